@@ -27,9 +27,19 @@ import (
 	"time"
 
 	"github.com/mumoshu/crossover/pkg/controller"
+	"github.com/mumoshu/crossover/pkg/reconciler"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "snapshots":
+			os.Exit(runSnapshots(os.Args[2:]))
+		case "render":
+			os.Exit(runRender(os.Args[2:]))
+		}
+	}
+
 	var tokenfile string
 
 	manager := &controller.Manager{}
@@ -44,6 +54,15 @@ func main() {
 	flag.StringVar(&manager.Server, "apiserver", "https://kubernetes", "K8s api endpoint")
 	flag.StringVar(&manager.OutputDir, "output-dir", "", "Directory to putput xDS configs so that Envoy can read")
 	flag.Var(&manager.ConfigMaps, "configmap", "the configmap to process.")
+	flag.StringVar(&manager.EnvoyAdmin, "envoy-admin", "", "the address of the Envoy admin API e.g. localhost:9901, to confirm that Envoy applied written files and roll back rejected ones")
+	flag.DurationVar(&manager.EnvoyAdminTimeout, "envoy-admin-timeout", reconciler.DefaultEnvoyAdminTimeout, "the time to wait for Envoy to apply written files")
+	flag.StringVar(&manager.XDSListen, "xds-listen", "", "the address to serve xDS configs over the REST-JSON xDS API e.g. :18000. Files are written only when --output-dir is also set")
+	flag.StringVar(&manager.ADSListen, "ads-listen", "", "the address to serve xDS configs over gRPC ADS e.g. :18001, along with the statuses of Envoys at /nodes. Files are written only when --output-dir is also set")
+	flag.Var(&manager.Secrets, "secret", "the kubernetes.io/tls secret to be written as the SDS config named sds-<secret>.yaml")
+	flag.Var(&manager.Endpoints, "endpoints", "the service whose endpoints are written as the EDS config named eds-<service>.yaml, in the form of <service>[:<port name>][=<cluster name>]. Can be specified multiple times")
+	flag.BoolVar(&manager.DiscoverEndpoints, "discover-endpoints", false, "Write the endpoints of the backends of trafficsplits and the services in the crossover.mumoshu.github.io/endpoints annotation of configmaps, besides --endpoints")
+	flag.Var(&manager.Overlays, "overlay", "the configmap to be patched into the configmaps. Can be specified multiple times to add overlays in order")
+	flag.Var(&manager.TemplateEnv, "template-env", "the environment variable that templates in configmaps can read via env, besides POD_NAME and POD_NAMESPACE. Can be specified multiple times")
 	flag.BoolVar(&manager.Noop, "dry-run", false, "print processed configmaps and secrets and do not submit them to the cluster.")
 	flag.BoolVar(&manager.Onetime, "onetime", false, "run one time and exit.")
 	flag.BoolVar(&manager.Insecure, "insecure", false, "disable tls server verification")
@@ -51,6 +70,21 @@ func main() {
 	flag.BoolVar(&manager.SMIEnabled, "smi", false, "Enable SMI integration")
 	flag.Var(&manager.TrafficSplits, "trafficsplit", "the trafficsplit to be watched and merged into the configmap")
 	flag.StringVar(&manager.SMITrafficSplitVersion, "trafficsplit-api-version", "v1alpha2", "API version of SMI TrafficSplits e.g. v1alpha1")
+	flag.BoolVar(&manager.FlaggerEnabled, "flagger", false, "Enable Flagger integration that reads Canary objects without SMI")
+	flag.Var(&manager.Canaries, "canary", "the flagger canary to be watched and merged into the configmap")
+	flag.StringVar(&manager.FlaggerCanaryVersion, "canary-api-version", "v1beta1", "API version of Flagger Canaries e.g. v1alpha3")
+	flag.BoolVar(&manager.ArgoRolloutsEnabled, "argo-rollouts", false, "Enable Argo Rollouts integration that reads canary weights from Rollout objects")
+	flag.Var(&manager.Rollouts, "rollout", "the argo rollout to be watched and merged into the configmap")
+	manager.FileMode = controller.FileMode(reconciler.DefaultFileMode)
+	manager.SecretFileMode = controller.FileMode(reconciler.DefaultSecretFileMode)
+	manager.DirMode = controller.FileMode(reconciler.DefaultDirMode)
+	flag.Var(&manager.FileMode, "file-mode", "the mode of written files in octal")
+	flag.Var(&manager.SecretFileMode, "secret-file-mode", "the mode of written files derived from secrets in octal")
+	flag.Var(&manager.DirMode, "dir-mode", "the mode of directories created under the output dir in octal")
+	flag.IntVar(&manager.History, "history", 0, "the number of snapshots of written files to keep per configmap or secret, to be pinned with the snapshots subcommand")
+	flag.StringVar(&manager.VersionInfo, "version-info", "", "set version_info of written files to the one derived from the content and the resourceVersion of the configmap. Either inject to add it when missing or override to replace it")
+	flag.IntVar(&manager.UID, "uid", -1, "the uid to own written files and directories. -1 to keep the owner")
+	flag.IntVar(&manager.GID, "gid", -1, "the gid to own written files and directories. -1 to keep the group")
 	flag.DurationVar(&manager.SyncInterval, "sync-interval", (60 * time.Second), "the time duration between template processing.")
 	flag.Parse()
 
@@ -58,6 +92,14 @@ func main() {
 		manager.SMIEnabled = true
 	}
 
+	if len(manager.Canaries) > 0 {
+		manager.FlaggerEnabled = true
+	}
+
+	if len(manager.Rollouts) > 0 {
+		manager.ArgoRolloutsEnabled = true
+	}
+
 	tokenBytes, err := ioutil.ReadFile(tokenfile)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "reading token: %v\n", err)
@@ -29,11 +29,19 @@ type Controller struct {
 	namespace string
 	resourceNames StringSlice
 
+	// discover returns the names of resources found at runtime, that are reconciled along with resourceNames
+	discover   func() ([]string, error)
+	discovered []string
+	mu         sync.Mutex
+
 	client     kubeclient.Client
 	reconciler reconciler.Reconciler
 	updated    chan string
 }
 
+// discoverInterval is how often resources are discovered while watching
+const discoverInterval = 30 * time.Second
+
 type Opts struct {
 	Insecure bool
 	Noop     bool
@@ -50,23 +58,51 @@ func NewController(namespace string, client kubeclient.Client, reconciler reconc
 	return sync
 }
 
+// names returns resourceNames and the names discovered. The names discovered last are kept on failure.
+func (s *Controller) names() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.discover != nil {
+		discovered, err := s.discover()
+		if err != nil {
+			log.Printf("Failed discovering resources: %v", err)
+		} else {
+			s.discovered = discovered
+		}
+	}
+
+	names := append([]string{}, s.resourceNames...)
+	seen := map[string]bool{}
+	for _, n := range names {
+		seen[n] = true
+	}
+	for _, n := range s.discovered {
+		if !seen[n] {
+			seen[n] = true
+			names = append(names, n)
+		}
+	}
+	return names
+}
+
 func (s *Controller) Poll(ctx context.Context, syncInterval time.Duration) error {
 	for {
-		for _, c := range s.resourceNames {
+		names := s.names()
+		for _, c := range names {
 			s.updated <- c
 		}
-		log.Printf("Enqueued %d resources. Next sync in %v seconds.", len(s.resourceNames), syncInterval.Seconds())
+		log.Printf("Enqueued %d resources. Next sync in %v seconds.", len(names), syncInterval.Seconds())
 		select {
 		case <-time.After(syncInterval):
 		case <-ctx.Done():
 			return nil
 		}
 	}
-	return nil
 }
 
 func (s *Controller) Once() error {
-	for _, c := range s.resourceNames {
+	for _, c := range s.names() {
 		if err := s.reconciler.Reconcile(c); err != nil {
 			return err
 		}
@@ -76,16 +112,34 @@ func (s *Controller) Once() error {
 
 func (s *Controller) Watch(ctx context.Context) error {
 	wg := sync.WaitGroup{}
+	watched := map[string]bool{}
 
-	for i := range s.resourceNames {
-		c := s.resourceNames[i]
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			if err := s.client.RetryWatch(ctx, s.namespace, c, s.updated); err != nil {
-				panic(fmt.Errorf("failed to watch %s: %v", c, err))
+WATCH:
+	for {
+		for _, c := range s.names() {
+			if watched[c] {
+				continue
 			}
-		}()
+			watched[c] = true
+			c := c
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := s.client.RetryWatch(ctx, s.namespace, c, s.updated); err != nil {
+					panic(fmt.Errorf("failed to watch %s: %v", c, err))
+				}
+			}()
+		}
+
+		// Resources discovered later are watched once they are found
+		if s.discover == nil {
+			break
+		}
+		select {
+		case <-time.After(discoverInterval):
+		case <-ctx.Done():
+			break WATCH
+		}
 	}
 
 	wg.Wait()
@@ -109,7 +163,6 @@ LOOP:
 			}
 		case <-ctx.Done():
 			break LOOP
-			return nil
 		}
 	}
 	return nil
@@ -1,6 +1,11 @@
 package controller
 
-import "strings"
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
 
 type StringSlice []string
 
@@ -13,3 +18,21 @@ func (s *StringSlice) Set(value string) error {
 	return nil
 }
 
+// FileMode is a flag value for permission bits written in octal, like 0644
+type FileMode os.FileMode
+
+func (m *FileMode) String() string {
+	return fmt.Sprintf("%#o", uint32(*m))
+}
+
+func (m *FileMode) Set(value string) error {
+	n, err := strconv.ParseUint(value, 8, 32)
+	if err != nil {
+		return fmt.Errorf("invalid file mode %q: %v", value, err)
+	}
+	if os.FileMode(n)&^os.ModePerm != 0 {
+		return fmt.Errorf("invalid file mode %q: only permission bits are allowed", value)
+	}
+	*m = FileMode(n)
+	return nil
+}
@@ -7,11 +7,14 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"os"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/mumoshu/crossover/pkg/kubeclient"
 	"github.com/mumoshu/crossover/pkg/reconciler"
+	"github.com/mumoshu/crossover/pkg/xds"
 )
 
 type Manager struct {
@@ -27,8 +30,49 @@ type Manager struct {
 	Onetime       bool
 	ConfigMaps    StringSlice
 	TrafficSplits StringSlice
+	// Overlays are configmaps patched into ConfigMaps in order, to write one Envoy snapshot made of all of them
+	Overlays StringSlice
+	// Secrets are `kubernetes.io/tls` secrets written as SDS files
+	Secrets StringSlice
+	// Endpoints are services whose endpoints are written as EDS files, like `<service>[:<port name>][=<cluster name>]`
+	Endpoints StringSlice
+	// DiscoverEndpoints writes the endpoints of the backends of TrafficSplits and the services in the
+	// `crossover.mumoshu.github.io/endpoints` annotation of ConfigMaps, besides Endpoints
+	DiscoverEndpoints bool
+
+	// FileMode, SecretFileMode and DirMode are the modes of written files and directories
+	FileMode       FileMode
+	SecretFileMode FileMode
+	DirMode        FileMode
+	// UID and GID are the owner of written files and directories. -1 keeps the owner as is
+	UID, GID int
+	// History is the number of snapshots to keep per configmap or secret
+	History int
+	// TemplateEnv are the environment variables that templates in configmaps can read, besides POD_NAME and POD_NAMESPACE
+	TemplateEnv StringSlice
+	// VersionInfo is either `inject` or `override`, to stamp `version_info` derived from the content of written files
+	VersionInfo string
+
+	// EnvoyAdmin is the address of Envoy's admin API like `localhost:9901`, to confirm that Envoy applied written files
+	// and roll back rejected ones
+	EnvoyAdmin        string
+	EnvoyAdminTimeout time.Duration
+
+	// XDSListen is the address to serve the snapshots over the REST-JSON xDS API, like `:18000`.
+	// Files are written only when OutputDir is also set.
+	XDSListen string
+	// ADSListen is the address to serve the snapshots over gRPC ADS, like `:18001`.
+	// Like XDSListen, files are written only when OutputDir is also set.
+	ADSListen string
 
 	SMITrafficSplitVersion string
+
+	FlaggerEnabled       bool
+	Canaries             StringSlice
+	FlaggerCanaryVersion string
+
+	ArgoRolloutsEnabled bool
+	Rollouts            StringSlice
 }
 
 func (m *Manager) Run(ctx context.Context) error {
@@ -42,9 +86,77 @@ func (m *Manager) Run(ctx context.Context) error {
 		HttpClient:   createHttpClient(m.Insecure),
 	}
 
-	var genConfigs []string
+	files := &reconciler.FileOptions{
+		FileMode:       os.FileMode(m.FileMode),
+		SecretFileMode: os.FileMode(m.SecretFileMode),
+		DirMode:        os.FileMode(m.DirMode),
+		UID:            m.UID,
+		GID:            m.GID,
+		History:        m.History,
+		VersionInfo:    m.VersionInfo,
+	}
+	switch m.VersionInfo {
+	case "", reconciler.VersionInfoInject, reconciler.VersionInfoOverride:
+	default:
+		return fmt.Errorf("invalid version info mode %q: must be either %q or %q", m.VersionInfo, reconciler.VersionInfoInject, reconciler.VersionInfoOverride)
+	}
+	if m.EnvoyAdmin != "" {
+		u := m.EnvoyAdmin
+		if !strings.Contains(u, "://") {
+			u = "http://" + u
+		}
+		files.EnvoyAdmin = &reconciler.EnvoyAdmin{
+			URL:        u,
+			HttpClient: &http.Client{Timeout: 5 * time.Second},
+			Timeout:    m.EnvoyAdminTimeout,
+		}
+	}
+
+	var (
+		snapshots reconciler.SnapshotStore
+		xdsServer *xds.Server
+		skipFiles bool
+	)
+	if (m.XDSListen != "" || m.ADSListen != "") && m.Onetime {
+		return fmt.Errorf("--xds-listen and --ads-listen can't be used with --onetime, as the xDS server stops as soon as configs are processed")
+	}
+	if m.XDSListen != "" || m.ADSListen != "" {
+		xdsServer = xds.NewServer()
+		snapshots = xdsServer
+		skipFiles = m.OutputDir == ""
+	}
+
+	if !skipFiles {
+		reconciler.CheckOutputDir(m.OutputDir)
+	}
+	output := reconciler.Output{
+		OutputDir: m.OutputDir,
+		Files:     files,
+		Snapshots: snapshots,
+		SkipFiles: skipFiles,
+	}
+
+	// Each weight source regenerates `<configmap>-gen` on its own, so combining them would make the last writer win
+	var weightSources []string
 	if m.SMIEnabled {
-		for _, c := range m.ConfigMaps {
+		weightSources = append(weightSources, "--smi(--trafficsplit)")
+	}
+	if m.FlaggerEnabled {
+		weightSources = append(weightSources, "--flagger(--canary)")
+	}
+	if m.ArgoRolloutsEnabled {
+		weightSources = append(weightSources, "--argo-rollouts(--rollout)")
+	}
+	if len(weightSources) > 1 {
+		return fmt.Errorf("%s cannot be combined: enable only one source of traffic weights", strings.Join(weightSources, ", "))
+	}
+
+	// The same configmap can be given more than once, to merge multiple trafficsplits into it
+	configMapNames := uniqueNames(m.ConfigMaps)
+
+	var genConfigs []string
+	if m.SMIEnabled || m.FlaggerEnabled || m.ArgoRolloutsEnabled {
+		for _, c := range configMapNames {
 			genCM := c + "-gen"
 			genConfigs = append(genConfigs, genCM)
 
@@ -53,29 +165,56 @@ func (m *Manager) Run(ctx context.Context) error {
 			}
 		}
 	} else {
-		genConfigs = m.ConfigMaps
-	}
-	configmaps := &Controller{
-		updated:   make(chan string),
-		namespace: m.Namespace,
-		client:    cmclient,
-		reconciler: &reconciler.ConfigmapReconciler{
-			Client:    cmclient,
-			Namespace: m.Namespace,
-			OutputDir: m.OutputDir,
-		},
-		resourceNames: genConfigs,
+		genConfigs = configMapNames
+	}
+	var configmaps []*Controller
+	if len(m.Overlays) > 0 {
+		// Each configmap is the base of its own stack of the overlays, so that every configmap is written on its own
+		// like it is without overlays
+		for _, base := range genConfigs {
+			layers := append([]string{base}, m.Overlays...)
+			configmaps = append(configmaps, &Controller{
+				updated:   make(chan string),
+				namespace: m.Namespace,
+				client:    cmclient,
+				reconciler: &reconciler.LayeredConfigmapReconciler{
+					Client:      cmclient,
+					Namespace:   m.Namespace,
+					Output:      output,
+					TemplateEnv: m.TemplateEnv,
+					Layers:      layers,
+				},
+				resourceNames: layers,
+			})
+		}
+	} else {
+		configmaps = append(configmaps, &Controller{
+			updated:   make(chan string),
+			namespace: m.Namespace,
+			client:    cmclient,
+			reconciler: &reconciler.ConfigmapReconciler{
+				Client:      cmclient,
+				Namespace:   m.Namespace,
+				Output:      output,
+				TemplateEnv: m.TemplateEnv,
+			},
+			resourceNames: genConfigs,
+		})
 	}
 
+	// Trafficsplits are also read to discover the services whose endpoints are written
+	var (
+		tsclient    *kubeclient.KubeClient
+		tsToConfigs = map[string]string{}
+	)
 	if m.SMIEnabled {
 		if len(m.ConfigMaps) != len(m.TrafficSplits) {
 			return fmt.Errorf("mismatching number of configmaps and trafficsplits")
 		}
-		tsToConfigs := map[string]string{}
 		for i := range m.ConfigMaps {
 			tsToConfigs[m.TrafficSplits[i]] = m.ConfigMaps[i]
 		}
-		tsclient := &kubeclient.KubeClient{
+		tsclient = &kubeclient.KubeClient{
 			Resource:     "trafficsplits",
 			GroupVersion: "apis/split.smi-spec.io/" + m.SMITrafficSplitVersion,
 			Server:       m.Server,
@@ -89,7 +228,7 @@ func (m *Manager) Run(ctx context.Context) error {
 			reconciler: &reconciler.TrafficSplitReconciler{
 				TrafficSplits: tsclient,
 				ConfigMaps:    cmclient,
-				TsToConfigs: tsToConfigs,
+				TsToConfigs:   tsToConfigs,
 				Namespace:     m.Namespace,
 			},
 			resourceNames: m.TrafficSplits,
@@ -99,7 +238,151 @@ func (m *Manager) Run(ctx context.Context) error {
 		// so that the former can create <configmap-name>-gen from <confgimap-name> that is rendered to the local fs
 		controllers = append(controllers, trafficsplits)
 	}
-	controllers = append(controllers, configmaps)
+
+	if m.FlaggerEnabled {
+		if len(m.ConfigMaps) != len(m.Canaries) {
+			return fmt.Errorf("mismatching number of configmaps and canaries")
+		}
+		canariesToConfigs := map[string]string{}
+		for i := range m.ConfigMaps {
+			canariesToConfigs[m.Canaries[i]] = m.ConfigMaps[i]
+		}
+		canaryclient := &kubeclient.KubeClient{
+			Resource:     "canaries",
+			GroupVersion: "apis/flagger.app/" + m.FlaggerCanaryVersion,
+			Server:       m.Server,
+			Token:        m.Token,
+			HttpClient:   createHttpClient(m.Insecure),
+		}
+		canaries := &Controller{
+			updated:   make(chan string),
+			namespace: m.Namespace,
+			client:    canaryclient,
+			reconciler: &reconciler.CanaryReconciler{
+				Canaries:          canaryclient,
+				ConfigMaps:        cmclient,
+				CanariesToConfigs: canariesToConfigs,
+				Namespace:         m.Namespace,
+			},
+			resourceNames: m.Canaries,
+		}
+		controllers = append(controllers, canaries)
+	}
+
+	if m.ArgoRolloutsEnabled {
+		if len(m.ConfigMaps) != len(m.Rollouts) {
+			return fmt.Errorf("mismatching number of configmaps and rollouts")
+		}
+		rolloutsToConfigs := map[string]string{}
+		for i := range m.ConfigMaps {
+			rolloutsToConfigs[m.Rollouts[i]] = m.ConfigMaps[i]
+		}
+		rolloutclient := &kubeclient.KubeClient{
+			Resource:     "rollouts",
+			GroupVersion: "apis/argoproj.io/v1alpha1",
+			Server:       m.Server,
+			Token:        m.Token,
+			HttpClient:   createHttpClient(m.Insecure),
+		}
+		rr := &reconciler.RolloutReconciler{
+			Rollouts:          rolloutclient,
+			ConfigMaps:        cmclient,
+			RolloutsToConfigs: rolloutsToConfigs,
+			Namespace:         m.Namespace,
+		}
+		rollouts := &Controller{
+			updated:       make(chan string),
+			namespace:     m.Namespace,
+			client:        rolloutclient,
+			reconciler:    rr,
+			resourceNames: m.Rollouts,
+		}
+		// Template configmaps are watched as well, as their annotations can set the canary weights
+		rolloutConfigMaps := &Controller{
+			updated:       make(chan string),
+			namespace:     m.Namespace,
+			client:        cmclient,
+			reconciler:    &reconciler.RolloutConfigMapReconciler{Rollouts: rr},
+			resourceNames: configMapNames,
+		}
+		controllers = append(controllers, rollouts, rolloutConfigMaps)
+	}
+	// Like the trafficsplits controller, the canaries and rollouts controllers need to be before configmaps controller
+	// to create <configmap-name>-gen
+	controllers = append(controllers, configmaps...)
+
+	if len(m.Secrets) > 0 {
+		secretclient := &kubeclient.KubeClient{
+			Resource:     "secrets",
+			GroupVersion: "api/v1",
+			Server:       m.Server,
+			Token:        m.Token,
+			HttpClient:   createHttpClient(m.Insecure),
+		}
+		secrets := &Controller{
+			updated:   make(chan string),
+			namespace: m.Namespace,
+			client:    secretclient,
+			reconciler: &reconciler.SecretReconciler{
+				Client:    secretclient,
+				Namespace: m.Namespace,
+				Output:    output,
+			},
+			resourceNames: m.Secrets,
+		}
+		controllers = append(controllers, secrets)
+	}
+
+	if len(m.Endpoints) > 0 || m.DiscoverEndpoints {
+		var services []string
+		targets := map[string]reconciler.EndpointsTarget{}
+		for _, e := range m.Endpoints {
+			t := reconciler.ParseEndpointsTarget(e)
+			services = append(services, t.Service)
+			targets[t.Service] = t
+		}
+		// Endpoints are named after services and are updated along with EndpointSlices, so they are watched instead of
+		// EndpointSlices whose names are generated
+		epclient := &kubeclient.KubeClient{
+			Resource:     "endpoints",
+			GroupVersion: "api/v1",
+			Server:       m.Server,
+			Token:        m.Token,
+			HttpClient:   createHttpClient(m.Insecure),
+		}
+		sliceclient := &kubeclient.KubeClient{
+			Resource:     "endpointslices",
+			GroupVersion: "apis/discovery.k8s.io/v1",
+			Server:       m.Server,
+			Token:        m.Token,
+			HttpClient:   createHttpClient(m.Insecure),
+		}
+		eps := &reconciler.EndpointsReconciler{
+			EndpointSlices: sliceclient,
+			Endpoints:      epclient,
+			Namespace:      m.Namespace,
+			Targets:        targets,
+			Output:         output,
+		}
+		endpoints := &Controller{
+			updated:       make(chan string),
+			namespace:     m.Namespace,
+			client:        epclient,
+			reconciler:    eps,
+			resourceNames: services,
+		}
+		if m.DiscoverEndpoints {
+			eps.Discovery = &reconciler.EndpointsDiscovery{
+				TrafficSplits:  tsclient,
+				ConfigMaps:     cmclient,
+				Namespace:      m.Namespace,
+				TsToConfigs:    tsToConfigs,
+				ConfigMapNames: configMapNames,
+			}
+			endpoints.discover = eps.Discovery.Discover
+		}
+		controllers = append(controllers, endpoints)
+	}
 
 	if m.Onetime {
 		for i := range controllers {
@@ -115,6 +398,26 @@ func (m *Manager) Run(ctx context.Context) error {
 
 	var wg sync.WaitGroup
 
+	if m.XDSListen != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := xdsServer.ListenAndServe(ctx, m.XDSListen); err != nil {
+				log.Fatalf("xDS server stopped due to error: %v", err)
+			}
+		}()
+	}
+
+	if m.ADSListen != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := xdsServer.ListenAndServeGRPC(ctx, m.ADSListen); err != nil {
+				log.Fatalf("ADS server stopped due to error: %v", err)
+			}
+		}()
+	}
+
 	for i := range controllers {
 		c := controllers[i]
 		wg.Add(1)
@@ -157,6 +460,20 @@ func (m *Manager) Run(ctx context.Context) error {
 	return nil
 }
 
+// uniqueNames returns the names without duplicates, in the order of their first appearance
+func uniqueNames(names []string) []string {
+	seen := map[string]bool{}
+	var res []string
+	for _, n := range names {
+		if seen[n] {
+			continue
+		}
+		seen[n] = true
+		res = append(res, n)
+	}
+	return res
+}
+
 func createHttpClient(insecure bool) *http.Client {
 	transport := &http.Transport{
 		Proxy: http.ProxyFromEnvironment,
@@ -9,6 +9,7 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"time"
 
 	"github.com/mumoshu/crossover/pkg/types"
@@ -19,6 +20,12 @@ type ReadOnlyClient interface {
 	RetryWatch(ctx context.Context, namespace, name string, updated chan string) error
 }
 
+// Lister lists objects with the label selector like `kubernetes.io/service-name=podinfo`,
+// decoding the list object whose `items` are the objects
+type Lister interface {
+	List(namespace, labelSelector string, obj interface{}) error
+}
+
 type Client interface {
 	ReadOnlyClient
 
@@ -36,6 +43,7 @@ type KubeClient struct {
 
 var _ ReadOnlyClient = &KubeClient{}
 var _ Client = &KubeClient{}
+var _ Lister = &KubeClient{}
 
 func (tp *KubeClient) Get(namespace, name string, obj interface{}) error {
 	u := fmt.Sprintf("%s/%s/namespaces/%s/%s/%s", tp.Server, tp.GroupVersion, namespace, tp.Resource, name)
@@ -73,6 +81,43 @@ func (tp *KubeClient) Get(namespace, name string, obj interface{}) error {
 	return nil
 }
 
+func (tp *KubeClient) List(namespace, labelSelector string, obj interface{}) error {
+	u := fmt.Sprintf("%s/%s/namespaces/%s/%s?labelSelector=%s", tp.Server, tp.GroupVersion, namespace, tp.Resource, url.QueryEscape(labelSelector))
+	client := tp.HttpClient
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return fmt.Errorf("http get request creation: %v", err)
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", tp.Token))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("http get: %v", err)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	// The API server responds with 404 when the resource isn't served, like EndpointSlices before Kubernetes 1.21
+	if resp.StatusCode == 404 {
+		log.Printf("List %s/%s: %s", namespace, tp.Resource, data)
+		return types.ErrNotExist
+	}
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("non 200 response code: %v: %v", resp.StatusCode, req)
+	}
+
+	if err := json.Unmarshal(data, obj); err != nil {
+		return err
+	}
+
+	return nil
+}
+
 // See https://kubernetes.io/docs/reference/generated/kubernetes-api/v1.10/#watch-64
 func (tp *KubeClient) RetryWatch(ctx context.Context, namespace, name string, updated chan string) error {
 	u := fmt.Sprintf("%s/%s/watch/namespaces/%s/%s/%s", tp.Server, tp.GroupVersion, namespace, tp.Resource, name)
@@ -0,0 +1,291 @@
+package query
+
+import (
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Queries work on yaml.Node trees as well as maps and slices, so that documents can be updated
+// without losing comments, key order and scalar styles.
+// Matched values are passed to callbacks as *yaml.Node, and values to be set or appended are converted to nodes.
+
+// Resolve returns the node the document or alias node points to
+func Resolve(n *yaml.Node) *yaml.Node {
+	for n != nil {
+		switch n.Kind {
+		case yaml.DocumentNode:
+			if len(n.Content) == 0 {
+				return nil
+			}
+			n = n.Content[0]
+		case yaml.AliasNode:
+			n = n.Alias
+		default:
+			return n
+		}
+	}
+	return nil
+}
+
+func walkNode(n *yaml.Node, ops []op, f func(interface{})) {
+	if len(ops) == 0 {
+		f(n)
+		return
+	}
+
+	n = Resolve(n)
+	if n == nil {
+		return
+	}
+
+	o, rest := ops[0], ops[1:]
+
+	switch o.kind {
+	case opKey:
+		if n.Kind == yaml.MappingNode {
+			for i := 0; i+1 < len(n.Content); i += 2 {
+				if n.Content[i].Value == o.key {
+					walkNode(n.Content[i+1], rest, f)
+				}
+			}
+		}
+	case opWildcard:
+		switch n.Kind {
+		case yaml.SequenceNode:
+			for _, e := range n.Content {
+				walkNode(e, rest, f)
+			}
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(n.Content); i += 2 {
+				walkNode(n.Content[i+1], rest, f)
+			}
+		}
+	case opIndex:
+		if n.Kind == yaml.SequenceNode {
+			if i, ok := resolveIndex(o.index, len(n.Content)); ok {
+				walkNode(n.Content[i], rest, f)
+			}
+		}
+	case opFilter:
+		if n.Kind == yaml.SequenceNode {
+			for _, e := range n.Content {
+				if o.expr.eval(e) {
+					walkNode(e, rest, f)
+				}
+			}
+		} else if o.expr.eval(n) {
+			walkNode(n, rest, f)
+		}
+	}
+}
+
+// updateNode is the yaml.Node counterpart of updateValue
+func updateNode(n *yaml.Node, ops []op, fn updateFunc) (interface{}, bool, int) {
+	if len(ops) == 0 {
+		res, a := fn(n, true)
+		switch a {
+		case actionReplace:
+			replaced, err := toNode(res)
+			if err != nil {
+				return n, false, 0
+			}
+			return InheritComments(replaced, n), false, 1
+		case actionDelete:
+			return nil, true, 1
+		}
+		return n, false, 0
+	}
+
+	target := Resolve(n)
+	if target == nil {
+		return n, false, 0
+	}
+
+	o, rest := ops[0], ops[1:]
+
+	switch o.kind {
+	case opKey:
+		if target.Kind != yaml.MappingNode {
+			return n, false, 0
+		}
+		total := 0
+		found := false
+		content := make([]*yaml.Node, 0, len(target.Content))
+		for i := 0; i+1 < len(target.Content); i += 2 {
+			k, v := target.Content[i], target.Content[i+1]
+			if k.Value != o.key {
+				content = append(content, k, v)
+				continue
+			}
+			found = true
+			res, del, c := updateNode(v, rest, fn)
+			total += c
+			if del {
+				continue
+			}
+			content = append(content, k, res.(*yaml.Node))
+		}
+		if !found && len(rest) == 0 {
+			res, a := fn(nil, false)
+			if a == actionReplace {
+				v, err := toNode(res)
+				if err != nil {
+					return n, false, 0
+				}
+				k := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: o.key}
+				content = append(content, k, v)
+				total++
+			}
+		}
+		target.Content = content
+		return n, false, total
+	case opWildcard:
+		switch target.Kind {
+		case yaml.SequenceNode:
+			return updateSequence(n, target, fn, rest, func(int, *yaml.Node) bool { return true })
+		case yaml.MappingNode:
+			total := 0
+			content := make([]*yaml.Node, 0, len(target.Content))
+			for i := 0; i+1 < len(target.Content); i += 2 {
+				res, del, c := updateNode(target.Content[i+1], rest, fn)
+				total += c
+				if del {
+					continue
+				}
+				content = append(content, target.Content[i], res.(*yaml.Node))
+			}
+			target.Content = content
+			return n, false, total
+		}
+	case opIndex:
+		if target.Kind == yaml.SequenceNode {
+			if idx, ok := resolveIndex(o.index, len(target.Content)); ok {
+				return updateSequence(n, target, fn, rest, func(i int, _ *yaml.Node) bool { return i == idx })
+			}
+		}
+	case opFilter:
+		if target.Kind == yaml.SequenceNode {
+			return updateSequence(n, target, fn, rest, func(_ int, e *yaml.Node) bool { return o.expr.eval(e) })
+		}
+		if o.expr.eval(target) {
+			return updateNode(n, rest, fn)
+		}
+	}
+
+	return n, false, 0
+}
+
+func updateSequence(n, seq *yaml.Node, fn updateFunc, rest []op, match func(int, *yaml.Node) bool) (interface{}, bool, int) {
+	total := 0
+	content := make([]*yaml.Node, 0, len(seq.Content))
+	for i, e := range seq.Content {
+		if !match(i, e) {
+			content = append(content, e)
+			continue
+		}
+		res, del, c := updateNode(e, rest, fn)
+		total += c
+		if del {
+			continue
+		}
+		content = append(content, res.(*yaml.Node))
+	}
+	seq.Content = content
+	return n, false, total
+}
+
+// appendNode is the yaml.Node counterpart of appending values to a list
+func appendNode(old *yaml.Node, values []interface{}) (interface{}, action) {
+	seq := Resolve(old)
+	if seq == nil || seq.Kind != yaml.SequenceNode {
+		if seq != nil && seq.Kind == yaml.ScalarNode && seq.Tag == "!!null" {
+			seq = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		} else {
+			return nil, actionSkip
+		}
+	}
+	for _, v := range values {
+		n, err := toNode(v)
+		if err != nil {
+			return nil, actionSkip
+		}
+		seq.Content = append(seq.Content, n)
+	}
+	return seq, actionReplace
+}
+
+// toNode converts a Go value to a yaml.Node
+func toNode(v interface{}) (*yaml.Node, error) {
+	if n, ok := v.(*yaml.Node); ok {
+		return n, nil
+	}
+	bs, err := yaml.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	doc := yaml.Node{}
+	if err := yaml.Unmarshal(bs, &doc); err != nil {
+		return nil, err
+	}
+	n := Resolve(&doc)
+	if n == nil {
+		return nil, fmt.Errorf("unable to convert %v to yaml node", v)
+	}
+	return n, nil
+}
+
+// InheritComments copies comments of the replaced node to the new node, so that replacing values keeps comments
+func InheritComments(n, replaced *yaml.Node) *yaml.Node {
+	if n == replaced {
+		return n
+	}
+	if n.HeadComment == "" {
+		n.HeadComment = replaced.HeadComment
+	}
+	if n.LineComment == "" {
+		n.LineComment = replaced.LineComment
+	}
+	if n.FootComment == "" {
+		n.FootComment = replaced.FootComment
+	}
+	return n
+}
+
+// Value returns the Go value of v when it is a scalar yaml.Node, or v as is otherwise.
+// It is useful to read values found by queries regardless of the representation of the document.
+func Value(v interface{}) interface{} {
+	n, ok := v.(*yaml.Node)
+	if !ok {
+		return v
+	}
+	n = Resolve(n)
+	if n == nil {
+		return nil
+	}
+	if n.Kind != yaml.ScalarNode {
+		return n
+	}
+	var x interface{}
+	if err := n.Decode(&x); err != nil {
+		return n.Value
+	}
+	return x
+}
+
+// expandValue returns the elements of a list value, or the value itself otherwise
+func expandValue(v interface{}) []interface{} {
+	if l, ok := v.([]interface{}); ok {
+		return l
+	}
+	if n, ok := v.(*yaml.Node); ok {
+		if n = Resolve(n); n != nil && n.Kind == yaml.SequenceNode {
+			res := make([]interface{}, len(n.Content))
+			for i, e := range n.Content {
+				res[i] = e
+			}
+			return res
+		}
+	}
+	return []interface{}{v}
+}
@@ -0,0 +1,423 @@
+package query
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// opKind is the kind of a primitive operation a path is compiled into
+type opKind int
+
+const (
+	// opKey selects the value of a key of a map
+	opKey opKind = iota
+	// opWildcard selects every element of a list, or every value of a map
+	opWildcard
+	// opIndex selects an element of a list by its index. Negative indices count from the end of the list
+	opIndex
+	// opFilter selects the elements of a list, or the map itself, that satisfies the expression
+	opFilter
+)
+
+type op struct {
+	kind  opKind
+	key   string
+	index int
+	expr  expr
+}
+
+// parser is a recursive descent parser for path expressions
+type parser struct {
+	src string
+	pos int
+}
+
+func parse(src string) ([]op, error) {
+	p := &parser{src: src}
+	ops, err := p.parsePath(true)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.src) {
+		return nil, p.errorf("unexpected %q", p.src[p.pos:])
+	}
+	return ops, nil
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("parsing %q at %d: %s", p.src, p.pos, fmt.Sprintf(format, args...))
+}
+
+func (p *parser) eof() bool {
+	return p.pos >= len(p.src)
+}
+
+func (p *parser) peek() byte {
+	if p.eof() {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+func (p *parser) skipSpaces() {
+	for !p.eof() && unicode.IsSpace(rune(p.src[p.pos])) {
+		p.pos++
+	}
+}
+
+func (p *parser) consume(s string) bool {
+	if strings.HasPrefix(p.src[p.pos:], s) {
+		p.pos += len(s)
+		return true
+	}
+	return false
+}
+
+// parsePath parses slash-separated steps.
+// At the top-level, a step like `name=foo` is a legacy filter equivalent to `[name=foo]`.
+// Within filter expressions, a path ends at the first character that can't be a part of a key, like an operator.
+func (p *parser) parsePath(topLevel bool) ([]op, error) {
+	var ops []op
+
+	p.consume("/")
+
+	if topLevel && p.eof() {
+		// The root
+		return nil, nil
+	}
+
+	for {
+		stepOps, present, err := p.parseStep(topLevel)
+		if err != nil {
+			return nil, err
+		}
+		if !present {
+			return nil, p.errorf("empty step")
+		}
+		ops = append(ops, stepOps...)
+
+		if !p.consume("/") {
+			break
+		}
+	}
+
+	return ops, nil
+}
+
+// parseStep parses a step, that is a key followed by zero or more brackets.
+// It returns false when there's no step at the current position.
+func (p *parser) parseStep(topLevel bool) ([]op, bool, error) {
+	var ops []op
+
+	start := p.pos
+	for !p.eof() {
+		c := p.peek()
+		if c == '/' || c == '[' {
+			break
+		}
+		if !topLevel && !isKeyChar(c) {
+			break
+		}
+		p.pos++
+	}
+	key := p.src[start:p.pos]
+
+	switch {
+	case key == "":
+	case key == "*":
+		ops = append(ops, op{kind: opWildcard})
+	case key == "@":
+		// The current value
+	case topLevel && strings.ContainsAny(key, "=!<>"):
+		e, err := parseExpr(key)
+		if err != nil {
+			return nil, false, p.errorf("%v", err)
+		}
+		ops = append(ops, op{kind: opFilter, expr: e})
+	default:
+		ops = append(ops, op{kind: opKey, key: key})
+	}
+
+	brackets := 0
+	for p.peek() == '[' {
+		p.pos++
+		o, err := p.parseBracket()
+		if err != nil {
+			return nil, false, err
+		}
+		ops = append(ops, o)
+		brackets++
+	}
+
+	return ops, key != "" || brackets > 0, nil
+}
+
+// parseBracket parses the content of `[...]` after the opening bracket, including the closing bracket
+func (p *parser) parseBracket() (op, error) {
+	p.skipSpaces()
+
+	var o op
+
+	switch {
+	case p.consume("*"):
+		o = op{kind: opWildcard}
+	case isIndexStart(p.src[p.pos:]):
+		start := p.pos
+		p.pos++
+		for !p.eof() && '0' <= p.peek() && p.peek() <= '9' {
+			p.pos++
+		}
+		i, err := strconv.Atoi(p.src[start:p.pos])
+		if err != nil {
+			return op{}, p.errorf("invalid index: %v", err)
+		}
+		o = op{kind: opIndex, index: i}
+	case isQuotedKey(p.src[p.pos:]):
+		s, err := p.parseQuoted()
+		if err != nil {
+			return op{}, err
+		}
+		o = op{kind: opKey, key: s}
+	default:
+		e, err := p.parseOr()
+		if err != nil {
+			return op{}, err
+		}
+		o = op{kind: opFilter, expr: e}
+	}
+
+	p.skipSpaces()
+	if !p.consume("]") {
+		return op{}, p.errorf("expected ]")
+	}
+
+	return o, nil
+}
+
+// isIndexStart returns true when s starts with an index followed by the closing bracket, like `0]` or `-1]`
+func isIndexStart(s string) bool {
+	i := 0
+	if i < len(s) && s[i] == '-' {
+		i++
+	}
+	digits := i
+	for i < len(s) && '0' <= s[i] && s[i] <= '9' {
+		i++
+	}
+	if i == digits {
+		return false
+	}
+	s = strings.TrimLeftFunc(s[i:], unicode.IsSpace)
+	return strings.HasPrefix(s, "]")
+}
+
+// isQuotedKey returns true when s starts with a quoted string followed by the closing bracket, like `"@type"]`
+func isQuotedKey(s string) bool {
+	if s == "" || (s[0] != '"' && s[0] != '\'') {
+		return false
+	}
+	p := &parser{src: s}
+	if _, err := p.parseQuoted(); err != nil {
+		return false
+	}
+	p.skipSpaces()
+	return p.peek() == ']'
+}
+
+func isKeyChar(c byte) bool {
+	return c == '_' || c == '-' || c == '.' || c == '@' || c == '*' ||
+		('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+}
+
+func (p *parser) parseQuoted() (string, error) {
+	quote := p.peek()
+	start := p.pos
+	p.pos++
+	var b strings.Builder
+	for !p.eof() {
+		c := p.peek()
+		p.pos++
+		switch c {
+		case '\\':
+			if p.eof() {
+				return "", p.errorf("unterminated string")
+			}
+			b.WriteByte(p.peek())
+			p.pos++
+		case quote:
+			return b.String(), nil
+		default:
+			b.WriteByte(c)
+		}
+	}
+	p.pos = start
+	return "", p.errorf("unterminated string")
+}
+
+// parseExpr parses a standalone filter expression like `name=foo`
+func parseExpr(src string) (expr, error) {
+	p := &parser{src: src}
+	e, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpaces()
+	if !p.eof() {
+		return nil, p.errorf("unexpected %q", p.src[p.pos:])
+	}
+	return e, nil
+}
+
+func (p *parser) parseOr() (expr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		p.skipSpaces()
+		if !p.consume("||") {
+			return left, nil
+		}
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orExpr{left: left, right: right}
+	}
+}
+
+func (p *parser) parseAnd() (expr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		p.skipSpaces()
+		if !p.consume("&&") {
+			return left, nil
+		}
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = andExpr{left: left, right: right}
+	}
+}
+
+func (p *parser) parseUnary() (expr, error) {
+	p.skipSpaces()
+
+	if p.peek() == '!' && !strings.HasPrefix(p.src[p.pos:], "!=") {
+		p.pos++
+		e, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notExpr{e: e}, nil
+	}
+
+	if p.consume("(") {
+		e, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		p.skipSpaces()
+		if !p.consume(")") {
+			return nil, p.errorf("expected )")
+		}
+		return e, nil
+	}
+
+	return p.parseComparison()
+}
+
+var comparisonOps = []string{"==", "!=", "<=", ">=", "=", "<", ">"}
+
+func (p *parser) parseComparison() (expr, error) {
+	p.skipSpaces()
+
+	var left operand
+
+	if c := p.peek(); c == '"' || c == '\'' {
+		s, err := p.parseQuoted()
+		if err != nil {
+			return nil, err
+		}
+		left = literalExpr{value: literal{kind: litString, s: s}}
+	} else {
+		ops, err := p.parsePath(false)
+		if err != nil {
+			return nil, err
+		}
+		left = pathExpr{ops: ops}
+	}
+
+	p.skipSpaces()
+
+	var operator string
+	for _, o := range comparisonOps {
+		if p.consume(o) {
+			operator = o
+			break
+		}
+	}
+
+	if operator == "" {
+		return existsExpr{operand: left}, nil
+	}
+	if operator == "==" {
+		operator = "="
+	}
+
+	p.skipSpaces()
+
+	right, err := p.parseLiteral()
+	if err != nil {
+		return nil, err
+	}
+
+	return compareExpr{left: left, op: operator, right: right}, nil
+}
+
+// parseLiteral parses a quoted string, or a bare word that is a number, `true`, `false`, `null` or a string
+func (p *parser) parseLiteral() (literal, error) {
+	if c := p.peek(); c == '"' || c == '\'' {
+		s, err := p.parseQuoted()
+		if err != nil {
+			return literal{}, err
+		}
+		return literal{kind: litString, s: s}, nil
+	}
+
+	start := p.pos
+	for !p.eof() {
+		c := p.peek()
+		if unicode.IsSpace(rune(c)) || c == ']' || c == ')' || strings.HasPrefix(p.src[p.pos:], "&&") || strings.HasPrefix(p.src[p.pos:], "||") {
+			break
+		}
+		p.pos++
+	}
+	word := p.src[start:p.pos]
+	if word == "" {
+		return literal{}, p.errorf("expected a value")
+	}
+
+	return bareLiteral(word), nil
+}
+
+func bareLiteral(word string) literal {
+	switch word {
+	case "true":
+		return literal{kind: litBool, b: true, s: word}
+	case "false":
+		return literal{kind: litBool, b: false, s: word}
+	case "null":
+		return literal{kind: litNull, s: word}
+	}
+	if f, err := strconv.ParseFloat(word, 64); err == nil {
+		return literal{kind: litNumber, f: f, s: word}
+	}
+	return literal{kind: litString, s: word}
+}
@@ -0,0 +1,524 @@
+// Package query implements a small JSONPath-like query language to find and update values within
+// YAML and JSON documents decoded into maps and slices, or into yaml.Node trees.
+//
+// A path is a list of slash-separated steps. Each step is a key, optionally followed by brackets:
+//
+//	resources/*/virtual_hosts[name=podinfo]/routes[0]/route/weighted_clusters/clusters[weight>0]
+//
+// `*` selects every element of a list or every value of a map. `[N]` selects the N-th element of a list, counting from
+// the end when negative. `["key"]` selects the value of a key that can't be written as is, like `["@type"]`.
+// `[expr]` selects the elements of a list that satisfy the expression, where expr is made of comparisons
+// (`=`, `==`, `!=`, `<`, `<=`, `>`, `>=`) between a relative path and a literal, existence checks of relative paths,
+// `!`, `&&`, `||` and parentheses. `@` denotes the element itself.
+//
+// A comparison is satisfied when any of the values the relative path resolves to satisfies it. When the value is a
+// list, each element is compared, so that `virtual_hosts[domains=example.com]` selects virtual hosts containing
+// the domain.
+//
+// For compatibility with the original path syntax of crossover, a step like `name=foo` is equivalent to `[name=foo]`.
+package query
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Query is a compiled path expression
+type Query struct {
+	src string
+	ops []op
+}
+
+// Parse compiles the path expression
+func Parse(path string) (*Query, error) {
+	ops, err := parse(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Query{src: path, ops: ops}, nil
+}
+
+// MustParse is like Parse but panics when the path is invalid
+func MustParse(path string) *Query {
+	q, err := Parse(path)
+	if err != nil {
+		panic(err)
+	}
+	return q
+}
+
+// Key returns the query that selects the value of the key, which can contain any character
+func Key(key string) *Query {
+	src := `["` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(key) + `"]`
+	return &Query{src: src, ops: []op{{kind: opKey, key: key}}}
+}
+
+// String returns the source of the query
+func (q *Query) String() string {
+	return q.src
+}
+
+// Find returns all the values matched by the query, in document order
+func (q *Query) Find(root interface{}) []interface{} {
+	var res []interface{}
+	walk(root, q.ops, func(v interface{}) {
+		res = append(res, v)
+	})
+	return res
+}
+
+// Each calls f for each value matched by the query, and returns true if any value is matched
+func (q *Query) Each(root interface{}, f func(interface{})) bool {
+	found := false
+	walk(root, q.ops, func(v interface{}) {
+		found = true
+		f(v)
+	})
+	return found
+}
+
+// Set replaces all the values matched by the query with value.
+// When the last step of the query is a key missing in a matched map, the key is added to the map.
+// It returns the updated root, which differs from the original only when the root itself is replaced,
+// and the number of values set.
+func (q *Query) Set(root interface{}, value interface{}) (interface{}, int) {
+	return update(root, q.ops, func(_ interface{}, _ bool) (interface{}, action) {
+		return value, actionReplace
+	})
+}
+
+// Delete removes all the values matched by the query from their parent maps and lists.
+// It returns the updated root, and the number of values deleted.
+func (q *Query) Delete(root interface{}) (interface{}, int) {
+	return update(root, q.ops, func(_ interface{}, exists bool) (interface{}, action) {
+		if !exists {
+			return nil, actionSkip
+		}
+		return nil, actionDelete
+	})
+}
+
+// Append appends values to all the lists matched by the query.
+// When the last step of the query is a key missing in a matched map, a list is created.
+// It returns the updated root, and the number of lists appended to.
+func (q *Query) Append(root interface{}, values ...interface{}) (interface{}, int) {
+	return update(root, q.ops, func(old interface{}, exists bool) (interface{}, action) {
+		if !exists || old == nil {
+			return append([]interface{}{}, values...), actionReplace
+		}
+		if n, ok := old.(*yaml.Node); ok {
+			return appendNode(n, values)
+		}
+		l, ok := old.([]interface{})
+		if !ok {
+			return nil, actionSkip
+		}
+		return append(l, values...), actionReplace
+	})
+}
+
+func walk(v interface{}, ops []op, f func(interface{})) {
+	if n, ok := v.(*yaml.Node); ok {
+		walkNode(n, ops, f)
+		return
+	}
+
+	if len(ops) == 0 {
+		f(v)
+		return
+	}
+
+	o, rest := ops[0], ops[1:]
+
+	switch o.kind {
+	case opKey:
+		if m, ok := v.(map[string]interface{}); ok {
+			if child, ok := m[o.key]; ok {
+				walk(child, rest, f)
+			}
+		}
+	case opWildcard:
+		switch t := v.(type) {
+		case []interface{}:
+			for _, e := range t {
+				walk(e, rest, f)
+			}
+		case map[string]interface{}:
+			for _, k := range sortedKeys(t) {
+				walk(t[k], rest, f)
+			}
+		}
+	case opIndex:
+		if l, ok := v.([]interface{}); ok {
+			if i, ok := resolveIndex(o.index, len(l)); ok {
+				walk(l[i], rest, f)
+			}
+		}
+	case opFilter:
+		if l, ok := v.([]interface{}); ok {
+			for _, e := range l {
+				if o.expr.eval(e) {
+					walk(e, rest, f)
+				}
+			}
+		} else if o.expr.eval(v) {
+			walk(v, rest, f)
+		}
+	}
+}
+
+type action int
+
+const (
+	actionSkip action = iota
+	actionReplace
+	actionDelete
+)
+
+// updateFunc computes the new value for a matched value. exists is false when the value is missing in a map.
+type updateFunc func(old interface{}, exists bool) (interface{}, action)
+
+// update applies fn to the values matched by ops, and returns the updated v and the number of updated values
+func update(v interface{}, ops []op, fn updateFunc) (interface{}, int) {
+	res, del, n := updateValue(v, ops, fn)
+	if del {
+		return nil, n
+	}
+	return res, n
+}
+
+// updateValue returns the updated value, true if the value itself should be deleted from its parent,
+// and the number of updated values
+func updateValue(v interface{}, ops []op, fn updateFunc) (interface{}, bool, int) {
+	if n, ok := v.(*yaml.Node); ok {
+		return updateNode(n, ops, fn)
+	}
+
+	if len(ops) == 0 {
+		res, a := fn(v, true)
+		switch a {
+		case actionReplace:
+			return res, false, 1
+		case actionDelete:
+			return nil, true, 1
+		}
+		return v, false, 0
+	}
+
+	o, rest := ops[0], ops[1:]
+
+	switch o.kind {
+	case opKey:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return v, false, 0
+		}
+		child, exists := m[o.key]
+		if !exists {
+			if len(rest) > 0 {
+				return v, false, 0
+			}
+			res, a := fn(nil, false)
+			if a == actionReplace {
+				m[o.key] = res
+				return v, false, 1
+			}
+			return v, false, 0
+		}
+		res, del, n := updateValue(child, rest, fn)
+		if del {
+			delete(m, o.key)
+		} else if n > 0 {
+			m[o.key] = res
+		}
+		return v, false, n
+	case opWildcard:
+		switch t := v.(type) {
+		case []interface{}:
+			return updateList(t, fn, rest, func(int, interface{}) bool { return true })
+		case map[string]interface{}:
+			total := 0
+			for _, k := range sortedKeys(t) {
+				res, del, n := updateValue(t[k], rest, fn)
+				if del {
+					delete(t, k)
+				} else if n > 0 {
+					t[k] = res
+				}
+				total += n
+			}
+			return v, false, total
+		}
+	case opIndex:
+		if l, ok := v.([]interface{}); ok {
+			if idx, ok := resolveIndex(o.index, len(l)); ok {
+				return updateList(l, fn, rest, func(i int, _ interface{}) bool { return i == idx })
+			}
+		}
+	case opFilter:
+		if l, ok := v.([]interface{}); ok {
+			return updateList(l, fn, rest, func(_ int, e interface{}) bool { return o.expr.eval(e) })
+		}
+		if o.expr.eval(v) {
+			return updateValue(v, rest, fn)
+		}
+	}
+
+	return v, false, 0
+}
+
+// updateList applies the rest of ops to the elements of l that match, removing elements to be deleted
+func updateList(l []interface{}, fn updateFunc, rest []op, match func(int, interface{}) bool) (interface{}, bool, int) {
+	total := 0
+	deleted := false
+	res := make([]interface{}, 0, len(l))
+	for i, e := range l {
+		if !match(i, e) {
+			res = append(res, e)
+			continue
+		}
+		u, del, n := updateValue(e, rest, fn)
+		total += n
+		if del {
+			deleted = true
+			continue
+		}
+		res = append(res, u)
+	}
+	if !deleted {
+		// Keep the identity of the original slice so that it can be updated in place
+		copy(l, res)
+		return l, false, total
+	}
+	return res, false, total
+}
+
+func resolveIndex(i, length int) (int, bool) {
+	if i < 0 {
+		i += length
+	}
+	if i < 0 || i >= length {
+		return 0, false
+	}
+	return i, true
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type expr interface {
+	eval(v interface{}) bool
+}
+
+// operand is an expression that resolves to zero or more values
+type operand interface {
+	values(v interface{}) []interface{}
+}
+
+type andExpr struct {
+	left, right expr
+}
+
+func (e andExpr) eval(v interface{}) bool {
+	return e.left.eval(v) && e.right.eval(v)
+}
+
+type orExpr struct {
+	left, right expr
+}
+
+func (e orExpr) eval(v interface{}) bool {
+	return e.left.eval(v) || e.right.eval(v)
+}
+
+type notExpr struct {
+	e expr
+}
+
+func (e notExpr) eval(v interface{}) bool {
+	return !e.e.eval(v)
+}
+
+type existsExpr struct {
+	operand operand
+}
+
+func (e existsExpr) eval(v interface{}) bool {
+	for _, x := range e.operand.values(v) {
+		x = Value(x)
+		if x != nil {
+			if b, ok := x.(bool); ok && !b {
+				continue
+			}
+			return true
+		}
+	}
+	return false
+}
+
+type pathExpr struct {
+	ops []op
+}
+
+func (e pathExpr) values(v interface{}) []interface{} {
+	var res []interface{}
+	walk(v, e.ops, func(x interface{}) {
+		res = append(res, x)
+	})
+	return res
+}
+
+type literalExpr struct {
+	value literal
+}
+
+func (e literalExpr) values(v interface{}) []interface{} {
+	return []interface{}{e.value.native()}
+}
+
+func (e literalExpr) eval(v interface{}) bool {
+	return existsExpr{operand: e}.eval(v)
+}
+
+type compareExpr struct {
+	left  operand
+	op    string
+	right literal
+}
+
+func (e compareExpr) eval(v interface{}) bool {
+	var candidates []interface{}
+	for _, x := range e.left.values(v) {
+		for _, c := range expandValue(x) {
+			candidates = append(candidates, Value(c))
+		}
+	}
+
+	if e.op == "!=" {
+		for _, c := range candidates {
+			if e.right.compare(c, "=") {
+				return false
+			}
+		}
+		return true
+	}
+
+	for _, c := range candidates {
+		if e.right.compare(c, e.op) {
+			return true
+		}
+	}
+	return false
+}
+
+type literalKind int
+
+const (
+	litString literalKind = iota
+	litNumber
+	litBool
+	litNull
+)
+
+type literal struct {
+	kind literalKind
+	// s is the string value for string literals, and the source text for other literals
+	s string
+	f float64
+	b bool
+}
+
+func (l literal) native() interface{} {
+	switch l.kind {
+	case litNumber:
+		return l.f
+	case litBool:
+		return l.b
+	case litNull:
+		return nil
+	}
+	return l.s
+}
+
+// compare returns the result of `v <op> l`
+func (l literal) compare(v interface{}, op string) bool {
+	if l.kind == litNumber {
+		if f, ok := toFloat(v); ok {
+			return compareFloats(f, l.f, op)
+		}
+	}
+
+	switch t := v.(type) {
+	case string:
+		return compareStrings(t, l.s, op)
+	case bool:
+		if l.kind == litBool && (op == "=") {
+			return t == l.b
+		}
+		return compareStrings(strconv.FormatBool(t), l.s, op)
+	case nil:
+		return l.kind == litNull && op == "="
+	case map[string]interface{}, []interface{}, *yaml.Node:
+		return false
+	}
+
+	return compareStrings(fmt.Sprint(v), l.s, op)
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch t := v.(type) {
+	case int:
+		return float64(t), true
+	case int64:
+		return float64(t), true
+	case uint64:
+		return float64(t), true
+	case float64:
+		return t, true
+	case float32:
+		return float64(t), true
+	}
+	return 0, false
+}
+
+func compareFloats(a, b float64, op string) bool {
+	switch op {
+	case "=":
+		return a == b
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	case ">":
+		return a > b
+	case ">=":
+		return a >= b
+	}
+	return false
+}
+
+func compareStrings(a, b string, op string) bool {
+	switch op {
+	case "=":
+		return a == b
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	case ">":
+		return a > b
+	case ">=":
+		return a >= b
+	}
+	return false
+}
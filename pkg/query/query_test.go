@@ -0,0 +1,319 @@
+package query
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"gopkg.in/yaml.v3"
+)
+
+const rds = `resources:
+- name: podinfo
+  virtual_hosts:
+  - name: podinfo
+    domains:
+    - podinfo.example.com
+    - podinfo
+    routes:
+    - name: primary
+      match:
+        prefix: /
+      route:
+        weighted_clusters:
+          clusters:
+          - name: podinfo-v1
+            weight: 90
+          - name: podinfo-v2
+            weight: 10
+    - name: secondary
+      match:
+        prefix: /api
+      route:
+        weighted_clusters:
+          clusters:
+          - name: podinfo-v1
+            weight: 100
+  - name: name=with=equals
+    domains:
+    - other.example.com
+    routes: []
+`
+
+func load(t *testing.T) map[string]interface{} {
+	t.Helper()
+	m := map[string]interface{}{}
+	if err := yaml.Unmarshal([]byte(rds), &m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestFind(t *testing.T) {
+	testcases := []struct {
+		path     string
+		expected []interface{}
+	}{
+		{
+			path:     "resources/*/virtual_hosts/name=podinfo/routes/*/name",
+			expected: []interface{}{"primary", "secondary"},
+		},
+		{
+			path:     "/resources[0]/virtual_hosts[0]/routes[-1]/name",
+			expected: []interface{}{"secondary"},
+		},
+		{
+			path:     "resources/*/virtual_hosts[domains=podinfo.example.com]/name",
+			expected: []interface{}{"podinfo"},
+		},
+		{
+			path:     "resources/*/virtual_hosts/*/routes[match/prefix='/api']/name",
+			expected: []interface{}{"secondary"},
+		},
+		{
+			path:     "resources/*/virtual_hosts/*/routes/*/route/weighted_clusters/clusters[weight>=10 && weight<100]/name",
+			expected: []interface{}{"podinfo-v1", "podinfo-v2"},
+		},
+		{
+			path:     "resources/*/virtual_hosts/*/routes/*/route/weighted_clusters/clusters[name!=podinfo-v1 || weight=100]/weight",
+			expected: []interface{}{10, 100},
+		},
+		{
+			path:     "resources/*/virtual_hosts/*/routes[route/weighted_clusters/clusters[name=podinfo-v2]]/name",
+			expected: []interface{}{"primary"},
+		},
+		{
+			path:     "resources/*/virtual_hosts/*/routes[!(route/weighted_clusters/clusters[weight<100])]/name",
+			expected: []interface{}{"secondary"},
+		},
+		{
+			path:     "resources/*/virtual_hosts[name='name=with=equals']/domains[@>p]",
+			expected: nil,
+		},
+		{
+			path:     "resources/*/virtual_hosts[name=\"name=with=equals\"]/domains[@<p]",
+			expected: []interface{}{"other.example.com"},
+		},
+		{
+			path:     "resources/*/virtual_hosts/*/domains/*",
+			expected: []interface{}{"podinfo.example.com", "podinfo", "other.example.com"},
+		},
+		{
+			path:     "resources/*/virtual_hosts/name=nonexistent/name",
+			expected: nil,
+		},
+	}
+
+	for _, tc := range testcases {
+		q, err := Parse(tc.path)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.path, err)
+			continue
+		}
+		actual := q.Find(load(t))
+		if diff := cmp.Diff(tc.expected, actual); diff != "" {
+			t.Errorf("%s: %s", tc.path, diff)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, path := range []string{
+		"resources//name",
+		"resources[",
+		"resources[name=foo",
+		"resources[(name=foo]",
+		"resources[name=]",
+		"resources['foo]",
+	} {
+		if _, err := Parse(path); err == nil {
+			t.Errorf("%s: expected error", path)
+		}
+	}
+}
+
+func TestSet(t *testing.T) {
+	m := load(t)
+
+	_, n := MustParse("resources/*/virtual_hosts/*/routes/*/route/weighted_clusters/clusters[name=podinfo-v1]/weight").Set(m, 50)
+	if n != 2 {
+		t.Errorf("unexpected number of updates: %d", n)
+	}
+
+	_, n = MustParse("resources/*/virtual_hosts/*/routes/*/route/weighted_clusters/total_weight").Set(m, 100)
+	if n != 2 {
+		t.Errorf("unexpected number of updates: %d", n)
+	}
+
+	actual := MustParse("resources/*/virtual_hosts/*/routes/*/route/weighted_clusters").Find(m)
+	expected := []interface{}{
+		map[string]interface{}{
+			"total_weight": 100,
+			"clusters": []interface{}{
+				map[string]interface{}{"name": "podinfo-v1", "weight": 50},
+				map[string]interface{}{"name": "podinfo-v2", "weight": 10},
+			},
+		},
+		map[string]interface{}{
+			"total_weight": 100,
+			"clusters": []interface{}{
+				map[string]interface{}{"name": "podinfo-v1", "weight": 50},
+			},
+		},
+	}
+	if diff := cmp.Diff(expected, actual); diff != "" {
+		t.Errorf(diff)
+	}
+
+	_, n = MustParse("resources/*/nonexistent/name").Set(m, "foo")
+	if n != 0 {
+		t.Errorf("unexpected number of updates: %d", n)
+	}
+}
+
+func TestKey(t *testing.T) {
+	for _, k := range []string{"weight", "@type", `a"b\c`, "a/b[0]", `\u00e9`} {
+		m := map[string]interface{}{}
+		if _, n := Key(k).Set(m, 1); n != 1 {
+			t.Errorf("%q: unexpected number of updates: %d", k, n)
+		}
+		if diff := cmp.Diff(map[string]interface{}{k: 1}, m); diff != "" {
+			t.Errorf("%q: %s", k, diff)
+		}
+
+		parsed, err := Parse(Key(k).String())
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %v", k, err)
+		}
+		if diff := cmp.Diff([]interface{}{1}, parsed.Find(m)); diff != "" {
+			t.Errorf("%q: %s", k, diff)
+		}
+	}
+}
+
+func TestDelete(t *testing.T) {
+	m := load(t)
+
+	_, n := MustParse("resources/*/virtual_hosts/*/routes/*/route/weighted_clusters/clusters[name=podinfo-v2]").Delete(m)
+	if n != 1 {
+		t.Errorf("unexpected number of deletions: %d", n)
+	}
+
+	_, n = MustParse("resources/*/virtual_hosts/*/domains[@=podinfo]").Delete(m)
+	if n != 1 {
+		t.Errorf("unexpected number of deletions: %d", n)
+	}
+
+	_, n = MustParse("resources/*/virtual_hosts/*/routes/*/match").Delete(m)
+	if n != 2 {
+		t.Errorf("unexpected number of deletions: %d", n)
+	}
+
+	actual := MustParse("resources[0]/virtual_hosts[0]").Find(m)
+	expected := []interface{}{
+		map[string]interface{}{
+			"name":    "podinfo",
+			"domains": []interface{}{"podinfo.example.com"},
+			"routes": []interface{}{
+				map[string]interface{}{
+					"name": "primary",
+					"route": map[string]interface{}{
+						"weighted_clusters": map[string]interface{}{
+							"clusters": []interface{}{
+								map[string]interface{}{"name": "podinfo-v1", "weight": 90},
+							},
+						},
+					},
+				},
+				map[string]interface{}{
+					"name": "secondary",
+					"route": map[string]interface{}{
+						"weighted_clusters": map[string]interface{}{
+							"clusters": []interface{}{
+								map[string]interface{}{"name": "podinfo-v1", "weight": 100},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	if diff := cmp.Diff(expected, actual); diff != "" {
+		t.Errorf(diff)
+	}
+
+	root, n := MustParse("[name=b]").Delete([]interface{}{
+		map[string]interface{}{"name": "a"},
+		map[string]interface{}{"name": "b"},
+	})
+	if n != 1 {
+		t.Errorf("unexpected number of deletions: %d", n)
+	}
+	if diff := cmp.Diff([]interface{}{map[string]interface{}{"name": "a"}}, root); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestAppend(t *testing.T) {
+	m := load(t)
+
+	_, n := MustParse("resources/*/virtual_hosts/name=podinfo/routes/name=primary/route/weighted_clusters/clusters").Append(m,
+		map[string]interface{}{"name": "podinfo-v3", "weight": 0},
+	)
+	if n != 1 {
+		t.Errorf("unexpected number of appends: %d", n)
+	}
+
+	_, n = MustParse("resources/*/virtual_hosts/*/retry_policies").Append(m, "5xx")
+	if n != 2 {
+		t.Errorf("unexpected number of appends: %d", n)
+	}
+
+	actual := MustParse("resources/*/virtual_hosts/*/routes/name=primary/route/weighted_clusters/clusters/*/name").Find(m)
+	if diff := cmp.Diff([]interface{}{"podinfo-v1", "podinfo-v2", "podinfo-v3"}, actual); diff != "" {
+		t.Errorf(diff)
+	}
+
+	actual = MustParse("resources/*/virtual_hosts/*/retry_policies").Find(m)
+	if diff := cmp.Diff([]interface{}{[]interface{}{"5xx"}, []interface{}{"5xx"}}, actual); diff != "" {
+		t.Errorf(diff)
+	}
+
+	_, n = MustParse("resources/*/virtual_hosts/*/name").Append(m, "foo")
+	if n != 0 {
+		t.Errorf("unexpected number of appends to non-list values: %d", n)
+	}
+}
+
+func TestNode(t *testing.T) {
+	doc := &yaml.Node{}
+	if err := yaml.Unmarshal([]byte("# head\nclusters:\n- name: a # first\n  weight: 1\n- name: b\n  weight: 2\n"), doc); err != nil {
+		t.Fatal(err)
+	}
+
+	actual := []interface{}{}
+	MustParse("clusters[weight>1]/name").Each(doc, func(v interface{}) {
+		actual = append(actual, Value(v))
+	})
+	if diff := cmp.Diff([]interface{}{"b"}, actual); diff != "" {
+		t.Errorf(diff)
+	}
+
+	if _, n := MustParse("clusters[name=a]/weight").Set(doc, 3); n != 1 {
+		t.Errorf("unexpected number of updates: %d", n)
+	}
+	if _, n := MustParse("clusters[name=b]").Delete(doc); n != 1 {
+		t.Errorf("unexpected number of deletions: %d", n)
+	}
+	if _, n := MustParse("clusters").Append(doc, map[string]interface{}{"name": "c"}); n != 1 {
+		t.Errorf("unexpected number of appends: %d", n)
+	}
+
+	out, err := yaml.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "# head\nclusters:\n    - name: a # first\n      weight: 3\n    - name: c\n"
+	if diff := cmp.Diff(expected, string(out)); diff != "" {
+		t.Errorf(diff)
+	}
+}
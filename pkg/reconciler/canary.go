@@ -0,0 +1,123 @@
+package reconciler
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/mumoshu/crossover/pkg/kubeclient"
+	"github.com/mumoshu/crossover/pkg/types"
+)
+
+// CanaryReconciler translates the status of Flagger Canary objects into primary/canary cluster weights,
+// so that Flagger-driven rollouts work without installing SMI TrafficSplit CRDs.
+type CanaryReconciler struct {
+	Canaries          kubeclient.ReadOnlyClient
+	ConfigMaps        kubeclient.Client
+	Namespace         string
+	CanariesToConfigs map[string]string
+}
+
+// Reconcile merges all the canaries that target the same template configmap as the named canary at once
+func (r *CanaryReconciler) Reconcile(name string) error {
+	tplCmName, ok := r.CanariesToConfigs[name]
+	if !ok {
+		panic(fmt.Sprintf("detected misconfiguration: no configmap name defined for canary named %q", name))
+	}
+
+	var tss []TrafficSplit
+	for _, n := range namesForConfig(r.CanariesToConfigs, tplCmName) {
+		canary := Canary{}
+		err := r.Canaries.Get(r.Namespace, n, &canary)
+		if err != nil {
+			if err == types.ErrNotExist {
+				log.Printf("Canary %s/%s not found. Skipping reconcilation. This will be retried soon", r.Namespace, n)
+				continue
+			}
+			log.Printf("Unexpected error while getting Canary %s/%s: %v", r.Namespace, n, err)
+			return err
+		}
+
+		log.Printf("Reconciling canary %s/%s: phase=%s, canaryWeight=%d", r.Namespace, n, canary.Status.Phase, canary.Status.CanaryWeight)
+
+		tss = append(tss, canary.TrafficSplit())
+	}
+
+	if len(tss) == 0 {
+		return nil
+	}
+
+	return applyTrafficSplits(r.ConfigMaps, r.Namespace, tplCmName, tss...)
+}
+
+// Canary is the subset of Flagger's Canary resource that is needed to compute traffic weights.
+// See https://docs.flagger.app/usage/how-it-works#canary-resource
+type Canary struct {
+	ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   CanarySpec   `json:"spec,omitempty"`
+	Status CanaryStatus `json:"status,omitempty"`
+}
+
+type CanarySpec struct {
+	TargetRef CanaryTargetRef `json:"targetRef,omitempty"`
+	Service   CanaryService   `json:"service,omitempty"`
+}
+
+type CanaryTargetRef struct {
+	Kind string `json:"kind,omitempty"`
+	Name string `json:"name,omitempty"`
+}
+
+type CanaryService struct {
+	// Name overrides the apex service name, which defaults to the name of the target
+	Name string `json:"name,omitempty"`
+}
+
+type CanaryStatus struct {
+	Phase        string `json:"phase,omitempty"`
+	CanaryWeight int    `json:"canaryWeight,omitempty"`
+}
+
+// canaryPhasesRoutingToCanary are the Flagger canary phases in which status.canaryWeight is in effect.
+// In any other phase, e.g. Initialized, Finalising, Succeeded and Failed, Flagger routes all the traffic to the primary.
+var canaryPhasesRoutingToCanary = map[string]bool{
+	"Waiting":          true,
+	"Progressing":      true,
+	"WaitingPromotion": true,
+	"Promoting":        true,
+}
+
+// ApexService returns the name of the service that is split into the primary and the canary.
+func (c Canary) ApexService() string {
+	if c.Spec.Service.Name != "" {
+		return c.Spec.Service.Name
+	}
+	return c.Spec.TargetRef.Name
+}
+
+// TrafficSplit returns the TrafficSplit equivalent to the current state of the canary,
+// following Flagger's `<apex>-primary` and `<apex>-canary` service naming.
+func (c Canary) TrafficSplit() TrafficSplit {
+	apex := c.ApexService()
+
+	canaryWeight := 0
+	if canaryPhasesRoutingToCanary[c.Status.Phase] {
+		canaryWeight = c.Status.CanaryWeight
+	}
+	if canaryWeight < 0 {
+		canaryWeight = 0
+	} else if canaryWeight > 100 {
+		canaryWeight = 100
+	}
+
+	return TrafficSplit{
+		ObjectMeta: c.ObjectMeta,
+		Spec: TrafficSplitSpec{
+			Service: apex,
+			Backends: []TrafficSplitBackend{
+				{Service: apex + "-primary", Weight: 100 - canaryWeight},
+				{Service: apex + "-canary", Weight: canaryWeight},
+			},
+		},
+	}
+}
@@ -0,0 +1,55 @@
+package reconciler
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCanaryTrafficSplit(t *testing.T) {
+	testcases := []struct {
+		canary   Canary
+		expected []TrafficSplitBackend
+	}{
+		{
+			canary: Canary{
+				Spec:   CanarySpec{TargetRef: CanaryTargetRef{Kind: "Deployment", Name: "podinfo"}},
+				Status: CanaryStatus{Phase: "Progressing", CanaryWeight: 30},
+			},
+			expected: []TrafficSplitBackend{
+				{Service: "podinfo-primary", Weight: 70},
+				{Service: "podinfo-canary", Weight: 30},
+			},
+		},
+		{
+			canary: Canary{
+				Spec: CanarySpec{
+					TargetRef: CanaryTargetRef{Kind: "Deployment", Name: "podinfo"},
+					Service:   CanaryService{Name: "frontend"},
+				},
+				Status: CanaryStatus{Phase: "Promoting", CanaryWeight: 50},
+			},
+			expected: []TrafficSplitBackend{
+				{Service: "frontend-primary", Weight: 50},
+				{Service: "frontend-canary", Weight: 50},
+			},
+		},
+		{
+			canary: Canary{
+				Spec:   CanarySpec{TargetRef: CanaryTargetRef{Kind: "Deployment", Name: "podinfo"}},
+				Status: CanaryStatus{Phase: "Failed", CanaryWeight: 10},
+			},
+			expected: []TrafficSplitBackend{
+				{Service: "podinfo-primary", Weight: 100},
+				{Service: "podinfo-canary", Weight: 0},
+			},
+		},
+	}
+
+	for i, tc := range testcases {
+		ts := tc.canary.TrafficSplit()
+		if diff := cmp.Diff(tc.expected, ts.Spec.Backends); diff != "" {
+			t.Errorf("case %d: unexpected backends: %s", i, diff)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package reconciler
+
+import (
+	"github.com/mumoshu/crossover/pkg/query"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultClusterTypeURL is the type of synthesized clusters used when neither the prototype nor the CDS file has one
+const defaultClusterTypeURL = "type.googleapis.com/envoy.config.cluster.v3.Cluster"
+
+var (
+	resourcesQuery = query.MustParse("resources")
+	typeURLQuery   = query.MustParse(`["@type"]`)
+)
+
+// synthesizeClusters appends clusters rendered from the cluster prototype to the CDS DiscoveryResponse doc,
+// for the trafficsplit backends that have no cluster in it yet.
+// It returns true if any cluster is added.
+func synthesizeClusters(doc *yaml.Node, ts TrafficSplit, backends []clusterWeight, opts *templateOptions) (bool, error) {
+	typeURL := defaultClusterTypeURL
+	existing := map[string]bool{}
+	for _, r := range query.MustParse("resources/*").Find(doc) {
+		if name := queryString(nameQuery, r); name != "" {
+			existing[name] = true
+		}
+		if t := queryString(typeURLQuery, r); t != "" {
+			typeURL = t
+		}
+	}
+
+	var added bool
+	for _, b := range backends {
+		if existing[b.Name] {
+			continue
+		}
+		existing[b.Name] = true
+
+		cluster, err := opts.renderClusterPrototype(ts, b)
+		if err != nil {
+			return false, err
+		}
+
+		// Prepend missing `@type` and `name` so that they come first as usual
+		var head []*yaml.Node
+		if len(typeURLQuery.Find(cluster)) == 0 {
+			head = append(head, scalarNode("@type"), scalarNode(typeURL))
+		}
+		if len(nameQuery.Find(cluster)) == 0 {
+			head = append(head, scalarNode("name"), scalarNode(b.Name))
+		}
+		cluster.Content = append(head, cluster.Content...)
+
+		resourcesQuery.Append(doc, cluster)
+		added = true
+	}
+
+	return added, nil
+}
+
+func scalarNode(v string) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: v}
+}
@@ -0,0 +1,86 @@
+package reconciler
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSynthesizeClusters(t *testing.T) {
+	opts, err := newTemplateOptions(ConfigMap{ObjectMeta: ObjectMeta{Annotations: map[string]string{
+		AnnotationClusterPrototype: `
+connect_timeout: 0.25s
+type: STRICT_DNS
+load_assignment:
+  cluster_name: {{ .ClusterName }}
+  endpoints:
+  - lb_endpoints:
+    - endpoint:
+        address:
+          socket_address:
+            address: {{ .Service }}.{{ .Namespace }}.svc.cluster.local
+            port_value: 9898
+`,
+	}}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	obj, err := decodeYAML(`version_info: "0"
+resources:
+- "@type": type.googleapis.com/envoy.api.v2.Cluster
+  name: podinfo-v1
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := TrafficSplit{ObjectMeta: ObjectMeta{Namespace: "default"}, Spec: TrafficSplitSpec{Service: "podinfo"}}
+	backends := []clusterWeight{
+		{Name: "podinfo-v1", Service: "podinfo-v1", Weight: 50},
+		{Name: "podinfo-v2", Service: "podinfo-v2", Weight: 50},
+	}
+
+	added, err := synthesizeClusters(obj, ts, backends, opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !added {
+		t.Fatalf("expected a cluster to be added")
+	}
+
+	actual, err := encodeYAML(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `version_info: "0"
+resources:
+  - "@type": type.googleapis.com/envoy.api.v2.Cluster
+    name: podinfo-v1
+  - '@type': type.googleapis.com/envoy.api.v2.Cluster
+    name: podinfo-v2
+    connect_timeout: 0.25s
+    type: STRICT_DNS
+    load_assignment:
+      cluster_name: podinfo-v2
+      endpoints:
+        - lb_endpoints:
+            - endpoint:
+                address:
+                  socket_address:
+                    address: podinfo-v2.default.svc.cluster.local
+                    port_value: 9898
+`
+	if diff := cmp.Diff(expected, actual); diff != "" {
+		t.Errorf(diff)
+	}
+
+	added, err = synthesizeClusters(obj, ts, backends, opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if added {
+		t.Errorf("expected no cluster to be added for the second time")
+	}
+}
@@ -0,0 +1,127 @@
+package reconciler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mumoshu/crossover/pkg/types"
+)
+
+// memClient is an in-memory kubeclient.Client for testing reconcilers.
+// Objects are stored in JSON like the API server does.
+type memClient struct {
+	objs map[string][]byte
+}
+
+func newMemClient() *memClient {
+	return &memClient{objs: map[string][]byte{}}
+}
+
+func (c *memClient) key(namespace, name string) string {
+	return namespace + "/" + name
+}
+
+func (c *memClient) Get(namespace, name string, obj interface{}) error {
+	bs, ok := c.objs[c.key(namespace, name)]
+	if !ok {
+		return types.ErrNotExist
+	}
+	return json.Unmarshal(bs, obj)
+}
+
+func (c *memClient) RetryWatch(ctx context.Context, namespace, name string, updated chan string) error {
+	<-ctx.Done()
+	return nil
+}
+
+func (c *memClient) Create(namespace string, obj interface{}) error {
+	bs, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	meta := struct {
+		ObjectMeta `json:"metadata"`
+	}{}
+	if err := json.Unmarshal(bs, &meta); err != nil {
+		return err
+	}
+	if _, ok := c.objs[c.key(namespace, meta.Name)]; ok {
+		return fmt.Errorf("%s/%s already exists", namespace, meta.Name)
+	}
+	c.objs[c.key(namespace, meta.Name)] = bs
+	return nil
+}
+
+func (c *memClient) Replace(namespace, name string, obj interface{}) error {
+	if _, ok := c.objs[c.key(namespace, name)]; !ok {
+		return types.ErrNotExist
+	}
+	bs, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	c.objs[c.key(namespace, name)] = bs
+	return nil
+}
+
+// List lists objects in the namespace with all the labels in the selector like `k1=v1,k2=v2`
+func (c *memClient) List(namespace, labelSelector string, obj interface{}) error {
+	keys := make([]string, 0, len(c.objs))
+	for k := range c.objs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	items := []json.RawMessage{}
+	for _, k := range keys {
+		if !strings.HasPrefix(k, namespace+"/") {
+			continue
+		}
+		meta := struct {
+			ObjectMeta `json:"metadata"`
+		}{}
+		if err := json.Unmarshal(c.objs[k], &meta); err != nil {
+			return err
+		}
+		matched := true
+		for _, req := range strings.Split(labelSelector, ",") {
+			kv := strings.SplitN(req, "=", 2)
+			if len(kv) != 2 || meta.Labels[kv[0]] != kv[1] {
+				matched = false
+			}
+		}
+		if matched {
+			items = append(items, c.objs[k])
+		}
+	}
+
+	bs, err := json.Marshal(map[string]interface{}{"items": items})
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(bs, obj)
+}
+
+func (c *memClient) put(namespace, name string, obj interface{}) {
+	bs, err := json.Marshal(obj)
+	if err != nil {
+		panic(err)
+	}
+	c.objs[c.key(namespace, name)] = bs
+}
+
+// memStore is an in-memory SnapshotStore that keeps the latest files of each source
+type memStore struct {
+	files map[string]map[string]string
+}
+
+func (s *memStore) Update(source, serviceNode, serviceCluster string, files map[string]string) error {
+	if s.files == nil {
+		s.files = map[string]map[string]string{}
+	}
+	s.files[source] = files
+	return nil
+}
@@ -11,6 +11,7 @@ import (
 type ConfigMap struct {
 	ApiVersion string            `json:"apiVersion"`
 	Data       map[string]string `json:"data"`
+	BinaryData map[string][]byte `json:"binaryData,omitempty"`
 	Kind       string            `json:"kind"`
 	ObjectMeta ObjectMeta        `json:"metadata"`
 }
@@ -18,7 +19,9 @@ type ConfigMap struct {
 type ConfigmapReconciler struct {
 	Client    kubeclient.ReadOnlyClient
 	Namespace string
-	OutputDir string
+	Output
+	// TemplateEnv are the environment variables templates can read via `env`, in addition to POD_NAME and POD_NAMESPACE
+	TemplateEnv []string
 }
 
 func (s *ConfigmapReconciler) Reconcile(c string) error {
@@ -29,7 +32,12 @@ func (s *ConfigmapReconciler) Reconcile(c string) error {
 		log.Printf("get configmap %s/%s: %v", s.Namespace, c, err)
 		return types.ErrNotExist
 	}
-	if err := newWriter(s.OutputDir).write(cm); err != nil {
+	cm, err = RenderConfigMap(cm, s.Client, s.Namespace, s.TemplateEnv)
+	if err != nil {
+		log.Printf("Skipping configmap %s/%s: %v", s.Namespace, c, err)
+		return nil
+	}
+	if err := s.output(configMapSource(s.Namespace, c), cm, newWriter); err != nil {
 		return fmt.Errorf("failed writing %v: %v", cm, err)
 	}
 	return nil
@@ -1,55 +1,374 @@
 package reconciler
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 )
 
+const (
+	DefaultFileMode os.FileMode = 0644
+	DefaultDirMode  os.FileMode = 0755
+	// DefaultSecretFileMode is the mode of files derived from secrets, that must be readable only by Envoy
+	DefaultSecretFileMode os.FileMode = 0600
+)
+
+// FileOptions are the modes and the ownership of files and directories written to the output directory
+type FileOptions struct {
+	FileMode       os.FileMode
+	SecretFileMode os.FileMode
+	DirMode        os.FileMode
+	// UID and GID are the owner of written files and directories. -1 keeps the owner as is
+	UID, GID int
+	// History is the number of snapshots to keep per configmap or secret, so that Envoy can be pinned to one of them
+	History int
+	// VersionInfo is either VersionInfoInject or VersionInfoOverride to set `version_info` of written DiscoveryResponse
+	// files to the one derived from the content and the resourceVersion of the configmap. Empty leaves files as is.
+	VersionInfo string
+	// EnvoyAdmin confirms that Envoy applied written files, so that rejected files are rolled back, when not nil
+	EnvoyAdmin *EnvoyAdmin
+}
+
+// DefaultFileOptions returns the secure defaults
+func DefaultFileOptions() *FileOptions {
+	return &FileOptions{
+		FileMode:       DefaultFileMode,
+		SecretFileMode: DefaultSecretFileMode,
+		DirMode:        DefaultDirMode,
+		UID:            -1,
+		GID:            -1,
+	}
+}
+
+// CheckOutputDir logs a warning if the output directory can be written by anyone, as any process sharing the volume
+// could then change the Envoy config
+func CheckOutputDir(dir string) {
+	if dir == "" {
+		dir = defaultOutputDir
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Warning: checking output dir %s: %v", dir, err)
+		}
+		return
+	}
+	if info.Mode().Perm()&0002 != 0 {
+		log.Printf("Warning: output dir %s is world-writable(%v). Restrict its permissions so that only crossover can write Envoy configs", dir, info.Mode().Perm())
+	}
+}
+
+const defaultOutputDir = "/srv/runtime"
+
+// Output is where reconcilers put the files they generate, embedded in every reconciler that writes files
+type Output struct {
+	OutputDir string
+	// Files defaults to DefaultFileOptions when nil
+	Files *FileOptions
+	// Snapshots receives the written files to serve them over xDS, when not nil
+	Snapshots SnapshotStore
+	// SkipFiles disables writing files to OutputDir, for when Envoy reads the snapshots only over xDS
+	SkipFiles bool
+}
+
+// output gives the data of the configmap for the source to the snapshot store, and then writes it with the writer
+// newWriter returns, unless SkipFiles is set
+func (o Output) output(source string, cm ConfigMap, newWriter func(string, *FileOptions) *writer) error {
+	updateSnapshot(o.Snapshots, o.OutputDir, source, cm)
+	if o.SkipFiles {
+		return nil
+	}
+	return newWriter(o.OutputDir, o.Files).write(source, cm)
+}
+
 type writer struct {
-	xdsDir string
+	xdsDir   string
+	fileMode os.FileMode
+	dirMode  os.FileMode
+	uid, gid int
+	admin    *EnvoyAdmin
+	history  int
+	// versionInfo is how `version_info` is stamped
+	versionInfo string
 }
 
-func newWriter(dir string) *writer {
+// newWriter returns the writer for files derived from configmaps. opts defaults to DefaultFileOptions when nil.
+func newWriter(dir string, opts *FileOptions) *writer {
 	if dir == "" {
-		dir = "/srv/runtime"
+		dir = defaultOutputDir
+	}
+	if opts == nil {
+		opts = DefaultFileOptions()
+	}
+	w := &writer{
+		xdsDir:   dir,
+		fileMode: opts.FileMode,
+		dirMode:  opts.DirMode,
+		uid:      opts.UID,
+		gid:      opts.GID,
+		admin:    opts.EnvoyAdmin,
+		history:  opts.History,
+
+		versionInfo: opts.VersionInfo,
+	}
+	if w.fileMode == 0 {
+		w.fileMode = DefaultFileMode
 	}
-	return &writer{
-		xdsDir: dir,
+	if w.dirMode == 0 {
+		w.dirMode = DefaultDirMode
 	}
+	return w
 }
 
-func (rf *writer) write(route ConfigMap) error {
+// newSecretWriter returns the writer for files derived from secrets
+func newSecretWriter(dir string, opts *FileOptions) *writer {
+	w := newWriter(dir, opts)
+	w.fileMode = DefaultSecretFileMode
+	if opts != nil && opts.SecretFileMode != 0 {
+		w.fileMode = opts.SecretFileMode
+	}
+	return w
+}
+
+// write writes the data of the configmap for the source, like `configmaps/<namespace>/<name>`
+func (rf *writer) write(source string, route ConfigMap) error {
 	newDir := filepath.Join(rf.xdsDir, "new")
 	currentDir := filepath.Join(rf.xdsDir, "current")
 
-	if err := os.MkdirAll(newDir, 0777); err != nil {
-		return fmt.Errorf("creating dir %s: %v", newDir, err)
+	if err := rf.mkdir(newDir); err != nil {
+		return err
 	}
-	if err := os.MkdirAll(currentDir, 0777); err != nil {
-		return fmt.Errorf("creating dir %s: %v", currentDir, err)
+	if err := rf.mkdir(currentDir); err != nil {
+		return err
 	}
 
-	id := fmt.Sprintf("%s/%s", route.ObjectMeta.Namespace, route.ObjectMeta.Name)
+	id := source
 	log.Printf("Processing %s", id)
-	if len(route.Data) == 0 {
+	if len(route.Data) == 0 && len(route.BinaryData) == 0 {
 		log.Printf("Nothing to write! Configmap %s has no data", route.ObjectMeta.Name)
 		return nil
 	}
-	for fn, content := range route.Data {
-		newFile := filepath.Join(newDir, fn)
-		currentFile := filepath.Join(currentDir, fn)
-		log.Printf("Writing file %s", newFile)
-		if err := ioutil.WriteFile(newFile, []byte(content), 0666); err != nil {
+
+	paths, err := filePaths(route)
+	if err != nil {
+		return fmt.Errorf("configmap %s: %v", id, err)
+	}
+
+	keys := make([]string, 0, len(paths))
+	for k := range paths {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pinned, err := PinnedSnapshot(rf.xdsDir, id)
+	if err != nil {
+		return err
+	}
+	if pinned != "" {
+		log.Printf("Skipping writes of %s: it is pinned to snapshot %s", id, pinned)
+		return nil
+	}
+
+	if rf.versionInfo != "" {
+		if route, err = stampVersions(route, rf.versionInfo); err != nil {
+			return fmt.Errorf("configmap %s: %v", id, err)
+		}
+	}
+
+	if rf.admin != nil {
+		applied, err := rf.writeConfirmed(id, newDir, currentDir, keys, paths, route)
+		if err != nil || !applied {
 			return err
 		}
-		log.Printf("Moving file to %s", currentFile)
-		if err := os.Rename(newFile, currentFile); err != nil {
-			return fmt.Errorf("failed renaming %s to %s: %v", newFile, currentFile, err)
+	} else {
+		for _, key := range keys {
+			if err := rf.writeFile(newDir, currentDir, paths[key], fileContent(route, key)); err != nil {
+				return err
+			}
 		}
 	}
 
+	files := map[string][]byte{}
+	for _, key := range keys {
+		files[paths[key]] = fileContent(route, key)
+	}
+	// Failing to keep the history doesn't affect Envoy, so it isn't an error of the write
+	if err := rf.record(id, route, files); err != nil {
+		log.Printf("Warning: recording snapshot of %s: %v", id, err)
+	}
+
 	return nil
 }
+
+func fileContent(route ConfigMap, key string) []byte {
+	if content, ok := route.BinaryData[key]; ok {
+		return content
+	}
+	return []byte(route.Data[key])
+}
+
+// change is a file replaced by a write, to be restored when Envoy rejects the new one
+type change struct {
+	path    string
+	prev    []byte
+	existed bool
+}
+
+// writeConfirmed writes changed files only, and waits for Envoy to apply them.
+// The previous files, which are the last ones Envoy accepted, are restored when Envoy rejects the new ones, and the
+// rejected files aren't written again until the source changes.
+// Failing to confirm, like when Envoy isn't ready yet, keeps the new files.
+// It returns false when the files are rolled back or skipped.
+func (rf *writer) writeConfirmed(id, newDir, currentDir string, keys []string, paths map[string]string, route ConfigMap) (bool, error) {
+	// Updates of other sources in the meantime would be counted as the ones of this source
+	rf.admin.mu.Lock()
+	defer rf.admin.mu.Unlock()
+
+	h := sha256.New()
+	for _, key := range keys {
+		fmt.Fprintf(h, "%s\x00%d\x00", paths[key], len(fileContent(route, key)))
+		h.Write(fileContent(route, key))
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if rf.admin.rejected[id] == sum {
+		log.Printf("Skipping writes of %s: Envoy has rejected the same files. They are written again once %s changes", id, id)
+		return false, nil
+	}
+
+	before, err := rf.admin.stats()
+	if err != nil {
+		log.Printf("Warning: reading stats of Envoy: %v. Files of %s are written without confirmation", err, id)
+	}
+	confirm := err == nil
+
+	var (
+		changes  []change
+		updates  int
+		versions []string
+	)
+	for _, key := range keys {
+		content := fileContent(route, key)
+		currentFile, err := safePath(currentDir, paths[key])
+		if err != nil {
+			return false, err
+		}
+		prev, err := ioutil.ReadFile(currentFile)
+		if err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+		existed := err == nil
+		if existed && bytes.Equal(prev, content) {
+			continue
+		}
+		if err := rf.writeFile(newDir, currentDir, paths[key], content); err != nil {
+			return false, err
+		}
+		changes = append(changes, change{path: paths[key], prev: prev, existed: existed})
+		if v, ok := versionInfo(content); ok {
+			updates++
+			versions = append(versions, v)
+		}
+	}
+
+	if !confirm || updates == 0 {
+		return true, nil
+	}
+
+	switch err := rf.admin.confirm(before, updates, versions); err {
+	case nil:
+		log.Printf("Envoy applied versions %v of %s", versions, id)
+		delete(rf.admin.rejected, id)
+	case errRejected:
+		log.Printf("Envoy rejected versions %v of %s. Rolling back to the last-known-good files", versions, id)
+		if rf.admin.rejected == nil {
+			rf.admin.rejected = map[string]string{}
+		}
+		rf.admin.rejected[id] = sum
+		return false, rf.rollback(newDir, currentDir, changes)
+	default:
+		log.Printf("Warning: confirming files of %s: %v", id, err)
+	}
+	return true, nil
+}
+
+func (rf *writer) rollback(newDir, currentDir string, changes []change) error {
+	for i := len(changes) - 1; i >= 0; i-- {
+		c := changes[i]
+		if c.existed {
+			if err := rf.writeFile(newDir, currentDir, c.path, c.prev); err != nil {
+				return fmt.Errorf("rolling back %s: %v", c.path, err)
+			}
+			continue
+		}
+		currentFile, err := safePath(currentDir, c.path)
+		if err != nil {
+			return err
+		}
+		log.Printf("Removing file %s", currentFile)
+		if err := os.Remove(currentFile); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("rolling back %s: %v", c.path, err)
+		}
+	}
+	return nil
+}
+
+// writeFile writes the file to the new dir and then moves it to the current dir, so that Envoy never reads
+// a partially written file
+func (rf *writer) writeFile(newDir, currentDir, path string, content []byte) error {
+	newFile, err := safePath(newDir, path)
+	if err != nil {
+		return err
+	}
+	currentFile, err := safePath(currentDir, path)
+	if err != nil {
+		return err
+	}
+	for _, d := range []string{filepath.Dir(newFile), filepath.Dir(currentFile)} {
+		if err := rf.mkdir(d); err != nil {
+			return err
+		}
+	}
+	log.Printf("Writing file %s", newFile)
+	if err := ioutil.WriteFile(newFile, content, rf.fileMode); err != nil {
+		return err
+	}
+	// WriteFile neither changes the mode of existing files nor ignores umask, so set the mode explicitly
+	if err := rf.setPermissions(newFile, rf.fileMode); err != nil {
+		return err
+	}
+	log.Printf("Moving file to %s", currentFile)
+	if err := os.Rename(newFile, currentFile); err != nil {
+		return fmt.Errorf("failed renaming %s to %s: %v", newFile, currentFile, err)
+	}
+	return nil
+}
+
+func (rf *writer) mkdir(dir string) error {
+	if err := os.MkdirAll(dir, rf.dirMode); err != nil {
+		return fmt.Errorf("creating dir %s: %v", dir, err)
+	}
+	return rf.setPermissions(dir, rf.dirMode)
+}
+
+func (rf *writer) setPermissions(path string, mode os.FileMode) error {
+	if err := os.Chmod(path, mode); err != nil {
+		return fmt.Errorf("changing mode of %s: %v", path, err)
+	}
+	if rf.uid >= 0 || rf.gid >= 0 {
+		if err := os.Chown(path, rf.uid, rf.gid); err != nil {
+			return fmt.Errorf("changing owner of %s: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// WriteFiles writes the data of the configmap to the output directory, like crossover does for configmaps it watches
+func WriteFiles(dir string, cm ConfigMap, opts *FileOptions) error {
+	return newWriter(dir, opts).write(configMapSource(cm.ObjectMeta.Namespace, cm.ObjectMeta.Name), cm)
+}
@@ -0,0 +1,110 @@
+package reconciler
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriterModes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crossover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Leftovers of older versions that wrote everything world-writable
+	if err := os.MkdirAll(filepath.Join(dir, "new"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(dir, "new"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "new", "rds.yaml"), []byte("stale"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(dir, "new", "rds.yaml"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	cm := ConfigMap{Data: map[string]string{"rds.yaml": "resources: []\n"}}
+
+	testcases := []struct {
+		writer   *writer
+		fileMode os.FileMode
+		dirMode  os.FileMode
+	}{
+		{writer: newWriter(dir, nil), fileMode: DefaultFileMode, dirMode: DefaultDirMode},
+		{writer: newSecretWriter(dir, nil), fileMode: DefaultSecretFileMode, dirMode: DefaultDirMode},
+		{writer: newWriter(dir, &FileOptions{FileMode: 0640, DirMode: 0750, UID: -1, GID: -1}), fileMode: 0640, dirMode: 0750},
+		{writer: newSecretWriter(dir, &FileOptions{SecretFileMode: 0640, UID: -1, GID: -1}), fileMode: 0640, dirMode: DefaultDirMode},
+	}
+
+	for i, tc := range testcases {
+		if err := tc.writer.write(configMapSource("default", "envoy-xds"), cm); err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+
+		for path, expected := range map[string]os.FileMode{
+			filepath.Join(dir, "current", "rds.yaml"): tc.fileMode,
+			filepath.Join(dir, "current"):             tc.dirMode,
+			filepath.Join(dir, "new"):                 tc.dirMode,
+		} {
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if actual := info.Mode().Perm(); actual != expected {
+				t.Errorf("%d: %s: expected %v, got %v", i, path, expected, actual)
+			}
+		}
+	}
+}
+
+func TestWriterPaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crossover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cm := ConfigMap{
+		ObjectMeta: ObjectMeta{Annotations: map[string]string{
+			AnnotationPaths: "lds.yaml: listeners/lds.yaml\nfilter.wasm: wasm/filters/filter.wasm\n",
+		}},
+		Data:       map[string]string{"lds.yaml": "resources: []\n", "cds.yaml": "resources: []\n"},
+		BinaryData: map[string][]byte{"filter.wasm": {0x00, 0x61, 0x73, 0x6d}},
+	}
+
+	if err := newWriter(dir, nil).write(configMapSource("default", "envoy-xds"), cm); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for path, expected := range map[string]string{
+		"current/listeners/lds.yaml":       "resources: []\n",
+		"current/cds.yaml":                 "resources: []\n",
+		"current/wasm/filters/filter.wasm": "\x00asm",
+	} {
+		actual, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(path)))
+		if err != nil {
+			t.Errorf("%s: %v", path, err)
+			continue
+		}
+		if string(actual) != expected {
+			t.Errorf("%s: expected %q, got %q", path, expected, actual)
+		}
+	}
+
+	for _, paths := range []string{
+		"lds.yaml: ../lds.yaml",
+		"lds.yaml: /etc/lds.yaml",
+		"lds.yaml: cds.yaml",
+		"lds.yaml: [",
+	} {
+		cm.ObjectMeta.Annotations[AnnotationPaths] = paths
+		if err := newWriter(dir, nil).write(configMapSource("default", "envoy-xds"), cm); err == nil {
+			t.Errorf("%s: expected an error", paths)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package reconciler
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mumoshu/crossover/pkg/kubeclient"
+	"github.com/mumoshu/crossover/pkg/types"
+)
+
+// EndpointsTarget is a service whose endpoints are written as the ClusterLoadAssignment of a cluster
+type EndpointsTarget struct {
+	Service string
+	// Port is the name of the port to send requests to. Defaults to the first port.
+	Port string
+	// Cluster is the name of the cluster. Defaults to the service name.
+	Cluster string
+}
+
+// ParseEndpointsTarget parses `<service>[:<port name>][=<cluster name>]`
+func ParseEndpointsTarget(s string) EndpointsTarget {
+	var t EndpointsTarget
+	if i := strings.Index(s, "="); i >= 0 {
+		s, t.Cluster = s[:i], s[i+1:]
+	}
+	if i := strings.Index(s, ":"); i >= 0 {
+		s, t.Port = s[:i], s[i+1:]
+	}
+	t.Service = s
+	return t
+}
+
+// EndpointsDiscovery finds the services whose endpoints are written, from the backends of trafficsplits and the
+// AnnotationEndpoints of configmaps
+type EndpointsDiscovery struct {
+	TrafficSplits kubeclient.ReadOnlyClient
+	ConfigMaps    kubeclient.ReadOnlyClient
+	Namespace     string
+	// TsToConfigs maps trafficsplits to their template configmaps, whose cluster name templates name the clusters of
+	// the backends
+	TsToConfigs map[string]string
+	// ConfigMapNames are the configmaps whose AnnotationEndpoints are read
+	ConfigMapNames []string
+
+	mu      sync.Mutex
+	targets map[string]EndpointsTarget
+}
+
+// Discover returns the names of the services found. Missing trafficsplits and configmaps are skipped.
+func (d *EndpointsDiscovery) Discover() ([]string, error) {
+	targets := map[string]EndpointsTarget{}
+
+	for _, name := range d.ConfigMapNames {
+		cm := ConfigMap{}
+		if err := d.ConfigMaps.Get(d.Namespace, name, &cm); err == types.ErrNotExist {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("getting configmap %s/%s: %v", d.Namespace, name, err)
+		}
+		for _, line := range strings.Split(cm.ObjectMeta.Annotations[AnnotationEndpoints], "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			t := ParseEndpointsTarget(line)
+			targets[t.Service] = t
+		}
+	}
+
+	var tsNames []string
+	for n := range d.TsToConfigs {
+		tsNames = append(tsNames, n)
+	}
+	sort.Strings(tsNames)
+
+	for _, name := range tsNames {
+		ts := TrafficSplit{}
+		if err := d.TrafficSplits.Get(d.Namespace, name, &ts); err == types.ErrNotExist {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("getting trafficsplit %s/%s: %v", d.Namespace, name, err)
+		}
+
+		cm := ConfigMap{}
+		if err := d.ConfigMaps.Get(d.Namespace, d.TsToConfigs[name], &cm); err != nil && err != types.ErrNotExist {
+			return nil, fmt.Errorf("getting configmap %s/%s: %v", d.Namespace, d.TsToConfigs[name], err)
+		}
+		opts, err := newTemplateOptions(cm)
+		if err != nil {
+			return nil, fmt.Errorf("configmap %s/%s: %v", d.Namespace, d.TsToConfigs[name], err)
+		}
+
+		for _, b := range ts.Spec.Backends {
+			// The annotation takes precedence, to let it specify the port
+			if _, ok := targets[b.Service]; ok {
+				continue
+			}
+			cluster, err := opts.clusterName(ts, b)
+			if err != nil {
+				return nil, fmt.Errorf("trafficsplit %s/%s: %v", d.Namespace, name, err)
+			}
+			targets[b.Service] = EndpointsTarget{Service: b.Service, Cluster: cluster}
+		}
+	}
+
+	d.mu.Lock()
+	d.targets = targets
+	d.mu.Unlock()
+
+	var services []string
+	for svc := range targets {
+		services = append(services, svc)
+	}
+	sort.Strings(services)
+	if len(services) > 0 {
+		log.Printf("Discovered services %s", strings.Join(services, ", "))
+	}
+	return services, nil
+}
+
+// target returns the port and the cluster of the service found by the last discovery
+func (d *EndpointsDiscovery) target(service string) (EndpointsTarget, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	t, ok := d.targets[service]
+	return t, ok
+}
@@ -0,0 +1,100 @@
+package reconciler
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseEndpointsTarget(t *testing.T) {
+	for in, expected := range map[string]EndpointsTarget{
+		"podinfo":                      {Service: "podinfo"},
+		"podinfo:http":                 {Service: "podinfo", Port: "http"},
+		"podinfo=podinfo-primary":      {Service: "podinfo", Cluster: "podinfo-primary"},
+		"podinfo:http=podinfo-primary": {Service: "podinfo", Port: "http", Cluster: "podinfo-primary"},
+	} {
+		if d := cmp.Diff(expected, ParseEndpointsTarget(in)); d != "" {
+			t.Errorf("%s: %s", in, d)
+		}
+	}
+}
+
+func TestEndpointsDiscovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crossover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configMaps := newMemClient()
+	configMaps.put("default", "envoy-xds", ConfigMap{
+		ObjectMeta: ObjectMeta{Name: "envoy-xds", Namespace: "default", Annotations: map[string]string{
+			AnnotationClusterNameTemplate: "{{ .Service }}-cluster",
+			AnnotationEndpoints: `# the canary is named by the annotation
+podinfo-canary:http=canary
+frontend
+`,
+		}},
+	})
+
+	trafficSplits := newMemClient()
+	trafficSplits.put("default", "podinfo", TrafficSplit{
+		ObjectMeta: ObjectMeta{Name: "podinfo", Namespace: "default"},
+		Spec: TrafficSplitSpec{
+			Service:  "podinfo",
+			Backends: []TrafficSplitBackend{{Service: "podinfo-primary", Weight: 90}, {Service: "podinfo-canary", Weight: 10}},
+		},
+	})
+
+	d := &EndpointsDiscovery{
+		TrafficSplits:  trafficSplits,
+		ConfigMaps:     configMaps,
+		Namespace:      "default",
+		TsToConfigs:    map[string]string{"podinfo": "envoy-xds", "missing": "envoy-xds"},
+		ConfigMapNames: []string{"envoy-xds", "missing"},
+	}
+
+	services, err := d.Discover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"frontend", "podinfo-canary", "podinfo-primary"}, services); diff != "" {
+		t.Errorf(diff)
+	}
+
+	http := int32(9898)
+	slices := newMemClient()
+	for _, svc := range services {
+		slices.put("default", svc+"-abcde", EndpointSlice{
+			ObjectMeta:  ObjectMeta{Name: svc + "-abcde", Namespace: "default", Labels: map[string]string{serviceNameLabel: svc}},
+			AddressType: "IPv4",
+			Ports:       []EndpointPort{{Name: "http", Port: &http}},
+			Endpoints:   []EndpointSliceEndpoint{{Addresses: []string{"10.0.0.1"}}},
+		})
+	}
+
+	// Flags take precedence over the discovered targets
+	r := &EndpointsReconciler{
+		EndpointSlices: slices,
+		Namespace:      "default",
+		Output:         Output{OutputDir: dir},
+		Targets:        map[string]EndpointsTarget{"frontend": {Service: "frontend", Cluster: "front"}},
+		Discovery:      d,
+	}
+	for svc, cluster := range map[string]string{"frontend": "front", "podinfo-canary": "canary", "podinfo-primary": "podinfo-primary-cluster"} {
+		if err := r.Reconcile(svc); err != nil {
+			t.Fatal(err)
+		}
+		actual, err := ioutil.ReadFile(filepath.Join(dir, "current", edsFileName(svc)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(actual), "cluster_name: "+cluster+"\n") {
+			t.Errorf("%s: expected cluster %s, got:\n%s", svc, cluster, actual)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package reconciler
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mumoshu/crossover/pkg/kubeclient"
+	"github.com/mumoshu/crossover/pkg/types"
+)
+
+const (
+	clusterLoadAssignmentTypeURL = "type.googleapis.com/envoy.config.endpoint.v3.ClusterLoadAssignment"
+
+	// serviceNameLabel is the label of EndpointSlices for the name of the service they belong to
+	serviceNameLabel = "kubernetes.io/service-name"
+
+	healthStatusHealthy   = "HEALTHY"
+	healthStatusUnhealthy = "UNHEALTHY"
+	healthStatusDraining  = "DRAINING"
+)
+
+// EndpointSlice is the subset of Kubernetes EndpointSlice in discovery.k8s.io/v1 that is needed to write EDS configs
+type EndpointSlice struct {
+	ObjectMeta  ObjectMeta              `json:"metadata"`
+	AddressType string                  `json:"addressType"`
+	Endpoints   []EndpointSliceEndpoint `json:"endpoints"`
+	Ports       []EndpointPort          `json:"ports"`
+}
+
+type EndpointSliceEndpoint struct {
+	Addresses  []string           `json:"addresses"`
+	Conditions EndpointConditions `json:"conditions"`
+	Zone       string             `json:"zone,omitempty"`
+}
+
+// EndpointConditions are the conditions of an endpoint. Nil conditions are unknown.
+type EndpointConditions struct {
+	Ready       *bool `json:"ready,omitempty"`
+	Serving     *bool `json:"serving,omitempty"`
+	Terminating *bool `json:"terminating,omitempty"`
+}
+
+type EndpointPort struct {
+	Name string `json:"name,omitempty"`
+	Port *int32 `json:"port,omitempty"`
+}
+
+type EndpointSliceList struct {
+	Items []EndpointSlice `json:"items"`
+}
+
+// Endpoints is the subset of Kubernetes Endpoints, that is read when the cluster doesn't serve EndpointSlices
+type Endpoints struct {
+	ObjectMeta ObjectMeta       `json:"metadata"`
+	Subsets    []EndpointSubset `json:"subsets"`
+}
+
+type EndpointSubset struct {
+	Addresses         []EndpointAddress `json:"addresses"`
+	NotReadyAddresses []EndpointAddress `json:"notReadyAddresses"`
+	Ports             []EndpointPort    `json:"ports"`
+}
+
+type EndpointAddress struct {
+	IP string `json:"ip"`
+}
+
+// EndpointsReconciler writes the endpoints of services as EDS DiscoveryResponse files named `eds-<service name>.yaml`,
+// so that Envoy balances requests among pods rather than connecting to ClusterIPs.
+// The resource names it reconciles are service names.
+type EndpointsReconciler struct {
+	// EndpointSlices lists EndpointSlices. Endpoints are read instead when the cluster doesn't serve EndpointSlices.
+	EndpointSlices kubeclient.Lister
+	Endpoints      kubeclient.ReadOnlyClient
+	Namespace      string
+	// Targets are the ports and the clusters of services, keyed by service names.
+	// Services missing in it are looked up in Discovery, and default to the first port and the cluster named after them.
+	Targets map[string]EndpointsTarget
+	// Discovery finds services besides Targets, when not nil
+	Discovery *EndpointsDiscovery
+	Output
+}
+
+func (s *EndpointsReconciler) Reconcile(service string) error {
+	log.Printf("Reconciling endpoints %s", service)
+
+	target := s.target(service)
+
+	lbEndpoints, versionInfo, err := s.lbEndpoints(service, target.Port)
+	if err == types.ErrNotExist {
+		log.Printf("Endpoints %s/%s not found. Skipping reconcilation. This will be retried soon", s.Namespace, service)
+		return nil
+	} else if err != nil {
+		log.Printf("Unexpected error while getting endpoints %s/%s: %v", s.Namespace, service, err)
+		return err
+	}
+
+	conf, err := encodeYAML(discoveryResponse{
+		VersionInfo: versionInfo,
+		Resources:   []interface{}{clusterLoadAssignment(target.Cluster, lbEndpoints)},
+	})
+	if err != nil {
+		return err
+	}
+
+	files := ConfigMap{
+		ObjectMeta: ObjectMeta{Name: service, Namespace: s.Namespace},
+		Data:       map[string]string{edsFileName(service): conf},
+	}
+
+	if err := s.output(endpointsSource(s.Namespace, service), files, newWriter); err != nil {
+		return fmt.Errorf("failed writing endpoints %s/%s: %v", s.Namespace, service, err)
+	}
+	return nil
+}
+
+// target returns the port and the cluster of the service
+func (s *EndpointsReconciler) target(service string) EndpointsTarget {
+	t, ok := s.Targets[service]
+	if !ok && s.Discovery != nil {
+		t, ok = s.Discovery.target(service)
+	}
+	if !ok {
+		t = EndpointsTarget{Service: service}
+	}
+	if t.Cluster == "" {
+		t.Cluster = service
+	}
+	return t
+}
+
+func edsFileName(serviceName string) string {
+	return fmt.Sprintf("eds-%s.yaml", serviceName)
+}
+
+// lbEndpoint is an address of a pod along with its health status and zone
+type lbEndpoint struct {
+	address      string
+	port         int32
+	healthStatus string
+	zone         string
+}
+
+// lbEndpoints returns the endpoints of the service from its EndpointSlices, or its Endpoints when the cluster doesn't
+// serve EndpointSlices, along with the version derived from the resource versions of them
+func (s *EndpointsReconciler) lbEndpoints(service, port string) ([]lbEndpoint, string, error) {
+	if s.EndpointSlices != nil {
+		list := EndpointSliceList{}
+		err := s.EndpointSlices.List(s.Namespace, serviceNameLabel+"="+service, &list)
+		if err == nil {
+			if len(list.Items) == 0 {
+				return nil, "", types.ErrNotExist
+			}
+			return endpointsFromSlices(list.Items, port)
+		}
+		if err != types.ErrNotExist || s.Endpoints == nil {
+			return nil, "", err
+		}
+	}
+
+	eps := Endpoints{}
+	if err := s.Endpoints.Get(s.Namespace, service, &eps); err != nil {
+		return nil, "", err
+	}
+	return endpointsFromSubsets(eps, port), versionOf(eps.ObjectMeta.ResourceVersion), nil
+}
+
+func endpointsFromSlices(slices []EndpointSlice, port string) ([]lbEndpoint, string, error) {
+	sort.Slice(slices, func(i, j int) bool { return slices[i].ObjectMeta.Name < slices[j].ObjectMeta.Name })
+
+	var (
+		res      []lbEndpoint
+		versions []string
+		// An endpoint can be in more than one slice while it moves between them, in which case the first one is used
+		seen = map[string]bool{}
+	)
+	for _, slice := range slices {
+		versions = append(versions, slice.ObjectMeta.Name+"="+slice.ObjectMeta.ResourceVersion)
+
+		// FQDN endpoints can't be given to Envoy as socket addresses
+		if slice.AddressType != "IPv4" && slice.AddressType != "IPv6" {
+			continue
+		}
+		p, ok := selectPort(slice.Ports, port)
+		if !ok {
+			continue
+		}
+		for _, e := range slice.Endpoints {
+			for _, a := range e.Addresses {
+				key := net.JoinHostPort(a, strconv.Itoa(int(p)))
+				if seen[key] {
+					continue
+				}
+				seen[key] = true
+				res = append(res, lbEndpoint{address: a, port: p, healthStatus: healthStatus(e.Conditions), zone: e.Zone})
+			}
+		}
+	}
+
+	if len(slices) == 1 {
+		return res, versionOf(slices[0].ObjectMeta.ResourceVersion), nil
+	}
+	return res, versionOf(versions...), nil
+}
+
+func endpointsFromSubsets(eps Endpoints, port string) []lbEndpoint {
+	var res []lbEndpoint
+	for _, subset := range eps.Subsets {
+		p, ok := selectPort(subset.Ports, port)
+		if !ok {
+			continue
+		}
+		for _, a := range subset.Addresses {
+			res = append(res, lbEndpoint{address: a.IP, port: p, healthStatus: healthStatusHealthy})
+		}
+		for _, a := range subset.NotReadyAddresses {
+			res = append(res, lbEndpoint{address: a.IP, port: p, healthStatus: healthStatusUnhealthy})
+		}
+	}
+	return res
+}
+
+// selectPort returns the port of the name, or the first port when the name is empty
+func selectPort(ports []EndpointPort, name string) (int32, bool) {
+	for _, p := range ports {
+		if p.Port != nil && (name == "" || p.Name == name) {
+			return *p.Port, true
+		}
+	}
+	return 0, false
+}
+
+// healthStatus maps the conditions of the endpoint to the Envoy's health status.
+// Terminating endpoints are draining, so that Envoy stops sending new requests to them while letting in-flight
+// requests complete.
+func healthStatus(c EndpointConditions) string {
+	if c.Terminating != nil && *c.Terminating {
+		return healthStatusDraining
+	}
+	// The ready condition is unknown for clusters that don't report it, in which case the endpoint is considered ready
+	if c.Ready == nil || *c.Ready {
+		return healthStatusHealthy
+	}
+	return healthStatusUnhealthy
+}
+
+// clusterLoadAssignment returns the ClusterLoadAssignment of the cluster,
+// with the endpoints grouped by zones in the order of zone names
+func clusterLoadAssignment(cluster string, endpoints []lbEndpoint) map[string]interface{} {
+	byZone := map[string][]interface{}{}
+	var zones []string
+	for _, e := range endpoints {
+		if _, ok := byZone[e.zone]; !ok {
+			zones = append(zones, e.zone)
+		}
+		byZone[e.zone] = append(byZone[e.zone], map[string]interface{}{
+			"endpoint": map[string]interface{}{
+				"address": map[string]interface{}{
+					"socket_address": map[string]interface{}{
+						"address":    e.address,
+						"port_value": e.port,
+					},
+				},
+			},
+			"health_status": e.healthStatus,
+		})
+	}
+	sort.Strings(zones)
+
+	localities := []interface{}{}
+	for _, z := range zones {
+		locality := map[string]interface{}{"lb_endpoints": byZone[z]}
+		if z != "" {
+			locality["locality"] = map[string]interface{}{"zone": z}
+		}
+		localities = append(localities, locality)
+	}
+
+	return map[string]interface{}{
+		"@type":        clusterLoadAssignmentTypeURL,
+		"cluster_name": cluster,
+		"endpoints":    localities,
+	}
+}
+
+// versionOf returns the version_info derived from the resource versions
+func versionOf(resourceVersions ...string) string {
+	switch len(resourceVersions) {
+	case 0:
+		return "0"
+	case 1:
+		if resourceVersions[0] == "" {
+			return "0"
+		}
+		return resourceVersions[0]
+	}
+	sum := sha256.Sum256([]byte(strings.Join(resourceVersions, ",")))
+	return fmt.Sprintf("%x", sum[:8])
+}
@@ -0,0 +1,159 @@
+package reconciler
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestEndpointsReconcilerEndpointSlices(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crossover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	yes, no := true, false
+	http, metrics := int32(9898), int32(9797)
+	labels := map[string]string{serviceNameLabel: "podinfo"}
+
+	slices := newMemClient()
+	slices.put("default", "podinfo-abcde", EndpointSlice{
+		ObjectMeta:  ObjectMeta{Name: "podinfo-abcde", Namespace: "default", Labels: labels, ResourceVersion: "10"},
+		AddressType: "IPv4",
+		Ports:       []EndpointPort{{Name: "metrics", Port: &metrics}, {Name: "http", Port: &http}},
+		Endpoints: []EndpointSliceEndpoint{
+			{Addresses: []string{"10.0.1.1"}, Conditions: EndpointConditions{Ready: &yes}, Zone: "us-east-1b"},
+			{Addresses: []string{"10.0.0.1"}, Conditions: EndpointConditions{Ready: &no, Terminating: &yes}, Zone: "us-east-1a"},
+			{Addresses: []string{"10.0.0.2"}, Conditions: EndpointConditions{Ready: &no}, Zone: "us-east-1a"},
+		},
+	})
+	slices.put("default", "podinfo-fghij", EndpointSlice{
+		ObjectMeta:  ObjectMeta{Name: "podinfo-fghij", Namespace: "default", Labels: labels, ResourceVersion: "11"},
+		AddressType: "FQDN",
+		Ports:       []EndpointPort{{Name: "http", Port: &http}},
+		Endpoints:   []EndpointSliceEndpoint{{Addresses: []string{"podinfo.example.com"}}},
+	})
+	// 10.0.1.1 is moving from podinfo-abcde to podinfo-klmno
+	slices.put("default", "podinfo-klmno", EndpointSlice{
+		ObjectMeta:  ObjectMeta{Name: "podinfo-klmno", Namespace: "default", Labels: labels, ResourceVersion: "12"},
+		AddressType: "IPv4",
+		Ports:       []EndpointPort{{Name: "http", Port: &http}},
+		Endpoints:   []EndpointSliceEndpoint{{Addresses: []string{"10.0.1.1"}, Conditions: EndpointConditions{Ready: &no}, Zone: "us-east-1b"}},
+	})
+	slices.put("default", "frontend-abcde", EndpointSlice{
+		ObjectMeta:  ObjectMeta{Name: "frontend-abcde", Namespace: "default", Labels: map[string]string{serviceNameLabel: "frontend"}},
+		AddressType: "IPv4",
+		Ports:       []EndpointPort{{Name: "http", Port: &http}},
+		Endpoints:   []EndpointSliceEndpoint{{Addresses: []string{"10.0.2.1"}}},
+	})
+
+	r := &EndpointsReconciler{EndpointSlices: slices, Namespace: "default", Output: Output{OutputDir: dir}, Targets: map[string]EndpointsTarget{
+		"podinfo": {Service: "podinfo", Port: "http", Cluster: "podinfo-primary"},
+	}}
+
+	for _, name := range []string{"podinfo", "missing"} {
+		if err := r.Reconcile(name); err != nil {
+			t.Fatalf("%s: unexpected error: %v", name, err)
+		}
+	}
+
+	actual, err := ioutil.ReadFile(filepath.Join(dir, "current", "eds-podinfo.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `version_info: ` + versionOf("podinfo-abcde=10", "podinfo-fghij=11", "podinfo-klmno=12") + `
+resources:
+  - '@type': type.googleapis.com/envoy.config.endpoint.v3.ClusterLoadAssignment
+    cluster_name: podinfo-primary
+    endpoints:
+      - lb_endpoints:
+          - endpoint:
+              address:
+                socket_address:
+                  address: 10.0.0.1
+                  port_value: 9898
+            health_status: DRAINING
+          - endpoint:
+              address:
+                socket_address:
+                  address: 10.0.0.2
+                  port_value: 9898
+            health_status: UNHEALTHY
+        locality:
+          zone: us-east-1a
+      - lb_endpoints:
+          - endpoint:
+              address:
+                socket_address:
+                  address: 10.0.1.1
+                  port_value: 9898
+            health_status: HEALTHY
+        locality:
+          zone: us-east-1b
+`
+	if d := cmp.Diff(expected, string(actual)); d != "" {
+		t.Errorf("unexpected eds config: %s", d)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "current", "eds-missing.yaml")); !os.IsNotExist(err) {
+		t.Errorf("unexpected eds config for missing service: %v", err)
+	}
+}
+
+func TestEndpointsReconcilerEndpoints(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crossover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	http := int32(9898)
+
+	endpoints := newMemClient()
+	endpoints.put("default", "podinfo", Endpoints{
+		ObjectMeta: ObjectMeta{Name: "podinfo", Namespace: "default", ResourceVersion: "20"},
+		Subsets: []EndpointSubset{{
+			Addresses:         []EndpointAddress{{IP: "10.0.0.1"}},
+			NotReadyAddresses: []EndpointAddress{{IP: "10.0.0.2"}},
+			Ports:             []EndpointPort{{Name: "http", Port: &http}},
+		}},
+	})
+
+	r := &EndpointsReconciler{Endpoints: endpoints, Namespace: "default", Output: Output{OutputDir: dir}}
+	if err := r.Reconcile("podinfo"); err != nil {
+		t.Fatal(err)
+	}
+
+	actual, err := ioutil.ReadFile(filepath.Join(dir, "current", "eds-podinfo.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `version_info: "20"
+resources:
+  - '@type': type.googleapis.com/envoy.config.endpoint.v3.ClusterLoadAssignment
+    cluster_name: podinfo
+    endpoints:
+      - lb_endpoints:
+          - endpoint:
+              address:
+                socket_address:
+                  address: 10.0.0.1
+                  port_value: 9898
+            health_status: HEALTHY
+          - endpoint:
+              address:
+                socket_address:
+                  address: 10.0.0.2
+                  port_value: 9898
+            health_status: UNHEALTHY
+`
+	if d := cmp.Diff(expected, string(actual)); d != "" {
+		t.Errorf("unexpected eds config: %s", d)
+	}
+}
@@ -0,0 +1,190 @@
+package reconciler
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	DefaultEnvoyAdminTimeout  = 10 * time.Second
+	defaultEnvoyAdminInterval = 500 * time.Millisecond
+
+	// updateStatsFilter matches the stats of all the xDS subscriptions of Envoy, like `cluster_manager.cds.update_rejected`
+	updateStatsFilter = `\.update_(success|rejected)$`
+)
+
+// errRejected is returned when Envoy rejected written files
+var errRejected = errors.New("rejected by Envoy")
+
+// EnvoyAdmin confirms that Envoy applied written files via its admin API
+type EnvoyAdmin struct {
+	// URL is the base URL of the admin API like `http://127.0.0.1:9901`
+	URL        string
+	HttpClient *http.Client
+	// Timeout is how long to wait for Envoy to apply written files. Defaults to DefaultEnvoyAdminTimeout
+	Timeout time.Duration
+	// Interval is the interval between polls of the admin API
+	Interval time.Duration
+
+	// mu serializes confirmed writes, as the update counters are shared by all the files Envoy reads
+	mu sync.Mutex
+	// rejected are the hashes of the contents Envoy rejected, keyed by source, not to write them again until the
+	// sources change
+	rejected map[string]string
+}
+
+// updateStats are the sums of update counters of all the xDS subscriptions
+type updateStats struct {
+	success, rejected int
+}
+
+// stats returns the update counters read from `/stats`
+func (a *EnvoyAdmin) stats() (updateStats, error) {
+	bs, err := a.get("/stats?filter=" + updateStatsFilter)
+	if err != nil {
+		return updateStats{}, err
+	}
+
+	res := updateStats{}
+	scanner := bufio.NewScanner(bytes.NewReader(bs))
+	for scanner.Scan() {
+		kv := strings.SplitN(scanner.Text(), ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		v, err := strconv.Atoi(strings.TrimSpace(kv[1]))
+		if err != nil {
+			continue
+		}
+		switch {
+		case strings.HasSuffix(kv[0], ".update_success"):
+			res.success += v
+		case strings.HasSuffix(kv[0], ".update_rejected"):
+			res.rejected += v
+		}
+	}
+	return res, scanner.Err()
+}
+
+// versions returns every `version_info` found in `/config_dump`
+func (a *EnvoyAdmin) versions() (map[string]bool, error) {
+	bs, err := a.get("/config_dump")
+	if err != nil {
+		return nil, err
+	}
+	var dump interface{}
+	if err := json.Unmarshal(bs, &dump); err != nil {
+		return nil, fmt.Errorf("parsing config dump: %v", err)
+	}
+	res := map[string]bool{}
+	collectVersions(dump, res)
+	return res, nil
+}
+
+func collectVersions(v interface{}, res map[string]bool) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, e := range t {
+			if s, ok := e.(string); ok && k == "version_info" {
+				res[s] = true
+				continue
+			}
+			collectVersions(e, res)
+		}
+	case []interface{}:
+		for _, e := range t {
+			collectVersions(e, res)
+		}
+	}
+}
+
+func (a *EnvoyAdmin) get(path string) ([]byte, error) {
+	client := a.HttpClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Get(strings.TrimSuffix(a.URL, "/") + path)
+	if err != nil {
+		return nil, fmt.Errorf("http get: %v", err)
+	}
+	defer resp.Body.Close()
+	bs, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("non 200 response code from %s: %v: %s", path, resp.StatusCode, bs)
+	}
+	return bs, nil
+}
+
+// confirm waits until Envoy has processed the updates of the given number of files since the stats were taken,
+// and every version has shown up in the config dump.
+// It returns errRejected as soon as Envoy rejects any update.
+func (a *EnvoyAdmin) confirm(before updateStats, updates int, versions []string) error {
+	timeout, interval := a.Timeout, a.Interval
+	if timeout == 0 {
+		timeout = DefaultEnvoyAdminTimeout
+	}
+	if interval == 0 {
+		interval = defaultEnvoyAdminInterval
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		applied, err := a.applied(before, updates, versions)
+		if err != nil || applied {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out after %v waiting for Envoy to apply versions %v", timeout, versions)
+		}
+		time.Sleep(interval)
+	}
+}
+
+func (a *EnvoyAdmin) applied(before updateStats, updates int, versions []string) (bool, error) {
+	after, err := a.stats()
+	if err != nil {
+		return false, err
+	}
+	if after.rejected > before.rejected {
+		return false, errRejected
+	}
+	if after.success-before.success < updates {
+		return false, nil
+	}
+	found, err := a.versions()
+	if err != nil {
+		return false, err
+	}
+	for _, v := range versions {
+		if !found[v] {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// versionInfo returns the `version_info` of the DiscoveryResponse file, and false if the file isn't one
+func versionInfo(content []byte) (string, bool) {
+	var doc struct {
+		VersionInfo string        `yaml:"version_info"`
+		Resources   []interface{} `yaml:"resources"`
+	}
+	if err := yaml.Unmarshal(content, &doc); err != nil || doc.Resources == nil {
+		return "", false
+	}
+	return doc.VersionInfo, true
+}
@@ -0,0 +1,128 @@
+package reconciler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeEnvoy is a fake Envoy admin API that reads cds.yaml in the current dir like Envoy does on every poll,
+// and rejects files containing `invalid`
+type fakeEnvoy struct {
+	dir string
+
+	mu       sync.Mutex
+	applied  string
+	version  string
+	success  int
+	rejected int
+}
+
+func (e *fakeEnvoy) reload() {
+	content, err := ioutil.ReadFile(filepath.Join(e.dir, "current", "cds.yaml"))
+	if err != nil || string(content) == e.applied {
+		return
+	}
+	e.applied = string(content)
+	if strings.Contains(e.applied, "invalid") {
+		e.rejected++
+		return
+	}
+	e.success++
+	e.version, _ = versionInfo(content)
+}
+
+func (e *fakeEnvoy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	switch r.URL.Path {
+	case "/stats":
+		if r.URL.Query().Get("filter") != updateStatsFilter {
+			http.Error(w, "unexpected filter", http.StatusBadRequest)
+			return
+		}
+		// Stats are read before writes, so that reloads happen on the later polls
+		defer e.reload()
+		fmt.Fprintf(w, "cluster_manager.cds.update_rejected: %d\ncluster_manager.cds.update_success: %d\n", e.rejected, e.success)
+	case "/config_dump":
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"configs": []interface{}{
+				map[string]interface{}{"@type": "type.googleapis.com/envoy.admin.v3.ClustersConfigDump", "version_info": e.version},
+			},
+		})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestWriterEnvoyAdmin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crossover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	envoy := &fakeEnvoy{dir: dir}
+	srv := httptest.NewServer(envoy)
+	defer srv.Close()
+
+	opts := DefaultFileOptions()
+	opts.EnvoyAdmin = &EnvoyAdmin{URL: srv.URL, Timeout: time.Second, Interval: time.Millisecond}
+
+	good := "version_info: \"1\"\nresources: []\n"
+	bad := "version_info: \"2\"\nresources:\n- invalid\n"
+
+	if err := newWriter(dir, opts).write(configMapSource("default", "envoy-xds"), ConfigMap{Data: map[string]string{"cds.yaml": good}}); err != nil {
+		t.Fatal(err)
+	}
+	if envoy.success != 1 || envoy.version != "1" {
+		t.Fatalf("unexpected state of envoy: %+v", envoy)
+	}
+
+	if err := newWriter(dir, opts).write(configMapSource("default", "envoy-xds"), ConfigMap{Data: map[string]string{"cds.yaml": bad, "rds.yaml": good}}); err != nil {
+		t.Fatal(err)
+	}
+	if envoy.rejected != 1 {
+		t.Fatalf("unexpected state of envoy: %+v", envoy)
+	}
+
+	// The last-known-good file is restored, and the file added along with the rejected one is removed
+	actual, err := ioutil.ReadFile(filepath.Join(dir, "current", "cds.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(actual) != good {
+		t.Errorf("unexpected cds.yaml after rollback: %s", actual)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "current", "rds.yaml")); !os.IsNotExist(err) {
+		t.Errorf("unexpected rds.yaml after rollback: %v", err)
+	}
+
+	// The rejected files aren't written again until the source changes
+	if err := newWriter(dir, opts).write(configMapSource("default", "envoy-xds"), ConfigMap{Data: map[string]string{"cds.yaml": bad, "rds.yaml": good}}); err != nil {
+		t.Fatal(err)
+	}
+	if envoy.rejected != 1 {
+		t.Fatalf("rejected files are written again: %+v", envoy)
+	}
+	if err := newWriter(dir, opts).write(configMapSource("default", "envoy-xds"), ConfigMap{Data: map[string]string{"cds.yaml": bad + "- invalid\n"}}); err != nil {
+		t.Fatal(err)
+	}
+	if envoy.rejected != 2 {
+		t.Fatalf("changed files aren't written: %+v", envoy)
+	}
+
+	// Unchanged files aren't written again, so there's nothing to confirm
+	if err := newWriter(dir, opts).write(configMapSource("default", "envoy-xds"), ConfigMap{Data: map[string]string{"cds.yaml": good}}); err != nil {
+		t.Fatal(err)
+	}
+}
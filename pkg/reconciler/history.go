@@ -0,0 +1,361 @@
+package reconciler
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// historyDir is the directory under the output directory to keep snapshots in
+	historyDir = "history"
+	// pinsDir is the directory under the output directory to keep the IDs of pinned snapshots in, one file per source
+	pinsDir = "pins"
+
+	snapshotMetadataFile = "metadata.json"
+	snapshotFilesDir     = "files"
+)
+
+// SnapshotMetadata describes a snapshot, which is the set of files written for a configmap or a secret at once
+type SnapshotMetadata struct {
+	ID string `json:"id"`
+	// Source is the kind, the namespace and the name of the object the files were written for,
+	// like `configmaps/default/envoy-xds`
+	Source          string    `json:"source"`
+	ResourceVersion string    `json:"resourceVersion,omitempty"`
+	Time            time.Time `json:"time"`
+	// Hash is the SHA-256 hash of the paths and the contents of the files
+	Hash string `json:"hash"`
+	// Files are the paths of the files relative to the current dir
+	Files []string    `json:"files"`
+	Mode  os.FileMode `json:"mode"`
+}
+
+// snapshotHash returns the hash of the files keyed by paths
+func snapshotHash(files map[string][]byte) string {
+	paths := make([]string, 0, len(files))
+	for p := range files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	h := sha256.New()
+	for _, p := range paths {
+		fmt.Fprintf(h, "%s\x00%d\x00", p, len(files[p]))
+		h.Write(files[p])
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// record keeps the files in the history, and removes the oldest snapshots of the same source beyond the limit.
+// Nothing is kept when the files are the same as the latest snapshot of the source.
+func (rf *writer) record(source string, route ConfigMap, files map[string][]byte) error {
+	if rf.history <= 0 {
+		return nil
+	}
+
+	hash := snapshotHash(files)
+
+	snapshots, err := ListSnapshots(rf.xdsDir)
+	if err != nil {
+		return err
+	}
+	var same []SnapshotMetadata
+	for _, s := range snapshots {
+		if s.Source == source {
+			same = append(same, s)
+		}
+	}
+	if len(same) > 0 && same[len(same)-1].Hash == hash {
+		return nil
+	}
+
+	now := time.Now().UTC()
+	meta := SnapshotMetadata{
+		ID:              fmt.Sprintf("%s-%s", now.Format("20060102T150405.000000000Z"), hash[:8]),
+		Source:          source,
+		ResourceVersion: route.ObjectMeta.ResourceVersion,
+		Time:            now,
+		Hash:            hash,
+		Mode:            rf.fileMode,
+	}
+	for p := range files {
+		meta.Files = append(meta.Files, p)
+	}
+	sort.Strings(meta.Files)
+
+	root := filepath.Join(rf.xdsDir, historyDir)
+	if err := rf.mkdir(root); err != nil {
+		return err
+	}
+	// Snapshots are written to a temporary dir and then renamed, so that a partial snapshot is never listed
+	tmp := filepath.Join(root, "."+meta.ID)
+	if err := rf.mkdir(filepath.Join(tmp, snapshotFilesDir)); err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	for p, content := range files {
+		f, err := safePath(filepath.Join(tmp, snapshotFilesDir), p)
+		if err != nil {
+			return err
+		}
+		if err := rf.mkdir(filepath.Dir(f)); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(f, content, rf.fileMode); err != nil {
+			return err
+		}
+		if err := rf.setPermissions(f, rf.fileMode); err != nil {
+			return err
+		}
+	}
+	bs, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmp, snapshotMetadataFile), bs, rf.fileMode); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(root, meta.ID)); err != nil {
+		return err
+	}
+	log.Printf("Recorded snapshot %s of %s", meta.ID, source)
+
+	same = append(same, meta)
+	pinned, _ := PinnedSnapshot(rf.xdsDir, source)
+	for i := 0; i < len(same)-rf.history; i++ {
+		// The pinned snapshot is kept so that it can be inspected until unpinned
+		if same[i].ID == pinned {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(root, same[i].ID)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ListSnapshots returns the snapshots in the output directory from the oldest to the newest
+func ListSnapshots(dir string) ([]SnapshotMetadata, error) {
+	if dir == "" {
+		dir = defaultOutputDir
+	}
+	root := filepath.Join(dir, historyDir)
+	entries, err := ioutil.ReadDir(root)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var res []SnapshotMetadata
+	for _, e := range entries {
+		if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		meta, err := readSnapshotMetadata(root, e.Name())
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, meta)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res, nil
+}
+
+func readSnapshotMetadata(root, id string) (SnapshotMetadata, error) {
+	meta := SnapshotMetadata{}
+	bs, err := ioutil.ReadFile(filepath.Join(root, id, snapshotMetadataFile))
+	if err != nil {
+		return meta, fmt.Errorf("reading snapshot %s: %v", id, err)
+	}
+	if err := json.Unmarshal(bs, &meta); err != nil {
+		return meta, fmt.Errorf("reading snapshot %s: %v", id, err)
+	}
+	return meta, nil
+}
+
+// pinPath returns the path to the file that holds the ID of the snapshot the source is pinned to.
+// Kinds and namespaces can't contain `_`, so that the first two `_` in the file name separate the kind, the namespace
+// and the name.
+func pinPath(dir, source string) (string, error) {
+	parts := strings.SplitN(source, "/", 3)
+	if len(parts) != 3 {
+		return "", fmt.Errorf("invalid source %q: must be <kind>/<namespace>/<name>", source)
+	}
+	kind, ns, name := parts[0], parts[1], parts[2]
+	if kind == "" || ns == "" || name == "" || strings.Contains(kind, "_") || strings.Contains(ns, "_") || strings.Contains(name, "/") || name == "." || name == ".." {
+		return "", fmt.Errorf("invalid source %q: must be <kind>/<namespace>/<name>", source)
+	}
+	return filepath.Join(dir, pinsDir, kind+"_"+ns+"_"+name), nil
+}
+
+// PinnedSnapshot returns the ID of the snapshot the source is pinned to, or an empty string when it isn't pinned.
+// Sources without namespaces are never pinned.
+func PinnedSnapshot(dir, source string) (string, error) {
+	if dir == "" {
+		dir = defaultOutputDir
+	}
+	p, err := pinPath(dir, source)
+	if err != nil {
+		return "", nil
+	}
+	bs, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return strings.TrimSpace(string(bs)), err
+}
+
+// PinnedSnapshots returns the IDs of pinned snapshots keyed by sources
+func PinnedSnapshots(dir string) (map[string]string, error) {
+	if dir == "" {
+		dir = defaultOutputDir
+	}
+	entries, err := ioutil.ReadDir(filepath.Join(dir, pinsDir))
+	if os.IsNotExist(err) {
+		return map[string]string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	res := map[string]string{}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		bs, err := ioutil.ReadFile(filepath.Join(dir, pinsDir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		res[strings.Replace(e.Name(), "_", "/", 2)] = strings.TrimSpace(string(bs))
+	}
+	return res, nil
+}
+
+// SnapshotFiles returns the contents of the files of the snapshot keyed by paths relative to the current dir
+func SnapshotFiles(dir, id string) (SnapshotMetadata, map[string][]byte, error) {
+	if dir == "" {
+		dir = defaultOutputDir
+	}
+	if _, err := cleanRelPath(id); err != nil || strings.Contains(id, "/") {
+		return SnapshotMetadata{}, nil, fmt.Errorf("invalid snapshot id %q", id)
+	}
+	root := filepath.Join(dir, historyDir)
+	meta, err := readSnapshotMetadata(root, id)
+	if err != nil {
+		return meta, nil, err
+	}
+	files := map[string][]byte{}
+	for _, p := range meta.Files {
+		f, err := safePath(filepath.Join(root, id, snapshotFilesDir), p)
+		if err != nil {
+			return meta, nil, err
+		}
+		content, err := ioutil.ReadFile(f)
+		if err != nil {
+			return meta, nil, err
+		}
+		files[p] = content
+	}
+	return meta, files, nil
+}
+
+// PinSnapshot writes the files of the snapshot to the current dir, removes the other files of the same source, and
+// stops writes of the source until UnpinSnapshot is called, so that Envoy stays on the snapshot while the configmap is
+// being fixed. Other sources are written as usual.
+// The source stays pinned when restoring the files fails, so that it can be pinned again or unpinned.
+func PinSnapshot(dir, id string, opts *FileOptions) error {
+	if dir == "" {
+		dir = defaultOutputDir
+	}
+	meta, files, err := SnapshotFiles(dir, id)
+	if err != nil {
+		return err
+	}
+	p, err := pinPath(dir, meta.Source)
+	if err != nil {
+		return err
+	}
+
+	// The current dir has the files of either the latest snapshot or the one pinned before
+	snapshots, err := ListSnapshots(dir)
+	if err != nil {
+		return err
+	}
+	pinned, err := PinnedSnapshot(dir, meta.Source)
+	if err != nil {
+		return err
+	}
+	var latest string
+	for _, s := range snapshots {
+		if s.Source == meta.Source {
+			latest = s.ID
+		}
+	}
+	stale := map[string]bool{}
+	for _, s := range snapshots {
+		if s.ID != latest && s.ID != pinned {
+			continue
+		}
+		for _, f := range s.Files {
+			if _, ok := files[f]; !ok {
+				stale[f] = true
+			}
+		}
+	}
+
+	// The pin is written first, so that writes of the source starting in the meantime don't overwrite restored files
+	if err := os.MkdirAll(filepath.Dir(p), DefaultDirMode); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(p, []byte(id+"\n"), DefaultFileMode); err != nil {
+		return err
+	}
+
+	w := newWriter(dir, opts)
+	// Snapshots recorded without modes are restored with the default one rather than 0000
+	if meta.Mode != 0 {
+		w.fileMode = meta.Mode
+	}
+	newDir, currentDir := filepath.Join(dir, "new"), filepath.Join(dir, "current")
+	for _, f := range meta.Files {
+		if err := w.writeFile(newDir, currentDir, f, files[f]); err != nil {
+			return err
+		}
+	}
+	for f := range stale {
+		currentFile, err := safePath(currentDir, f)
+		if err != nil {
+			return err
+		}
+		log.Printf("Removing file %s", currentFile)
+		if err := os.Remove(currentFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// UnpinSnapshot resumes writes of the source. The current dir is updated on the next reconciliation.
+func UnpinSnapshot(dir, source string) error {
+	if dir == "" {
+		dir = defaultOutputDir
+	}
+	p, err := pinPath(dir, source)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
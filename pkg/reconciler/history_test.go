@@ -0,0 +1,213 @@
+package reconciler
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestWriterHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crossover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := DefaultFileOptions()
+	opts.History = 2
+
+	writeFiles := func(name, rv string, data map[string]string) {
+		t.Helper()
+		cm := ConfigMap{
+			ObjectMeta: ObjectMeta{Name: name, Namespace: "default", ResourceVersion: rv},
+			Data:       data,
+		}
+		if err := newWriter(dir, opts).write(configMapSource("default", name), cm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write := func(rv, content string) {
+		t.Helper()
+		writeFiles("envoy-xds", rv, map[string]string{"cds.yaml": content})
+	}
+	read := func(f string) string {
+		t.Helper()
+		bs, err := ioutil.ReadFile(filepath.Join(dir, "current", f))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(bs)
+	}
+	current := func() string {
+		t.Helper()
+		return read("cds.yaml")
+	}
+
+	write("1", "v1")
+	// The same files aren't kept twice
+	write("1", "v1")
+	write("2", "v2")
+	writeFiles("envoy-xds", "3", map[string]string{"cds.yaml": "v3", "lds.yaml": "v3"})
+
+	snapshots, err := ListSnapshots(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 2 {
+		t.Fatalf("unexpected number of snapshots: %+v", snapshots)
+	}
+	v2 := snapshots[0]
+	if v2.Source != "configmaps/default/envoy-xds" || v2.ResourceVersion != "2" || v2.Hash != snapshotHash(map[string][]byte{"cds.yaml": []byte("v2")}) || len(v2.Files) != 1 || v2.Files[0] != "cds.yaml" {
+		t.Errorf("unexpected snapshot: %+v", v2)
+	}
+
+	if err := PinSnapshot(dir, v2.ID, opts); err != nil {
+		t.Fatal(err)
+	}
+	if c := current(); c != "v2" {
+		t.Errorf("unexpected file after pinning: %s", c)
+	}
+	// Files missing in the pinned snapshot are removed
+	if _, err := os.Stat(filepath.Join(dir, "current", "lds.yaml")); !os.IsNotExist(err) {
+		t.Errorf("unexpected lds.yaml after pinning: %v", err)
+	}
+
+	// Writes of the pinned source are skipped, while the other sources are written
+	write("4", "v4")
+	if c := current(); c != "v2" {
+		t.Errorf("unexpected file while pinned: %s", c)
+	}
+	writeFiles("envoy-eds", "1", map[string]string{"eds.yaml": "v1"})
+	if c := read("eds.yaml"); c != "v1" {
+		t.Errorf("unexpected file of another source while pinned: %s", c)
+	}
+	pinned, err := PinnedSnapshots(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := cmp.Diff(map[string]string{"configmaps/default/envoy-xds": v2.ID}, pinned); d != "" {
+		t.Errorf("unexpected pinned snapshots: %s", d)
+	}
+
+	// The pinned snapshot is served over xDS as well
+	store := &memStore{}
+	updateSnapshot(store, dir, "configmaps/default/envoy-xds", ConfigMap{
+		ObjectMeta: ObjectMeta{Name: "envoy-xds", Namespace: "default"},
+		Data:       map[string]string{"cds.yaml": "v4"},
+	})
+	if d := cmp.Diff(map[string]string{"cds.yaml": "v2"}, store.files["configmaps/default/envoy-xds"]); d != "" {
+		t.Errorf("unexpected files served while pinned: %s", d)
+	}
+
+	if err := UnpinSnapshot(dir, "configmaps/default/envoy-xds"); err != nil {
+		t.Fatal(err)
+	}
+	write("4", "v4")
+	if c := current(); c != "v4" {
+		t.Errorf("unexpected file after unpinning: %s", c)
+	}
+
+	for _, id := range []string{"../current", "missing", ""} {
+		if err := PinSnapshot(dir, id, opts); err == nil {
+			t.Errorf("%q: expected error", id)
+		}
+	}
+	for _, source := range []string{"envoy-xds", "default/envoy-xds", "configmaps/default/../x", "configmaps/a_b/c", "config_maps/default/c", "configmaps//x"} {
+		if err := UnpinSnapshot(dir, source); err == nil {
+			t.Errorf("%q: expected error", source)
+		}
+	}
+}
+
+func TestPinSnapshotKeepsSourcesOfOtherKinds(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crossover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := DefaultFileOptions()
+	opts.History = 1
+
+	write := func(source, file, content string) {
+		t.Helper()
+		cm := ConfigMap{
+			ObjectMeta: ObjectMeta{Name: "podinfo", Namespace: "default"},
+			Data:       map[string]string{file: content},
+		}
+		if err := newWriter(dir, opts).write(source, cm); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The configmap and the endpoints of the service have the same name
+	write(configMapSource("default", "podinfo"), "cds.yaml", "v1")
+	write(endpointsSource("default", "podinfo"), "eds-podinfo.yaml", "v1")
+
+	snapshots, err := ListSnapshots(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 2 {
+		t.Fatalf("snapshots of other kinds are removed from the history: %+v", snapshots)
+	}
+
+	if err := PinSnapshot(dir, snapshots[0].ID, opts); err != nil {
+		t.Fatal(err)
+	}
+	write(endpointsSource("default", "podinfo"), "eds-podinfo.yaml", "v2")
+
+	bs, err := ioutil.ReadFile(filepath.Join(dir, "current", "eds-podinfo.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bs) != "v2" {
+		t.Errorf("unexpected file of the endpoints while the configmap is pinned: %s", bs)
+	}
+}
+
+func TestPinSnapshotWithoutMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crossover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := DefaultFileOptions()
+	opts.History = 1
+
+	cm := ConfigMap{
+		ObjectMeta: ObjectMeta{Name: "envoy-xds", Namespace: "default"},
+		Data:       map[string]string{"cds.yaml": "v1"},
+	}
+	if err := newWriter(dir, opts).write(configMapSource("default", "envoy-xds"), cm); err != nil {
+		t.Fatal(err)
+	}
+	snapshots, err := ListSnapshots(dir)
+	if err != nil || len(snapshots) != 1 {
+		t.Fatalf("unexpected snapshots: %+v: %v", snapshots, err)
+	}
+
+	// Snapshots recorded by hand or by older versions may lack modes
+	meta := filepath.Join(dir, historyDir, snapshots[0].ID, snapshotMetadataFile)
+	if err := ioutil.WriteFile(meta, []byte(`{"id": "`+snapshots[0].ID+`", "source": "configmaps/default/envoy-xds", "hash": "abc", "files": ["cds.yaml"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "current", "cds.yaml")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := PinSnapshot(dir, snapshots[0].ID, opts); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(dir, "current", "cds.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != DefaultFileMode {
+		t.Errorf("unexpected mode of the restored file: %v", info.Mode().Perm())
+	}
+}
@@ -0,0 +1,140 @@
+package reconciler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configFormat is the format of an xDS file. Envoy picks the parser by the file extension, so the generated file
+// must be written in the format of the template.
+type configFormat int
+
+const (
+	formatYAML configFormat = iota
+	formatJSON
+)
+
+// detectFormat returns the format of the file from its extension, or from its content when the extension is unknown
+func detectFormat(key, conf string) configFormat {
+	switch strings.ToLower(filepath.Ext(key)) {
+	case ".json":
+		return formatJSON
+	case ".yaml", ".yml":
+		return formatYAML
+	}
+	trimmed := strings.TrimSpace(conf)
+	if strings.HasPrefix(trimmed, "{") && json.Valid([]byte(trimmed)) {
+		return formatJSON
+	}
+	return formatYAML
+}
+
+// encodeConfig returns the text of the updated document parsed from src, in the format of the file
+func encodeConfig(key, src string, doc *yaml.Node) (string, error) {
+	if detectFormat(key, src) == formatYAML {
+		return encodeYAMLNode(src, doc)
+	}
+	// JSON is a subset of YAML, so that weights can be spliced into JSON as well
+	if patched, ok := patchScalars(src, doc); ok {
+		return patched, nil
+	}
+	return encodeJSONNode(doc, jsonIndent(src))
+}
+
+// encodeJSONNode encodes the yaml.Node tree in JSON.
+// Keys are written in the order of the document, so that the output is deterministic and close to the template.
+func encodeJSONNode(doc *yaml.Node, indent string) (string, error) {
+	var buf bytes.Buffer
+	if err := writeJSONNode(&buf, doc); err != nil {
+		return "", err
+	}
+	if indent == "" {
+		return buf.String() + "\n", nil
+	}
+	var out bytes.Buffer
+	if err := json.Indent(&out, buf.Bytes(), "", indent); err != nil {
+		return "", fmt.Errorf("encoding json: %v", err)
+	}
+	out.WriteByte('\n')
+	return out.String(), nil
+}
+
+func writeJSONNode(buf *bytes.Buffer, n *yaml.Node) error {
+	switch n.Kind {
+	case yaml.DocumentNode:
+		if len(n.Content) == 0 {
+			buf.WriteString("null")
+			return nil
+		}
+		return writeJSONNode(buf, n.Content[0])
+	case yaml.AliasNode:
+		return writeJSONNode(buf, n.Alias)
+	case yaml.MappingNode:
+		buf.WriteByte('{')
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			k, err := json.Marshal(n.Content[i].Value)
+			if err != nil {
+				return err
+			}
+			buf.Write(k)
+			buf.WriteByte(':')
+			if err := writeJSONNode(buf, n.Content[i+1]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	case yaml.SequenceNode:
+		buf.WriteByte('[')
+		for i, e := range n.Content {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeJSONNode(buf, e); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case yaml.ScalarNode:
+		var v interface{}
+		if n.ShortTag() == "!!str" {
+			v = n.Value
+		} else if err := n.Decode(&v); err != nil {
+			return err
+		}
+		bs, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Errorf("encoding %q in json: %v", n.Value, err)
+		}
+		buf.Write(bs)
+	default:
+		return fmt.Errorf("unexpected yaml node kind %d", n.Kind)
+	}
+	return nil
+}
+
+// jsonIndent returns the indentation of the first indented line of the JSON document,
+// or an empty string when the document is written in a single line. New documents are indented with two spaces.
+func jsonIndent(src string) string {
+	if strings.TrimSpace(src) == "" {
+		return "  "
+	}
+	lines := strings.Split(strings.TrimSpace(src), "\n")
+	for _, l := range lines[1:] {
+		indent := l[:len(l)-len(strings.TrimLeft(l, " \t"))]
+		if indent != "" {
+			return indent
+		}
+	}
+	if len(lines) > 1 {
+		return "  "
+	}
+	return ""
+}
@@ -0,0 +1,160 @@
+package reconciler
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+const rdsJSON = `{
+    "version_info": "0",
+    "resources": [
+        {
+            "@type": "type.googleapis.com/envoy.api.v2.RouteConfiguration",
+            "name": "local_route",
+            "virtual_hosts": [
+                {
+                    "name": "podinfo",
+                    "domains": ["*"],
+                    "routes": [
+                        {
+                            "match": {"prefix": "/"},
+                            "route": {
+                                "weighted_clusters": {
+                                    "clusters": [
+                                        {"name": "podinfo-v1", "weight": 90},
+                                        {"name": "podinfo-v2", "weight": 10}
+                                    ]
+                                }
+                            }
+                        }
+                    ]
+                }
+            ]
+        }
+    ]
+}
+`
+
+func TestDetectFormat(t *testing.T) {
+	testcases := []struct {
+		key, conf string
+		expected  configFormat
+	}{
+		{key: "rds.json", conf: "", expected: formatJSON},
+		{key: "rds.yaml", conf: `{"version_info": "0"}`, expected: formatYAML},
+		{key: "rds.YML", conf: "", expected: formatYAML},
+		{key: "rds", conf: ` {"version_info": "0"}`, expected: formatJSON},
+		{key: "rds", conf: `{version_info: "0"}`, expected: formatYAML},
+		{key: "rds", conf: "version_info: \"0\"\n", expected: formatYAML},
+	}
+
+	for _, tc := range testcases {
+		if actual := detectFormat(tc.key, tc.conf); actual != tc.expected {
+			t.Errorf("%s %q: expected %d, got %d", tc.key, tc.conf, tc.expected, actual)
+		}
+	}
+}
+
+func TestMergeTrafficSplitJSON(t *testing.T) {
+	ts := TrafficSplit{
+		ObjectMeta: ObjectMeta{Namespace: "default"},
+		Spec: TrafficSplitSpec{
+			Service: "podinfo",
+			Backends: []TrafficSplitBackend{
+				{Service: "podinfo-v1", Weight: 25},
+				{Service: "podinfo-v2", Weight: 75},
+			},
+		},
+	}
+
+	data, err := mergeTrafficSplits(ConfigMap{Data: map[string]string{"rds.json": rdsJSON}}, ts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := strings.Replace(rdsJSON, `"weight": 90`, `"weight": 25`, 1)
+	expected = strings.Replace(expected, `"weight": 10`, `"weight": 75`, 1)
+	if diff := cmp.Diff(expected, data["rds.json"]); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestMergeTrafficSplitJSONStructuralChanges(t *testing.T) {
+	tplCm := ConfigMap{
+		ObjectMeta: ObjectMeta{Annotations: map[string]string{
+			AnnotationTrafficSplitMode: TrafficSplitModeAuthoritative,
+			AnnotationCDSKey:           "cds.json",
+			AnnotationClusterPrototype: `connect_timeout: 0.25s`,
+		}},
+		Data: map[string]string{"rds.json": rdsJSON},
+	}
+	ts := TrafficSplit{
+		ObjectMeta: ObjectMeta{Namespace: "default"},
+		Spec: TrafficSplitSpec{
+			Service: "podinfo",
+			Backends: []TrafficSplitBackend{
+				{Service: "podinfo-v1", Weight: 50},
+				{Service: "podinfo-v3", Weight: 50},
+			},
+		},
+	}
+
+	data, err := mergeTrafficSplits(tplCm, ts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expectedRDS := `{
+    "version_info": "0",
+    "resources": [
+        {
+            "@type": "type.googleapis.com/envoy.api.v2.RouteConfiguration",
+            "name": "local_route",
+            "virtual_hosts": [
+                {
+                    "name": "podinfo",
+                    "domains": [
+                        "*"
+                    ],
+                    "routes": [
+                        {
+                            "match": {
+                                "prefix": "/"
+                            },
+                            "route": {
+                                "weighted_clusters": {
+                                    "clusters": [
+                                        {
+                                            "name": "podinfo-v1",
+                                            "weight": 50
+                                        },
+                                        {
+                                            "name": "podinfo-v3",
+                                            "weight": 50
+                                        }
+                                    ]
+                                }
+                            }
+                        }
+                    ]
+                }
+            ]
+        }
+    ]
+}
+`
+	if diff := cmp.Diff(expectedRDS, data["rds.json"]); diff != "" {
+		t.Errorf(diff)
+	}
+
+	cds := data["cds.json"]
+	if !json.Valid([]byte(cds)) {
+		t.Fatalf("expected cds.json to be valid json:\n%s", cds)
+	}
+	if !strings.HasPrefix(cds, "{\n  \"version_info\": \"0\",\n  \"resources\": [") {
+		t.Errorf("unexpected cds.json:\n%s", cds)
+	}
+}
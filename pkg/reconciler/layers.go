@@ -0,0 +1,161 @@
+package reconciler
+
+import (
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/mumoshu/crossover/pkg/kubeclient"
+	"gopkg.in/yaml.v3"
+)
+
+// LayeredConfigmapReconciler writes one Envoy snapshot made of a base configmap and ordered overlay configmaps,
+// so that e.g. platform and application teams can own separate layers of the same Envoy.
+// Each file of an overlay is patched into the file of the same name in the layers below it.
+type LayeredConfigmapReconciler struct {
+	Client    kubeclient.ReadOnlyClient
+	Namespace string
+	Output
+	// TemplateEnv are the environment variables templates can read via `env`, in addition to POD_NAME and POD_NAMESPACE
+	TemplateEnv []string
+	// Layers are the names of configmaps, from the base to the top-most overlay
+	Layers []string
+}
+
+// Reconcile rebuilds the snapshot from all the layers, regardless of the name of the updated configmap
+func (s *LayeredConfigmapReconciler) Reconcile(c string) error {
+	log.Printf("Reconciling configmap %s in layers %v", c, s.Layers)
+
+	var layers []ConfigMap
+	for _, name := range s.Layers {
+		cm := ConfigMap{}
+		if err := s.Client.Get(s.Namespace, name, &cm); err != nil {
+			log.Printf("Skipping layers %v: get configmap %s/%s: %v", s.Layers, s.Namespace, name, err)
+			return nil
+		}
+
+		cm, err := RenderConfigMap(cm, s.Client, s.Namespace, s.TemplateEnv)
+		if err != nil {
+			log.Printf("Skipping layers %v: configmap %s/%s: %v", s.Layers, s.Namespace, name, err)
+			return nil
+		}
+
+		layers = append(layers, cm)
+	}
+
+	merged, err := mergeLayers(layers)
+	if err != nil {
+		log.Printf("Skipping layers %v: %v", s.Layers, err)
+		return nil
+	}
+
+	if err := s.output(configMapSource(s.Namespace, s.Layers[0]), merged, newWriter); err != nil {
+		return fmt.Errorf("failed writing %v: %v", merged, err)
+	}
+	return nil
+}
+
+// mergeLayers patches the overlays into the base, which is the first configmap, in order.
+// The patch type of an overlay is read from its annotation, and defaults to the strategic one.
+func mergeLayers(layers []ConfigMap) (ConfigMap, error) {
+	if len(layers) == 0 {
+		return ConfigMap{}, fmt.Errorf("no layers")
+	}
+
+	base := layers[0]
+	res := ConfigMap{ObjectMeta: base.ObjectMeta, Data: map[string]string{}, BinaryData: map[string][]byte{}}
+	for k, v := range base.Data {
+		res.Data[k] = v
+	}
+	for k, v := range base.BinaryData {
+		res.BinaryData[k] = v
+	}
+
+	// Paths of files are combined, so that overlays can add files in subdirectories
+	paths := map[string]string{}
+	res.ObjectMeta.Annotations = map[string]string{}
+	for k, v := range base.ObjectMeta.Annotations {
+		res.ObjectMeta.Annotations[k] = v
+	}
+
+	for _, l := range layers {
+		if a := l.ObjectMeta.Annotations[AnnotationPaths]; a != "" {
+			m := map[string]string{}
+			if err := yaml.Unmarshal([]byte(a), &m); err != nil {
+				return ConfigMap{}, fmt.Errorf("configmap %s: parsing annotation %s: %v", l.ObjectMeta.Name, AnnotationPaths, err)
+			}
+			for k, v := range m {
+				paths[k] = v
+			}
+		}
+	}
+	if len(paths) > 0 {
+		bs, err := yaml.Marshal(paths)
+		if err != nil {
+			return ConfigMap{}, err
+		}
+		res.ObjectMeta.Annotations[AnnotationPaths] = string(bs)
+	}
+
+	for _, overlay := range layers[1:] {
+		// Binary files can't be patched, and replace the files of the same names
+		for k, v := range overlay.BinaryData {
+			res.BinaryData[k] = v
+			delete(res.Data, k)
+		}
+
+		var strategic bool
+		switch t := overlay.ObjectMeta.Annotations[AnnotationPatchType]; t {
+		case "", PatchTypeStrategic:
+			strategic = true
+		case PatchTypeMerge:
+		default:
+			return ConfigMap{}, fmt.Errorf("configmap %s: invalid value for annotation %s: %q", overlay.ObjectMeta.Name, AnnotationPatchType, t)
+		}
+
+		files := make([]string, 0, len(overlay.Data))
+		for f := range overlay.Data {
+			files = append(files, f)
+		}
+		sort.Strings(files)
+
+		for _, file := range files {
+			patch := overlay.Data[file]
+			delete(res.BinaryData, file)
+			src, ok := res.Data[file]
+			if !ok {
+				res.Data[file] = patch
+				continue
+			}
+			out, err := patchConfig(file, src, patch, strategic)
+			if err != nil {
+				return ConfigMap{}, fmt.Errorf("configmap %s: %s: %v", overlay.ObjectMeta.Name, file, err)
+			}
+			res.Data[file] = out
+		}
+	}
+
+	return res, nil
+}
+
+// patchConfig applies the patch to the YAML or JSON file, and returns the result in the format of the file
+func patchConfig(file, src, patch string, strategic bool) (string, error) {
+	doc, err := decodeYAML(src)
+	if err != nil {
+		return "", err
+	}
+	p, err := decodeYAML(patch)
+	if err != nil {
+		return "", fmt.Errorf("parsing patch: %v", err)
+	}
+	if p == nil {
+		return src, nil
+	}
+	if doc == nil {
+		doc = &yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	}
+
+	doc.Content[0] = patchNode(doc.Content[0], p.Content[0], strategic)
+
+	return encodeConfig(file, src, doc)
+}
@@ -0,0 +1,153 @@
+package reconciler
+
+import (
+	"fmt"
+
+	"github.com/mumoshu/crossover/pkg/query"
+	"gopkg.in/yaml.v3"
+)
+
+// mergeSource is a trafficsplit prepared for the merge into a template
+type mergeSource struct {
+	ts       TrafficSplit
+	backends []clusterWeight
+	paths    []*query.Query
+}
+
+// mergeTrafficSplits merges the backend weights of the trafficsplits into the data of the template configmap,
+// and returns the data of the generated configmap.
+// Trafficsplits are merged one by one in the given order, so that the result is deterministic even when two
+// trafficsplits target the same `weighted_clusters`.
+// Files that contain no `weighted_clusters` to merge are copied as is, or omitted when the template says so.
+func mergeTrafficSplits(tplCm ConfigMap, tss ...TrafficSplit) (map[string]string, error) {
+	opts, err := newTemplateOptions(tplCm)
+	if err != nil {
+		return nil, err
+	}
+
+	var sources []mergeSource
+	for _, ts := range tss {
+		s, err := newMergeSource(ts, opts)
+		if err != nil {
+			return nil, fmt.Errorf("trafficsplit %s: %v", ts.ObjectMeta.Name, err)
+		}
+		sources = append(sources, s)
+	}
+
+	data := map[string]string{}
+DATA:
+	for file, conf := range tplCm.Data {
+		obj, err := decodeYAML(conf)
+		if err != nil {
+			if opts.render {
+				// Templates are rendered after the merge, and can be invalid YAML until then
+				data[file] = conf
+				continue DATA
+			}
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		if obj == nil {
+			if opts.copyUnmatched {
+				data[file] = conf
+			}
+			continue DATA
+		}
+
+		var found bool
+		for _, s := range sources {
+			f, err := s.merge(obj, file == opts.cdsKey, opts)
+			if err != nil {
+				return nil, fmt.Errorf("trafficsplit %s: %s: %v", s.ts.ObjectMeta.Name, file, err)
+			}
+			found = found || f
+		}
+
+		if !found {
+			if opts.copyUnmatched {
+				data[file] = conf
+			}
+			continue DATA
+		}
+
+		out, err := encodeConfig(file, conf, obj)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+
+		data[file] = out
+	}
+
+	if _, ok := tplCm.Data[opts.cdsKey]; !ok && opts.clusterPrototype != nil {
+		obj, err := decodeYAML(`version_info: "0"` + "\n")
+		if err != nil {
+			return nil, err
+		}
+		var added bool
+		for _, s := range sources {
+			a, err := synthesizeClusters(obj, s.ts, s.backends, opts)
+			if err != nil {
+				return nil, fmt.Errorf("trafficsplit %s: %s: %v", s.ts.ObjectMeta.Name, opts.cdsKey, err)
+			}
+			added = added || a
+		}
+		if added {
+			out, err := encodeConfig(opts.cdsKey, "", obj)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", opts.cdsKey, err)
+			}
+			data[opts.cdsKey] = out
+		}
+	}
+
+	return data, nil
+}
+
+func newMergeSource(ts TrafficSplit, opts *templateOptions) (mergeSource, error) {
+	s := mergeSource{ts: ts}
+
+	for _, b := range ts.Spec.Backends {
+		name, err := opts.clusterName(ts, b)
+		if err != nil {
+			return s, err
+		}
+		s.backends = append(s.backends, clusterWeight{Name: name, Service: b.Service, Weight: b.Weight})
+	}
+
+	paths, err := opts.paths(ts)
+	if err != nil {
+		return s, err
+	}
+	s.paths = paths
+
+	return s, nil
+}
+
+// merge merges the trafficsplit into the document, and synthesizes clusters for its backends when the document is
+// the CDS file. It returns true if anything in the document is merged into.
+func (s mergeSource) merge(doc *yaml.Node, cds bool, opts *templateOptions) (bool, error) {
+	var (
+		found    bool
+		mergeErr error
+	)
+	for _, path := range s.paths {
+		f := path.Each(doc, func(wc interface{}) {
+			if err := mergeWeightedClusters(wc, s.backends, opts); err != nil && mergeErr == nil {
+				mergeErr = err
+			}
+		})
+		found = found || f
+	}
+	if mergeErr != nil {
+		return false, mergeErr
+	}
+
+	if cds && opts.clusterPrototype != nil {
+		added, err := synthesizeClusters(doc, s.ts, s.backends, opts)
+		if err != nil {
+			return false, err
+		}
+		found = found || added
+	}
+
+	return found, nil
+}
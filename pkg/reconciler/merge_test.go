@@ -0,0 +1,147 @@
+package reconciler
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+const commentedRDS = `# Routes for podinfo
+version_info: "0"
+resources:
+- "@type": type.googleapis.com/envoy.api.v2.RouteConfiguration
+  name: local_route
+  virtual_hosts:
+  - name: podinfo   # the apex service
+    domains: ['*']
+    routes:
+    - match: { prefix: "/" }
+      route:
+        weighted_clusters:
+          # keep in sync with cds.yaml
+          clusters:
+          - name: podinfo-v1
+            weight:   90
+          - name: podinfo-v2
+            weight: 10 # canary
+`
+
+func TestMergeTrafficSplitPreservesFormatting(t *testing.T) {
+	tplCm := ConfigMap{Data: map[string]string{
+		"rds.yaml":   commentedRDS,
+		"other.yaml": "foo: bar\n",
+	}}
+	ts := TrafficSplit{
+		ObjectMeta: ObjectMeta{Namespace: "default"},
+		Spec: TrafficSplitSpec{
+			Service: "podinfo",
+			Backends: []TrafficSplitBackend{
+				{Service: "podinfo-v1", Weight: 25},
+				{Service: "podinfo-v2", Weight: 75},
+			},
+		},
+	}
+
+	data, err := mergeTrafficSplits(tplCm, ts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := strings.Replace(commentedRDS, "weight:   90", "weight:   25", 1)
+	expected = strings.Replace(expected, "weight: 10 # canary", "weight: 75 # canary", 1)
+
+	if diff := cmp.Diff(map[string]string{"rds.yaml": expected, "other.yaml": "foo: bar\n"}, data); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestMergeTrafficSplitUnmatchedFiles(t *testing.T) {
+	ts := TrafficSplit{
+		ObjectMeta: ObjectMeta{Namespace: "default"},
+		Spec: TrafficSplitSpec{
+			Service:  "podinfo",
+			Backends: []TrafficSplitBackend{{Service: "podinfo-v1", Weight: 100}},
+		},
+	}
+
+	testcases := []struct {
+		annotation string
+		expected   []string
+	}{
+		{annotation: "", expected: []string{"empty.yaml", "lds.yaml", "rds.yaml"}},
+		{annotation: UnmatchedFilesCopy, expected: []string{"empty.yaml", "lds.yaml", "rds.yaml"}},
+		{annotation: UnmatchedFilesSkip, expected: []string{"rds.yaml"}},
+	}
+
+	for _, tc := range testcases {
+		tplCm := ConfigMap{
+			ObjectMeta: ObjectMeta{Annotations: map[string]string{AnnotationUnmatchedFiles: tc.annotation}},
+			Data: map[string]string{
+				"rds.yaml":   commentedRDS,
+				"lds.yaml":   "# listeners\nresources: []\n",
+				"empty.yaml": "",
+			},
+		}
+
+		data, err := mergeTrafficSplits(tplCm, ts)
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %v", tc.annotation, err)
+		}
+
+		var actual []string
+		for k, v := range data {
+			if k != "rds.yaml" && v != tplCm.Data[k] {
+				t.Errorf("%q: expected %s to be copied as is, got %q", tc.annotation, k, v)
+			}
+			actual = append(actual, k)
+		}
+		sort.Strings(actual)
+		if diff := cmp.Diff(tc.expected, actual); diff != "" {
+			t.Errorf("%q: %s", tc.annotation, diff)
+		}
+	}
+
+	_, err := mergeTrafficSplits(ConfigMap{ObjectMeta: ObjectMeta{Annotations: map[string]string{AnnotationUnmatchedFiles: "drop"}}}, ts)
+	if err == nil {
+		t.Errorf("expected an error for the invalid annotation")
+	}
+}
+
+func TestMergeTrafficSplitKeepsCommentsOnStructuralChanges(t *testing.T) {
+	tplCm := ConfigMap{
+		ObjectMeta: ObjectMeta{Annotations: map[string]string{
+			AnnotationTrafficSplitMode: TrafficSplitModeAuthoritative,
+		}},
+		Data: map[string]string{"rds.yaml": commentedRDS},
+	}
+	ts := TrafficSplit{
+		ObjectMeta: ObjectMeta{Namespace: "default"},
+		Spec: TrafficSplitSpec{
+			Service: "podinfo",
+			Backends: []TrafficSplitBackend{
+				{Service: "podinfo-v2", Weight: 50},
+				{Service: "podinfo-v3", Weight: 50},
+			},
+		},
+	}
+
+	data, err := mergeTrafficSplits(tplCm, ts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	actual := data["rds.yaml"]
+	for _, s := range []string{"# Routes for podinfo", "# the apex service", "# keep in sync with cds.yaml", "# canary", "podinfo-v3"} {
+		if !strings.Contains(actual, s) {
+			t.Errorf("expected %q in the generated config:\n%s", s, actual)
+		}
+	}
+	if strings.Contains(actual, "podinfo-v1") {
+		t.Errorf("expected podinfo-v1 to be removed:\n%s", actual)
+	}
+	if strings.Index(actual, "version_info") > strings.Index(actual, "resources") {
+		t.Errorf("expected key order to be preserved:\n%s", actual)
+	}
+}
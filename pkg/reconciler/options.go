@@ -0,0 +1,267 @@
+package reconciler
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/mumoshu/crossover/pkg/query"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	annotationPrefix = "crossover.mumoshu.github.io/"
+
+	// AnnotationTrafficSplitMode is the annotation on the template configmap to specify how trafficsplits are merged.
+	// `merge`(default) updates weights of existing clusters only. `authoritative` adds clusters for new backends and
+	// removes or zeroes clusters missing in the trafficsplit.
+	AnnotationTrafficSplitMode = annotationPrefix + "trafficsplit-mode"
+
+	// AnnotationMissingBackends is the annotation on the template configmap to specify what to do with clusters missing
+	// in the trafficsplit in the authoritative mode. Either `remove`(default) or `zero`.
+	AnnotationMissingBackends = annotationPrefix + "missing-backends"
+
+	// AnnotationClusterNameTemplate is the annotation on the template configmap to specify the Go template to compute
+	// the cluster name from a trafficsplit backend. Defaults to `{{ .Service }}`.
+	AnnotationClusterNameTemplate = annotationPrefix + "cluster-name-template"
+
+	// AnnotationClusterPrototype is the annotation on the template configmap to specify the Go template of the Envoy
+	// cluster in YAML, that is used to synthesize CDS entries for trafficsplit backends missing in the CDS file.
+	AnnotationClusterPrototype = annotationPrefix + "cluster-prototype"
+
+	// AnnotationCDSKey is the annotation on the template configmap to specify the key of the CDS file that
+	// synthesized clusters are written to. Defaults to `cds.yaml`.
+	AnnotationCDSKey = annotationPrefix + "cds-key"
+
+	// AnnotationMergePaths is the annotation on the template configmap to specify the paths to `weighted_clusters`
+	// objects that trafficsplits are merged into, one per line. Each path is a Go template that renders a query
+	// of the query package.
+	// Defaults to `resources/*/virtual_hosts/name={{ .RootService }}/routes/*/route/weighted_clusters`.
+	AnnotationMergePaths = annotationPrefix + "merge-paths"
+
+	// AnnotationUnmatchedFiles is the annotation on the template configmap to specify what to do with files that
+	// contain nothing to merge the trafficsplit into. `copy`(default) passes them through to the generated configmap
+	// unchanged, so that it is always a complete superset of the template. `skip` omits them.
+	AnnotationUnmatchedFiles = annotationPrefix + "unmatched-files"
+
+	// AnnotationRenderTemplates is the annotation on the configmap to render its data as Go templates before writing
+	// them to the output directory, when set to `true`.
+	AnnotationRenderTemplates = annotationPrefix + "render-templates"
+
+	// AnnotationPatchType is the annotation on the overlay configmap to specify how its files are patched into the
+	// layers below. Either `strategic`(default) or `merge`.
+	AnnotationPatchType = annotationPrefix + "patch-type"
+
+	// AnnotationPaths is the annotation on the configmap to map its keys to paths relative to the output directory,
+	// in YAML like `lds.yaml: listeners/lds.yaml`. Keys missing in the map are written to files of the same names.
+	AnnotationPaths = annotationPrefix + "paths"
+
+	// AnnotationEndpoints is the annotation on the configmap to specify the services whose endpoints are written as EDS
+	// configs, one `<service>[:<port name>][=<cluster name>]` per line
+	AnnotationEndpoints = annotationPrefix + "endpoints"
+
+	// AnnotationServiceNode is the annotation on the configmap or the secret to serve its resources over xDS only to
+	// Envoys started with the `--service-node` of the value. Files are written regardless of it.
+	AnnotationServiceNode = annotationPrefix + "service-node"
+
+	// AnnotationServiceCluster is the annotation on the configmap or the secret to serve its resources over xDS only to
+	// Envoys started with the `--service-cluster` of the value. Files are written regardless of it.
+	AnnotationServiceCluster = annotationPrefix + "service-cluster"
+
+	// AnnotationCanaryWeightPrefix is the prefix of the annotations on the template configmap to set the canary
+	// weight of Argo Rollouts, like `crossover.mumoshu.github.io/canary-weight.<rollout name>: "25"`.
+	// It takes precedence over the weight read from the Rollout, so that e.g. a traffic routing plugin of Argo Rollouts
+	// can route traffic by annotating the configmap.
+	AnnotationCanaryWeightPrefix = annotationPrefix + "canary-weight."
+)
+
+const (
+	TrafficSplitModeMerge         = "merge"
+	TrafficSplitModeAuthoritative = "authoritative"
+
+	MissingBackendsRemove = "remove"
+	MissingBackendsZero   = "zero"
+
+	UnmatchedFilesCopy = "copy"
+	UnmatchedFilesSkip = "skip"
+)
+
+const (
+	defaultClusterNameTemplate = "{{ .Service }}"
+	defaultCDSKey              = "cds.yaml"
+	defaultMergePath           = "resources/*/virtual_hosts/name={{ .RootService }}/routes/*/route/weighted_clusters"
+)
+
+// templateOptions is the per-template configuration of the merge, read from the template configmap's annotations
+type templateOptions struct {
+	authoritative    bool
+	removeMissing    bool
+	clusterNameTmpl  *template.Template
+	clusterPrototype *template.Template
+	cdsKey           string
+	mergePaths       []*template.Template
+	copyUnmatched    bool
+	render           bool
+}
+
+// backendTemplateData is the data available to the cluster name template and the cluster prototype
+type backendTemplateData struct {
+	// Service is the name of the backend service
+	Service string
+	// RootService is the name of the root service of the trafficsplit
+	RootService string
+	// Namespace is the namespace of the trafficsplit
+	Namespace string
+	// ClusterName is the name of the cluster computed from the cluster name template.
+	// This is empty while rendering the cluster name template itself.
+	ClusterName string
+}
+
+// mergePathData is the data available to merge path templates
+type mergePathData struct {
+	// RootService is the name of the root service of the trafficsplit
+	RootService string
+	// Namespace is the namespace of the trafficsplit
+	Namespace string
+}
+
+func newTemplateOptions(cm ConfigMap) (*templateOptions, error) {
+	annotations := cm.ObjectMeta.Annotations
+
+	opts := &templateOptions{
+		removeMissing: true,
+		copyUnmatched: true,
+	}
+
+	switch mode := annotations[AnnotationTrafficSplitMode]; mode {
+	case "", TrafficSplitModeMerge:
+	case TrafficSplitModeAuthoritative:
+		opts.authoritative = true
+	default:
+		return nil, fmt.Errorf("invalid value for annotation %s: %q", AnnotationTrafficSplitMode, mode)
+	}
+
+	switch missing := annotations[AnnotationMissingBackends]; missing {
+	case "", MissingBackendsRemove:
+	case MissingBackendsZero:
+		opts.removeMissing = false
+	default:
+		return nil, fmt.Errorf("invalid value for annotation %s: %q", AnnotationMissingBackends, missing)
+	}
+
+	switch unmatched := annotations[AnnotationUnmatchedFiles]; unmatched {
+	case "", UnmatchedFilesCopy:
+	case UnmatchedFilesSkip:
+		opts.copyUnmatched = false
+	default:
+		return nil, fmt.Errorf("invalid value for annotation %s: %q", AnnotationUnmatchedFiles, unmatched)
+	}
+
+	render, err := renderEnabled(cm)
+	if err != nil {
+		return nil, err
+	}
+	opts.render = render
+
+	tmplText := annotations[AnnotationClusterNameTemplate]
+	if tmplText == "" {
+		tmplText = defaultClusterNameTemplate
+	}
+	tmpl, err := template.New("cluster-name").Option("missingkey=error").Parse(tmplText)
+	if err != nil {
+		return nil, fmt.Errorf("parsing annotation %s: %v", AnnotationClusterNameTemplate, err)
+	}
+	opts.clusterNameTmpl = tmpl
+
+	if proto := annotations[AnnotationClusterPrototype]; proto != "" {
+		tmpl, err := template.New("cluster-prototype").Option("missingkey=error").Parse(proto)
+		if err != nil {
+			return nil, fmt.Errorf("parsing annotation %s: %v", AnnotationClusterPrototype, err)
+		}
+		opts.clusterPrototype = tmpl
+	}
+
+	opts.cdsKey = annotations[AnnotationCDSKey]
+	if opts.cdsKey == "" {
+		opts.cdsKey = defaultCDSKey
+	}
+
+	paths := strings.Split(annotations[AnnotationMergePaths], "\n")
+	for _, p := range paths {
+		p = strings.TrimSpace(p)
+		if p == "" || strings.HasPrefix(p, "#") {
+			continue
+		}
+		tmpl, err := template.New("merge-path").Option("missingkey=error").Parse(p)
+		if err != nil {
+			return nil, fmt.Errorf("parsing annotation %s: %v", AnnotationMergePaths, err)
+		}
+		opts.mergePaths = append(opts.mergePaths, tmpl)
+	}
+	if len(opts.mergePaths) == 0 {
+		opts.mergePaths = []*template.Template{template.Must(template.New("merge-path").Parse(defaultMergePath))}
+	}
+
+	return opts, nil
+}
+
+// clusterName returns the name of the Envoy cluster that corresponds to the trafficsplit backend
+func (o *templateOptions) clusterName(ts TrafficSplit, b TrafficSplitBackend) (string, error) {
+	var buf bytes.Buffer
+	data := backendTemplateData{
+		Service:     b.Service,
+		RootService: ts.Spec.Service,
+		Namespace:   ts.ObjectMeta.Namespace,
+	}
+	if err := o.clusterNameTmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("rendering cluster name for backend %q: %v", b.Service, err)
+	}
+	if buf.Len() == 0 {
+		return "", fmt.Errorf("rendering cluster name for backend %q: empty name", b.Service)
+	}
+	return buf.String(), nil
+}
+
+// renderClusterPrototype returns the Envoy cluster for the trafficsplit backend rendered from the cluster prototype
+func (o *templateOptions) renderClusterPrototype(ts TrafficSplit, b clusterWeight) (*yaml.Node, error) {
+	var buf bytes.Buffer
+	data := backendTemplateData{
+		Service:     b.Service,
+		RootService: ts.Spec.Service,
+		Namespace:   ts.ObjectMeta.Namespace,
+		ClusterName: b.Name,
+	}
+	if err := o.clusterPrototype.Execute(&buf, data); err != nil {
+		return nil, fmt.Errorf("rendering cluster prototype for backend %q: %v", b.Service, err)
+	}
+	doc, err := decodeYAML(buf.String())
+	if err != nil {
+		return nil, fmt.Errorf("parsing cluster prototype rendered for backend %q: %v", b.Service, err)
+	}
+	if doc == nil || doc.Content[0].Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("cluster prototype rendered for backend %q is not a mapping", b.Service)
+	}
+	return doc.Content[0], nil
+}
+
+// paths returns the queries to `weighted_clusters` objects that the trafficsplit is merged into
+func (o *templateOptions) paths(ts TrafficSplit) ([]*query.Query, error) {
+	data := mergePathData{
+		RootService: ts.Spec.Service,
+		Namespace:   ts.ObjectMeta.Namespace,
+	}
+	var paths []*query.Query
+	for _, tmpl := range o.mergePaths {
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return nil, fmt.Errorf("rendering merge path: %v", err)
+		}
+		q, err := query.Parse(buf.String())
+		if err != nil {
+			return nil, fmt.Errorf("invalid merge path: %v", err)
+		}
+		paths = append(paths, q)
+	}
+	return paths, nil
+}
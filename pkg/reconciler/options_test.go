@@ -0,0 +1,124 @@
+package reconciler
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"gopkg.in/yaml.v3"
+)
+
+func TestClusterNameTemplate(t *testing.T) {
+	opts, err := newTemplateOptions(ConfigMap{ObjectMeta: ObjectMeta{Annotations: map[string]string{
+		AnnotationTrafficSplitMode:    TrafficSplitModeAuthoritative,
+		AnnotationClusterNameTemplate: "{{ .Service }}.{{ .Namespace }}",
+	}}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !opts.authoritative || !opts.removeMissing {
+		t.Errorf("unexpected options: %+v", opts)
+	}
+
+	ts := TrafficSplit{ObjectMeta: ObjectMeta{Namespace: "default"}, Spec: TrafficSplitSpec{Service: "podinfo"}}
+	name, err := opts.clusterName(ts, TrafficSplitBackend{Service: "podinfo-v2"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if name != "podinfo-v2.default" {
+		t.Errorf("unexpected cluster name: %q", name)
+	}
+
+	if _, err := newTemplateOptions(ConfigMap{ObjectMeta: ObjectMeta{Annotations: map[string]string{
+		AnnotationMissingBackends: "keep",
+	}}}); err == nil {
+		t.Errorf("expected error for invalid annotation value")
+	}
+}
+
+func TestMergePaths(t *testing.T) {
+	opts, err := newTemplateOptions(ConfigMap{ObjectMeta: ObjectMeta{Annotations: map[string]string{
+		AnnotationMergePaths: `
+# inline route config of the http connection manager, by domain
+resources/*/filter_chains/*/filters/*/typed_config/route_config/virtual_hosts/domains={{ .RootService }}.example.com/routes/*/route/weighted_clusters
+# tcp proxy
+resources/*/filter_chains/*/filters/name=envoy.tcp_proxy/typed_config/weighted_clusters
+`,
+	}}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ts := TrafficSplit{Spec: TrafficSplitSpec{Service: "podinfo"}}
+	paths, err := opts.paths(ts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(paths) != 2 {
+		t.Fatalf("unexpected number of paths: %v", paths)
+	}
+
+	obj := map[string]interface{}{}
+	if err := yaml.Unmarshal([]byte(`resources:
+- name: listener_0
+  filter_chains:
+  - filters:
+    - name: envoy.http_connection_manager
+      typed_config:
+        route_config:
+          virtual_hosts:
+          - name: vh
+            domains:
+            - podinfo.example.com
+            routes:
+            - route:
+                weighted_clusters:
+                  clusters:
+                  - name: podinfo-v1
+                    weight: 100
+                  - name: podinfo-v2
+                    weight: 0
+- name: listener_1
+  filter_chains:
+  - filters:
+    - name: envoy.tcp_proxy
+      typed_config:
+        weighted_clusters:
+          clusters:
+          - name: podinfo-v1
+            weight: 100
+          - name: podinfo-v2
+            weight: 0
+`), &obj); err != nil {
+		t.Fatal(err)
+	}
+
+	backends := []clusterWeight{
+		{Name: "podinfo-v1", Weight: 1},
+		{Name: "podinfo-v2", Weight: 3},
+	}
+
+	var merged []interface{}
+	for _, path := range paths {
+		found := path.Each(obj, func(wc interface{}) {
+			if err := mergeWeightedClusters(wc, backends, opts); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			merged = append(merged, wc)
+		})
+		if !found {
+			t.Errorf("path not found: %v", path)
+		}
+	}
+
+	expected := map[string]interface{}{
+		"clusters": []interface{}{
+			map[string]interface{}{"name": "podinfo-v1", "weight": 25},
+			map[string]interface{}{"name": "podinfo-v2", "weight": 75},
+		},
+	}
+	for i, wc := range merged {
+		if diff := cmp.Diff(expected, wc); diff != "" {
+			t.Errorf("weighted_clusters %d: %s", i, diff)
+		}
+	}
+}
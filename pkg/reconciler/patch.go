@@ -0,0 +1,147 @@
+package reconciler
+
+import (
+	"github.com/mumoshu/crossover/pkg/query"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// PatchTypeStrategic merges lists of objects by their `name`s, so that overlays can add or override e.g. clusters
+	// and listeners without repeating the whole list. An object with `$patch: delete` removes the element of the same
+	// name, and `$patch: replace` replaces the object instead of merging into it.
+	PatchTypeStrategic = "strategic"
+	// PatchTypeMerge is JSON Merge Patch as defined in RFC 7386. Lists are replaced as a whole.
+	PatchTypeMerge = "merge"
+)
+
+const (
+	patchDirectiveKey     = "$patch"
+	patchDirectiveDelete  = "delete"
+	patchDirectiveReplace = "replace"
+	patchMergeKey         = "name"
+)
+
+// patchNode applies the patch to the base node, and returns the patched node.
+// Maps are merged recursively, and a key with the null value in the patch removes the key from the base.
+// Comments of the base are kept for values that are merged or replaced.
+func patchNode(base, patch *yaml.Node, strategic bool) *yaml.Node {
+	base, patch = query.Resolve(base), query.Resolve(patch)
+
+	if patch == nil {
+		return base
+	}
+
+	if patch.Kind == yaml.MappingNode {
+		replace := strategic && directive(patch) == patchDirectiveReplace
+		if base == nil || base.Kind != yaml.MappingNode || replace {
+			base = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		}
+		for i := 0; i+1 < len(patch.Content); i += 2 {
+			k, v := patch.Content[i], query.Resolve(patch.Content[i+1])
+			if strategic && k.Value == patchDirectiveKey {
+				continue
+			}
+			idx := mappingIndex(base, k.Value)
+			if isNull(v) {
+				if idx >= 0 {
+					base.Content = append(base.Content[:idx], base.Content[idx+2:]...)
+				}
+				continue
+			}
+			if idx >= 0 {
+				base.Content[idx+1] = query.InheritComments(patchNode(base.Content[idx+1], v, strategic), base.Content[idx+1])
+				continue
+			}
+			base.Content = append(base.Content, k, patchNode(nil, v, strategic))
+		}
+		return base
+	}
+
+	if strategic && patch.Kind == yaml.SequenceNode && base != nil && base.Kind == yaml.SequenceNode && hasMergeKeys(patch) && hasMergeKeys(base) {
+		for _, e := range patch.Content {
+			e = query.Resolve(e)
+			name := mappingValue(e, patchMergeKey).Value
+			idx := -1
+			for i, b := range base.Content {
+				if mappingValue(query.Resolve(b), patchMergeKey).Value == name {
+					idx = i
+					break
+				}
+			}
+			if directive(e) == patchDirectiveDelete {
+				if idx >= 0 {
+					base.Content = append(base.Content[:idx], base.Content[idx+1:]...)
+				}
+				continue
+			}
+			if idx >= 0 {
+				base.Content[idx] = patchNode(base.Content[idx], e, strategic)
+				continue
+			}
+			base.Content = append(base.Content, patchNode(nil, e, strategic))
+		}
+		return base
+	}
+
+	if patch.Kind == yaml.SequenceNode {
+		// Nulls within the replacement are removed like RFC 7386 does for objects
+		res := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		for _, e := range patch.Content {
+			res.Content = append(res.Content, patchNode(nil, e, strategic))
+		}
+		return res
+	}
+
+	// Scalars take the style of the value they replace rather than the style of the patch, which may be JSON,
+	// so that the patched file looks like it was written by hand
+	res := *patch
+	res.Style = 0
+	if base != nil && base.Kind == yaml.ScalarNode {
+		res.Style = base.Style
+	}
+	return &res
+}
+
+// directive returns the value of `$patch` of the mapping node
+func directive(n *yaml.Node) string {
+	if v := mappingValue(n, patchDirectiveKey); v != nil {
+		return v.Value
+	}
+	return ""
+}
+
+func isNull(n *yaml.Node) bool {
+	return n == nil || (n.Kind == yaml.ScalarNode && n.ShortTag() == "!!null")
+}
+
+// mappingIndex returns the index of the key within the content of the mapping node, or -1 if it's missing
+func mappingIndex(n *yaml.Node, key string) int {
+	if n == nil || n.Kind != yaml.MappingNode {
+		return -1
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// mappingValue returns the value of the key of the mapping node, or nil if it's missing
+func mappingValue(n *yaml.Node, key string) *yaml.Node {
+	if i := mappingIndex(n, key); i >= 0 {
+		return query.Resolve(n.Content[i+1])
+	}
+	return nil
+}
+
+// hasMergeKeys returns true if every element of the sequence node is a mapping with a scalar name
+func hasMergeKeys(seq *yaml.Node) bool {
+	for _, e := range seq.Content {
+		v := mappingValue(query.Resolve(e), patchMergeKey)
+		if v == nil || v.Kind != yaml.ScalarNode {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,154 @@
+package reconciler
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+const baseCDS = `# Managed by the platform team
+resources:
+- "@type": type.googleapis.com/envoy.api.v2.Cluster
+  name: podinfo
+  connect_timeout: 0.25s # keep it short
+  type: STRICT_DNS
+- "@type": type.googleapis.com/envoy.api.v2.Cluster
+  name: legacy
+  connect_timeout: 1s
+`
+
+func TestPatchConfig(t *testing.T) {
+	testcases := []struct {
+		name      string
+		patch     string
+		strategic bool
+		expected  string
+	}{
+		{
+			name: "strategic",
+			patch: `resources:
+- name: podinfo
+  connect_timeout: 1s
+  type: null
+- name: legacy
+  $patch: delete
+- "@type": type.googleapis.com/envoy.api.v2.Cluster
+  name: frontend
+  connect_timeout: 0.5s
+`,
+			strategic: true,
+			expected: `# Managed by the platform team
+resources:
+  - "@type": type.googleapis.com/envoy.api.v2.Cluster
+    name: podinfo
+    connect_timeout: 1s # keep it short
+  - "@type": type.googleapis.com/envoy.api.v2.Cluster
+    name: frontend
+    connect_timeout: 0.5s
+`,
+		},
+		{
+			name: "strategic replace",
+			patch: `resources:
+- name: podinfo
+  $patch: replace
+  connect_timeout: 2s
+`,
+			strategic: true,
+			expected: `# Managed by the platform team
+resources:
+  - name: podinfo
+    connect_timeout: 2s
+  - "@type": type.googleapis.com/envoy.api.v2.Cluster
+    name: legacy
+    connect_timeout: 1s
+`,
+		},
+		{
+			name: "merge",
+			patch: `version_info: "1"
+resources:
+- name: frontend
+`,
+			strategic: false,
+			expected: `# Managed by the platform team
+resources:
+  - name: frontend
+version_info: "1"
+`,
+		},
+		{
+			name:      "scalars only",
+			patch:     `{"resources": [{"name": "podinfo", "connect_timeout": "5s"}]}`,
+			strategic: true,
+			expected: `# Managed by the platform team
+resources:
+- "@type": type.googleapis.com/envoy.api.v2.Cluster
+  name: podinfo
+  connect_timeout: 5s # keep it short
+  type: STRICT_DNS
+- "@type": type.googleapis.com/envoy.api.v2.Cluster
+  name: legacy
+  connect_timeout: 1s
+`,
+		},
+	}
+
+	for _, tc := range testcases {
+		actual, err := patchConfig("cds.yaml", baseCDS, tc.patch, tc.strategic)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+		if diff := cmp.Diff(tc.expected, actual); diff != "" {
+			t.Errorf("%s: %s", tc.name, diff)
+		}
+	}
+}
+
+func TestMergeLayers(t *testing.T) {
+	layers := []ConfigMap{
+		{
+			ObjectMeta: ObjectMeta{Name: "envoy-xds"},
+			Data: map[string]string{
+				"cds.yaml": "resources:\n- name: podinfo\n  connect_timeout: 1s\n",
+				"lds.yaml": "resources: []\n",
+			},
+		},
+		{
+			ObjectMeta: ObjectMeta{Name: "platform"},
+			Data: map[string]string{
+				"cds.yaml": "resources:\n- name: podinfo\n  connect_timeout: 2s\n",
+			},
+		},
+		{
+			ObjectMeta: ObjectMeta{Name: "app", Annotations: map[string]string{AnnotationPatchType: PatchTypeMerge}},
+			Data: map[string]string{
+				"cds.yaml": "version_info: \"2\"\n",
+				"rds.yaml": "resources: []\n",
+			},
+		},
+	}
+
+	actual, err := mergeLayers(layers)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := map[string]string{
+		"cds.yaml": "resources:\n  - name: podinfo\n    connect_timeout: 2s\nversion_info: \"2\"\n",
+		"lds.yaml": "resources: []\n",
+		"rds.yaml": "resources: []\n",
+	}
+	if diff := cmp.Diff(expected, actual.Data); diff != "" {
+		t.Errorf(diff)
+	}
+	if actual.ObjectMeta.Name != "envoy-xds" {
+		t.Errorf("unexpected name: %s", actual.ObjectMeta.Name)
+	}
+
+	layers[1].ObjectMeta.Annotations = map[string]string{AnnotationPatchType: "json"}
+	if _, err := mergeLayers(layers); err == nil {
+		t.Errorf("expected an error for the invalid annotation")
+	}
+}
@@ -0,0 +1,144 @@
+package reconciler
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// filePaths returns the paths of the files relative to the output directory, keyed by the keys of the configmap.
+// The paths are read from the paths annotation, and default to the keys.
+func filePaths(cm ConfigMap) (map[string]string, error) {
+	mapping := map[string]string{}
+	if a := cm.ObjectMeta.Annotations[AnnotationPaths]; a != "" {
+		if err := yaml.Unmarshal([]byte(a), &mapping); err != nil {
+			return nil, fmt.Errorf("parsing annotation %s: %v", AnnotationPaths, err)
+		}
+	}
+
+	paths := map[string]string{}
+	files := map[string]string{}
+	add := func(key string) error {
+		p := key
+		if m, ok := mapping[key]; ok {
+			p = m
+		}
+		p, err := cleanRelPath(p)
+		if err != nil {
+			return fmt.Errorf("key %q: %v", key, err)
+		}
+		if other, ok := files[p]; ok {
+			return fmt.Errorf("keys %q and %q are written to the same path %q", other, key, p)
+		}
+		files[p] = key
+		paths[key] = p
+		return nil
+	}
+	for k := range cm.Data {
+		if err := add(k); err != nil {
+			return nil, err
+		}
+	}
+	for k := range cm.BinaryData {
+		if _, ok := cm.Data[k]; ok {
+			return nil, fmt.Errorf("key %q is in both data and binaryData", k)
+		}
+		if err := add(k); err != nil {
+			return nil, err
+		}
+	}
+	return paths, nil
+}
+
+// reservedNames are the names that can't be the first segment of paths, as they are the working directories
+// of the writer
+var reservedNames = map[string]bool{
+	"new":     true,
+	"current": true,
+}
+
+// cleanRelPath returns the cleaned slash-separated path, or an error if it can point out of the directory it's
+// relative to, or collide with the working directories of the writer
+func cleanRelPath(p string) (string, error) {
+	if p == "" {
+		return "", fmt.Errorf("empty path")
+	}
+	if strings.ContainsAny(p, "\x00\\") {
+		return "", fmt.Errorf("path %q must not contain NUL or backslashes", p)
+	}
+	if strings.HasPrefix(p, "/") || filepath.IsAbs(p) || filepath.VolumeName(p) != "" {
+		return "", fmt.Errorf("absolute path %q is not allowed", p)
+	}
+	for _, seg := range strings.Split(p, "/") {
+		if seg == ".." {
+			return "", fmt.Errorf("path %q must not contain ..", p)
+		}
+	}
+	c := path.Clean(p)
+	if c == "." {
+		return "", fmt.Errorf("path %q points to the directory itself", p)
+	}
+	if first := strings.SplitN(c, "/", 2)[0]; reservedNames[first] {
+		return "", fmt.Errorf("path %q starts with the reserved name %q", p, first)
+	}
+	return c, nil
+}
+
+// safePath returns the path of the file rel within root, or an error if rel is invalid or any existing part of the
+// path is a symlink that points out of root.
+// Symlinks within root are allowed, so that e.g. the output directory can be a mounted volume.
+func safePath(root, rel string) (string, error) {
+	c, err := cleanRelPath(rel)
+	if err != nil {
+		return "", err
+	}
+
+	resolvedRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", fmt.Errorf("resolving %s: %v", root, err)
+	}
+	if resolvedRoot, err = filepath.Abs(resolvedRoot); err != nil {
+		return "", err
+	}
+
+	p := root
+	for _, seg := range strings.Split(c, "/") {
+		p = filepath.Join(p, seg)
+		info, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			// Nothing below can exist
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		target, err := filepath.EvalSymlinks(p)
+		if err != nil {
+			return "", fmt.Errorf("resolving symlink %s: %v", p, err)
+		}
+		if target, err = filepath.Abs(target); err != nil {
+			return "", err
+		}
+		if !within(resolvedRoot, target) {
+			return "", fmt.Errorf("%s is a symlink to %s out of %s", p, target, root)
+		}
+	}
+
+	return filepath.Join(root, filepath.FromSlash(c)), nil
+}
+
+// within returns true if the path is dir or within dir. Both must be absolute and clean.
+func within(dir, p string) bool {
+	rel, err := filepath.Rel(dir, p)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,141 @@
+package reconciler
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCleanRelPath(t *testing.T) {
+	valid := map[string]string{
+		"rds.yaml":                  "rds.yaml",
+		"listeners/lds.yaml":        "listeners/lds.yaml",
+		"./listeners//lds.yaml":     "listeners/lds.yaml",
+		"listeners/./lds.yaml":      "listeners/lds.yaml",
+		"..data":                    "..data",
+		"a..b/c":                    "a..b/c",
+		"newer/rds.yaml":            "newer/rds.yaml",
+		"listeners/current/lds.yml": "listeners/current/lds.yml",
+	}
+	for p, expected := range valid {
+		actual, err := cleanRelPath(p)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", p, err)
+			continue
+		}
+		if actual != expected {
+			t.Errorf("%q: expected %q, got %q", p, expected, actual)
+		}
+	}
+
+	for _, p := range []string{
+		"",
+		".",
+		"./",
+		"..",
+		"../rds.yaml",
+		"listeners/../../rds.yaml",
+		"listeners/../rds.yaml",
+		"/etc/passwd",
+		"\\etc\\passwd",
+		"..\\rds.yaml",
+		"rds\x00.yaml",
+		"new",
+		"new/rds.yaml",
+		"current",
+		"./current/rds.yaml",
+	} {
+		if _, err := cleanRelPath(p); err == nil {
+			t.Errorf("%q: expected an error", p)
+		}
+	}
+}
+
+func TestSafePath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crossover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	root := filepath.Join(dir, "current")
+	outside := filepath.Join(dir, "outside")
+	for _, d := range []string{root, outside, filepath.Join(root, "listeners")} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	symlinks := map[string]string{
+		// Symlinks within the root are fine
+		filepath.Join(root, "inside"): filepath.Join(root, "listeners"),
+		filepath.Join(root, "rel"):    "listeners",
+		// Symlinks out of the root are not
+		filepath.Join(root, "escape"):      outside,
+		filepath.Join(root, "escape.yaml"): filepath.Join(outside, "rds.yaml"),
+		filepath.Join(root, "dotdot"):      "..",
+		filepath.Join(root, "dangling"):    filepath.Join(outside, "missing"),
+	}
+	for link, target := range symlinks {
+		if err := os.Symlink(target, link); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, p := range []string{"rds.yaml", "listeners/lds.yaml", "inside/lds.yaml", "rel/lds.yaml", "missing/dir/lds.yaml"} {
+		actual, err := safePath(root, p)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", p, err)
+			continue
+		}
+		if expected := filepath.Join(root, filepath.FromSlash(p)); actual != expected {
+			t.Errorf("%q: expected %q, got %q", p, expected, actual)
+		}
+	}
+
+	for _, p := range []string{"escape/rds.yaml", "escape.yaml", "dotdot/rds.yaml", "dangling", "../outside/rds.yaml", "/etc/passwd"} {
+		if _, err := safePath(root, p); err == nil {
+			t.Errorf("%q: expected an error", p)
+		}
+	}
+
+	// The root itself can be a symlink, like a mounted volume
+	linkedRoot := filepath.Join(dir, "linked")
+	if err := os.Symlink(root, linkedRoot); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := safePath(linkedRoot, "inside/lds.yaml"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := safePath(linkedRoot, "escape/rds.yaml"); err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+func TestWriterRejectsSymlinksOutOfOutputDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crossover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	outputDir := filepath.Join(dir, "output")
+	outside := filepath.Join(dir, "outside")
+	for _, d := range []string{filepath.Join(outputDir, "new"), outside} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(filepath.Join(outside, "rds.yaml"), filepath.Join(outputDir, "new", "rds.yaml")); err != nil {
+		t.Fatal(err)
+	}
+
+	cm := ConfigMap{Data: map[string]string{"rds.yaml": "resources: []\n"}}
+	if err := newWriter(outputDir, nil).write(configMapSource("default", "envoy-xds"), cm); err == nil {
+		t.Errorf("expected an error")
+	}
+	if _, err := os.Stat(filepath.Join(outside, "rds.yaml")); !os.IsNotExist(err) {
+		t.Errorf("expected nothing to be written out of the output dir: %v", err)
+	}
+}
@@ -0,0 +1,192 @@
+package reconciler
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/mumoshu/crossover/pkg/kubeclient"
+	"gopkg.in/yaml.v3"
+)
+
+// configTemplateData is the data available to templates in configmap data
+type configTemplateData struct {
+	// PodName is the name of the pod crossover runs in, read from the POD_NAME environment variable
+	PodName string
+	// PodNamespace is the namespace of the pod crossover runs in, read from the POD_NAMESPACE environment variable
+	PodNamespace string
+	// Name is the name of the configmap
+	Name string
+	// Namespace is the namespace of the configmap
+	Namespace string
+}
+
+// renderer renders configmap data as Go templates
+type renderer struct {
+	configMaps kubeclient.ReadOnlyClient
+	namespace  string
+	getenv     func(string) string
+	// allowedEnv are the environment variables readable via `env` in addition to POD_NAME and POD_NAMESPACE.
+	// Anything else is hidden from templates, as anyone able to edit a configmap could otherwise copy e.g. secrets
+	// injected as environment variables of crossover into Envoy configs
+	allowedEnv []string
+}
+
+// renderEnabled returns true if the configmap opts in to the templating
+func renderEnabled(cm ConfigMap) (bool, error) {
+	switch v := cm.ObjectMeta.Annotations[AnnotationRenderTemplates]; v {
+	case "", "false":
+		return false, nil
+	case "true":
+		return true, nil
+	default:
+		return false, fmt.Errorf("invalid value for annotation %s: %q", AnnotationRenderTemplates, v)
+	}
+}
+
+// RenderConfigMap returns the configmap with its data rendered as Go templates when it opts in to the templating,
+// like crossover does before writing files. Templates read configmaps in the namespace from configMaps via
+// `configMapValue`, and the environment variables in templateEnv via `env` besides POD_NAME and POD_NAMESPACE.
+func RenderConfigMap(cm ConfigMap, configMaps kubeclient.ReadOnlyClient, namespace string, templateEnv []string) (ConfigMap, error) {
+	render, err := renderEnabled(cm)
+	if err != nil || !render {
+		return cm, err
+	}
+	r := &renderer{configMaps: configMaps, namespace: namespace, getenv: os.Getenv, allowedEnv: templateEnv}
+	data, err := r.render(cm)
+	if err != nil {
+		return cm, err
+	}
+	cm.Data = data
+	return cm, nil
+}
+
+// render returns the data of the configmap with every value rendered as a Go template.
+// Rendered YAML and JSON files are validated, so that a broken template never reaches Envoy.
+func (r *renderer) render(cm ConfigMap) (map[string]string, error) {
+	data := configTemplateData{
+		PodName:      r.getenv("POD_NAME"),
+		PodNamespace: r.getenv("POD_NAMESPACE"),
+		Name:         cm.ObjectMeta.Name,
+		Namespace:    cm.ObjectMeta.Namespace,
+	}
+
+	res := map[string]string{}
+	for file, content := range cm.Data {
+		tmpl, err := template.New(file).Option("missingkey=error").Funcs(r.funcs()).Parse(content)
+		if err != nil {
+			return nil, fmt.Errorf("parsing template %s: %v", file, err)
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return nil, fmt.Errorf("rendering template %s: %v", file, err)
+		}
+		if err := validateConfig(file, buf.String()); err != nil {
+			return nil, fmt.Errorf("validating rendered %s: %v", file, err)
+		}
+		res[file] = buf.String()
+	}
+
+	return res, nil
+}
+
+// env returns the value of the environment variable, or an error if it isn't allowed to be read by templates
+func (r *renderer) env(k string) (string, error) {
+	if k == "POD_NAME" || k == "POD_NAMESPACE" {
+		return r.getenv(k), nil
+	}
+	for _, a := range r.allowedEnv {
+		if a == k {
+			return r.getenv(k), nil
+		}
+	}
+	return "", fmt.Errorf("environment variable %q is not allowed in templates: allow it with --template-env", k)
+}
+
+// funcs returns the functions available to templates.
+// They are limited to string manipulations and reads of allowed environment variables and configmaps in the namespace,
+// so that templates can't touch the filesystem or the network otherwise.
+func (r *renderer) funcs() template.FuncMap {
+	return template.FuncMap{
+		"env": r.env,
+		"configMapValue": func(name, key string) (string, error) {
+			cm := ConfigMap{}
+			if err := r.configMaps.Get(r.namespace, name, &cm); err != nil {
+				return "", fmt.Errorf("getting configmap %s/%s: %v", r.namespace, name, err)
+			}
+			v, ok := cm.Data[key]
+			if !ok {
+				return "", fmt.Errorf("configmap %s/%s has no key %q", r.namespace, name, key)
+			}
+			return v, nil
+		},
+		"default": func(d, v interface{}) interface{} {
+			if v == nil || v == "" {
+				return d
+			}
+			return v
+		},
+		"required": func(msg string, v interface{}) (interface{}, error) {
+			if v == nil || v == "" {
+				return nil, errors.New(msg)
+			}
+			return v, nil
+		},
+		"quote":      func(s string) string { return fmt.Sprintf("%q", s) },
+		"squote":     func(s string) string { return "'" + strings.Replace(s, "'", "''", -1) + "'" },
+		"upper":      strings.ToUpper,
+		"lower":      strings.ToLower,
+		"trim":       strings.TrimSpace,
+		"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+		"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+		"replace":    func(old, new, s string) string { return strings.Replace(s, old, new, -1) },
+		"contains":   func(substr, s string) bool { return strings.Contains(s, substr) },
+		"hasPrefix":  func(prefix, s string) bool { return strings.HasPrefix(s, prefix) },
+		"hasSuffix":  func(suffix, s string) bool { return strings.HasSuffix(s, suffix) },
+		"split":      func(sep, s string) []string { return strings.Split(s, sep) },
+		"join": func(sep string, l []string) string {
+			return strings.Join(l, sep)
+		},
+		"indent": indent,
+		"nindent": func(n int, s string) string {
+			return "\n" + indent(n, s)
+		},
+		"b64enc": func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) },
+		"b64dec": func(s string) (string, error) {
+			bs, err := base64.StdEncoding.DecodeString(s)
+			return string(bs), err
+		},
+		"toJson": func(v interface{}) (string, error) {
+			bs, err := json.Marshal(v)
+			return string(bs), err
+		},
+		"toYaml": func(v interface{}) (string, error) {
+			bs, err := yaml.Marshal(v)
+			return strings.TrimSuffix(string(bs), "\n"), err
+		},
+	}
+}
+
+func indent(n int, s string) string {
+	pad := strings.Repeat(" ", n)
+	return pad + strings.Replace(s, "\n", "\n"+pad, -1)
+}
+
+// validateConfig returns an error if the content of the YAML or JSON file can't be parsed
+func validateConfig(file, content string) error {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".json":
+		var v interface{}
+		return json.Unmarshal([]byte(content), &v)
+	case ".yaml", ".yml":
+		var v interface{}
+		return yaml.Unmarshal([]byte(content), &v)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package reconciler
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRender(t *testing.T) {
+	configMaps := newMemClient()
+	configMaps.put("default", "envoy-env", ConfigMap{
+		ObjectMeta: ObjectMeta{Name: "envoy-env", Namespace: "default"},
+		Data:       map[string]string{"backend": "podinfo.production.svc.cluster.local"},
+	})
+
+	env := map[string]string{"POD_NAME": "envoy-abc", "POD_NAMESPACE": "default", "PORT": "9898", "AWS_SECRET_ACCESS_KEY": "secret"}
+	r := &renderer{
+		configMaps: configMaps,
+		namespace:  "default",
+		getenv:     func(k string) string { return env[k] },
+		allowedEnv: []string{"PORT", "TIMEOUT"},
+	}
+
+	cm := ConfigMap{
+		ObjectMeta: ObjectMeta{Name: "envoy-xds", Namespace: "default"},
+		Data: map[string]string{
+			"cds.yaml": `resources:
+- name: {{ .Name }}-{{ .PodName }}
+  address: {{ configMapValue "envoy-env" "backend" | quote }}
+  port: {{ env "PORT" | default "80" }}
+  timeout: {{ env "TIMEOUT" | default "1s" }}
+`,
+		},
+	}
+
+	actual, err := r.render(cm)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := map[string]string{
+		"cds.yaml": `resources:
+- name: envoy-xds-envoy-abc
+  address: "podinfo.production.svc.cluster.local"
+  port: 9898
+  timeout: 1s
+`,
+	}
+	if diff := cmp.Diff(expected, actual); diff != "" {
+		t.Errorf(diff)
+	}
+
+	for tmpl, msg := range map[string]string{
+		`{{ configMapValue "envoy-env" "missing" }}`: `has no key "missing"`,
+		`{{ configMapValue "missing" "backend" }}`:   "getting configmap default/missing",
+		`{{ .Unknown }}`: "can't evaluate field Unknown",
+		`{{ env "TIMEOUT" | required "TIMEOUT is required" }}`: "TIMEOUT is required",
+		"foo: [":                            "validating rendered cds.yaml",
+		`{{ readFile "x" }}`:                `function "readFile" not defined`,
+		`{{ env "AWS_SECRET_ACCESS_KEY" }}`: `environment variable "AWS_SECRET_ACCESS_KEY" is not allowed`,
+	} {
+		_, err := r.render(ConfigMap{Data: map[string]string{"cds.yaml": tmpl}})
+		if err == nil || !strings.Contains(err.Error(), msg) {
+			t.Errorf("%s: expected error containing %q, got %v", tmpl, msg, err)
+		}
+	}
+}
+
+func TestRenderEnabled(t *testing.T) {
+	for v, expected := range map[string]bool{"": false, "false": false, "true": true} {
+		actual, err := renderEnabled(ConfigMap{ObjectMeta: ObjectMeta{Annotations: map[string]string{AnnotationRenderTemplates: v}}})
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", v, err)
+		}
+		if actual != expected {
+			t.Errorf("%q: expected %v, got %v", v, expected, actual)
+		}
+	}
+
+	if _, err := renderEnabled(ConfigMap{ObjectMeta: ObjectMeta{Annotations: map[string]string{AnnotationRenderTemplates: "yes"}}}); err == nil {
+		t.Errorf("expected an error for the invalid annotation")
+	}
+}
@@ -0,0 +1,265 @@
+package reconciler
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mumoshu/crossover/pkg/kubeclient"
+	"github.com/mumoshu/crossover/pkg/types"
+)
+
+// RolloutReconciler translates the canary weights published by Argo Rollouts into stable/canary cluster weights,
+// so that Argo Rollouts works without going through SMI TrafficSplits.
+type RolloutReconciler struct {
+	Rollouts          kubeclient.ReadOnlyClient
+	ConfigMaps        kubeclient.Client
+	Namespace         string
+	RolloutsToConfigs map[string]string
+
+	// mu serializes the updates of generated configmaps, as rollouts and template configmaps are reconciled by
+	// separate controllers
+	mu sync.Mutex
+}
+
+// Reconcile merges all the rollouts that target the same template configmap as the named rollout at once
+func (r *RolloutReconciler) Reconcile(name string) error {
+	tplCmName, ok := r.RolloutsToConfigs[name]
+	if !ok {
+		panic(fmt.Sprintf("detected misconfiguration: no configmap name defined for rollout named %q", name))
+	}
+
+	return r.ReconcileConfigMap(tplCmName)
+}
+
+// ReconcileConfigMap merges all the rollouts that target the named template configmap at once.
+// It is called when the template configmap is updated, as its annotations can set the canary weights.
+func (r *RolloutReconciler) ReconcileConfigMap(tplCmName string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	tplCm := ConfigMap{}
+	if err := r.ConfigMaps.Get(r.Namespace, tplCmName, &tplCm); err != nil {
+		if err == types.ErrNotExist {
+			log.Printf("Could not find template ConfigMap %q. Please create it: %v", tplCmName, err)
+			return nil
+		}
+		return err
+	}
+
+	var tss []TrafficSplit
+	for _, n := range namesForConfig(r.RolloutsToConfigs, tplCmName) {
+		rollout := Rollout{}
+		err := r.Rollouts.Get(r.Namespace, n, &rollout)
+		if err != nil {
+			if err == types.ErrNotExist {
+				log.Printf("Rollout %s/%s not found. Skipping reconcilation. This will be retried soon", r.Namespace, n)
+				continue
+			}
+			log.Printf("Unexpected error while getting Rollout %s/%s: %v", r.Namespace, n, err)
+			return err
+		}
+
+		canaryWeight, ok, err := annotatedCanaryWeight(tplCm, n)
+		if err != nil {
+			log.Printf("Skipping rollout %s/%s: %v", r.Namespace, n, err)
+			continue
+		}
+		if !ok {
+			canaryWeight = rollout.CanaryWeight()
+		}
+
+		ts, err := rollout.trafficSplit(canaryWeight)
+		if err != nil {
+			log.Printf("Skipping rollout %s/%s: %v", r.Namespace, n, err)
+			continue
+		}
+
+		log.Printf("Reconciling rollout %s/%s: %+v", r.Namespace, n, ts.Spec.Backends)
+
+		tss = append(tss, ts)
+	}
+
+	if len(tss) == 0 {
+		return nil
+	}
+
+	return applyTrafficSplits(r.ConfigMaps, r.Namespace, tplCmName, tss...)
+}
+
+// annotatedCanaryWeight returns the canary weight of the rollout set by the annotation on the template configmap,
+// and false when it's not annotated
+func annotatedCanaryWeight(tplCm ConfigMap, rollout string) (int, bool, error) {
+	key := AnnotationCanaryWeightPrefix + rollout
+	v, ok := tplCm.ObjectMeta.Annotations[key]
+	if !ok {
+		return 0, false, nil
+	}
+	w, err := strconv.Atoi(strings.TrimSpace(v))
+	if err != nil || w < 0 || w > 100 {
+		return 0, false, fmt.Errorf("invalid annotation %s: %q is not a percentage from 0 to 100", key, v)
+	}
+	return w, true, nil
+}
+
+// RolloutConfigMapReconciler reconciles the rollouts targeting the template configmaps it is given the names of,
+// so that changes to the canary weight annotations are applied without waiting for the rollouts to change.
+type RolloutConfigMapReconciler struct {
+	Rollouts *RolloutReconciler
+}
+
+func (r *RolloutConfigMapReconciler) Reconcile(tplCmName string) error {
+	log.Printf("Reconciling rollouts of configmap %s", tplCmName)
+	return r.Rollouts.ReconcileConfigMap(tplCmName)
+}
+
+// Rollout is the subset of Argo Rollouts' Rollout resource that is needed to compute traffic weights.
+// See https://argoproj.github.io/argo-rollouts/features/specification/
+type Rollout struct {
+	ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   RolloutSpec   `json:"spec,omitempty"`
+	Status RolloutStatus `json:"status,omitempty"`
+}
+
+type RolloutSpec struct {
+	Strategy RolloutStrategy `json:"strategy,omitempty"`
+}
+
+type RolloutStrategy struct {
+	Canary *RolloutCanaryStrategy `json:"canary,omitempty"`
+}
+
+type RolloutCanaryStrategy struct {
+	CanaryService  string                 `json:"canaryService,omitempty"`
+	StableService  string                 `json:"stableService,omitempty"`
+	TrafficRouting *RolloutTrafficRouting `json:"trafficRouting,omitempty"`
+	Steps          []RolloutCanaryStep    `json:"steps,omitempty"`
+}
+
+type RolloutTrafficRouting struct {
+	SMI *RolloutSMITrafficRouting `json:"smi,omitempty"`
+}
+
+type RolloutSMITrafficRouting struct {
+	RootService string `json:"rootService,omitempty"`
+}
+
+type RolloutCanaryStep struct {
+	SetWeight *int `json:"setWeight,omitempty"`
+}
+
+type RolloutStatus struct {
+	CurrentPodHash   string              `json:"currentPodHash,omitempty"`
+	StableRS         string              `json:"stableRS,omitempty"`
+	CurrentStepIndex *int                `json:"currentStepIndex,omitempty"`
+	Abort            bool                `json:"abort,omitempty"`
+	PromoteFull      bool                `json:"promoteFull,omitempty"`
+	Canary           RolloutCanaryStatus `json:"canary,omitempty"`
+}
+
+type RolloutCanaryStatus struct {
+	Weights *RolloutTrafficWeights `json:"weights,omitempty"`
+}
+
+// RolloutTrafficWeights is the weights Argo Rollouts v1.1 or greater publishes for traffic routers
+type RolloutTrafficWeights struct {
+	Canary RolloutWeightDestination `json:"canary"`
+	Stable RolloutWeightDestination `json:"stable"`
+}
+
+type RolloutWeightDestination struct {
+	ServiceName string `json:"serviceName,omitempty"`
+	Weight      int    `json:"weight"`
+}
+
+// RootService returns the name of the service that clients use to connect to the application.
+// It is the SMI root service if configured, or the stable service otherwise.
+func (r Rollout) RootService() string {
+	c := r.Spec.Strategy.Canary
+	if c.TrafficRouting != nil && c.TrafficRouting.SMI != nil && c.TrafficRouting.SMI.RootService != "" {
+		return c.TrafficRouting.SMI.RootService
+	}
+	return c.StableService
+}
+
+// CanaryWeight returns the percentage of traffic to be routed to the canary service.
+// It prefers the weights published in the rollout status, and falls back to computing it from the canary steps
+// for Argo Rollouts versions that do not publish weights.
+func (r Rollout) CanaryWeight() int {
+	if w := r.Status.Canary.Weights; w != nil {
+		return w.Canary.Weight
+	}
+
+	if r.Status.Abort || r.Status.StableRS == r.Status.CurrentPodHash {
+		return 0
+	}
+
+	if r.Status.PromoteFull {
+		return 100
+	}
+
+	// Like Argo's GetCurrentSetWeight, the weight is the one set by the current step or the closest step before it,
+	// and the canary gets all the traffic once all the steps are completed
+	steps := r.Spec.Strategy.Canary.Steps
+	current := 0
+	if r.Status.CurrentStepIndex != nil {
+		current = *r.Status.CurrentStepIndex
+	}
+	if current >= len(steps) {
+		return 100
+	}
+	for i := current; i >= 0; i-- {
+		if steps[i].SetWeight != nil {
+			return *steps[i].SetWeight
+		}
+	}
+	return 0
+}
+
+// TrafficSplit returns the TrafficSplit equivalent to the current state of the rollout,
+// using Argo's canaryService and stableService as the backends.
+func (r Rollout) TrafficSplit() (TrafficSplit, error) {
+	return r.trafficSplit(r.CanaryWeight())
+}
+
+// trafficSplit returns the TrafficSplit that routes canaryWeight percent of the traffic to the canary service
+func (r Rollout) trafficSplit(canaryWeight int) (TrafficSplit, error) {
+	c := r.Spec.Strategy.Canary
+	if c == nil {
+		return TrafficSplit{}, fmt.Errorf("rollout has no canary strategy")
+	}
+
+	canarySvc, stableSvc := c.CanaryService, c.StableService
+	if w := r.Status.Canary.Weights; w != nil {
+		if w.Canary.ServiceName != "" {
+			canarySvc = w.Canary.ServiceName
+		}
+		if w.Stable.ServiceName != "" {
+			stableSvc = w.Stable.ServiceName
+		}
+	}
+
+	if canarySvc == "" || stableSvc == "" {
+		return TrafficSplit{}, fmt.Errorf("both canaryService and stableService must be set in the canary strategy")
+	}
+
+	if canaryWeight < 0 {
+		canaryWeight = 0
+	} else if canaryWeight > 100 {
+		canaryWeight = 100
+	}
+
+	return TrafficSplit{
+		ObjectMeta: r.ObjectMeta,
+		Spec: TrafficSplitSpec{
+			Service: r.RootService(),
+			Backends: []TrafficSplitBackend{
+				{Service: stableSvc, Weight: 100 - canaryWeight},
+				{Service: canarySvc, Weight: canaryWeight},
+			},
+		},
+	}, nil
+}
@@ -0,0 +1,229 @@
+package reconciler
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRolloutTrafficSplit(t *testing.T) {
+	intp := func(i int) *int { return &i }
+
+	steps := []RolloutCanaryStep{
+		{SetWeight: intp(20)},
+		{},
+		{SetWeight: intp(40)},
+		{},
+	}
+
+	testcases := []struct {
+		rollout         Rollout
+		expectedService string
+		expected        []TrafficSplitBackend
+	}{
+		{
+			rollout: Rollout{
+				Spec: RolloutSpec{Strategy: RolloutStrategy{Canary: &RolloutCanaryStrategy{
+					CanaryService: "podinfo-canary",
+					StableService: "podinfo-stable",
+					TrafficRouting: &RolloutTrafficRouting{
+						SMI: &RolloutSMITrafficRouting{RootService: "podinfo"},
+					},
+				}}},
+				Status: RolloutStatus{Canary: RolloutCanaryStatus{Weights: &RolloutTrafficWeights{
+					Canary: RolloutWeightDestination{ServiceName: "podinfo-canary", Weight: 25},
+					Stable: RolloutWeightDestination{ServiceName: "podinfo-stable", Weight: 75},
+				}}},
+			},
+			expectedService: "podinfo",
+			expected: []TrafficSplitBackend{
+				{Service: "podinfo-stable", Weight: 75},
+				{Service: "podinfo-canary", Weight: 25},
+			},
+		},
+		{
+			rollout: Rollout{
+				Spec: RolloutSpec{Strategy: RolloutStrategy{Canary: &RolloutCanaryStrategy{
+					CanaryService: "podinfo-canary",
+					StableService: "podinfo-stable",
+					Steps:         steps,
+				}}},
+				Status: RolloutStatus{CurrentPodHash: "b", StableRS: "a", CurrentStepIndex: intp(3)},
+			},
+			expectedService: "podinfo-stable",
+			expected: []TrafficSplitBackend{
+				{Service: "podinfo-stable", Weight: 60},
+				{Service: "podinfo-canary", Weight: 40},
+			},
+		},
+		{
+			rollout: Rollout{
+				Spec: RolloutSpec{Strategy: RolloutStrategy{Canary: &RolloutCanaryStrategy{
+					CanaryService: "podinfo-canary",
+					StableService: "podinfo-stable",
+					Steps:         steps,
+				}}},
+				Status: RolloutStatus{CurrentPodHash: "b", StableRS: "a", CurrentStepIndex: intp(0)},
+			},
+			expectedService: "podinfo-stable",
+			expected: []TrafficSplitBackend{
+				{Service: "podinfo-stable", Weight: 80},
+				{Service: "podinfo-canary", Weight: 20},
+			},
+		},
+		{
+			rollout: Rollout{
+				Spec: RolloutSpec{Strategy: RolloutStrategy{Canary: &RolloutCanaryStrategy{
+					CanaryService: "podinfo-canary",
+					StableService: "podinfo-stable",
+					Steps:         steps,
+				}}},
+				Status: RolloutStatus{CurrentPodHash: "b", StableRS: "a", CurrentStepIndex: intp(2)},
+			},
+			expectedService: "podinfo-stable",
+			expected: []TrafficSplitBackend{
+				{Service: "podinfo-stable", Weight: 60},
+				{Service: "podinfo-canary", Weight: 40},
+			},
+		},
+		{
+			rollout: Rollout{
+				Spec: RolloutSpec{Strategy: RolloutStrategy{Canary: &RolloutCanaryStrategy{
+					CanaryService: "podinfo-canary",
+					StableService: "podinfo-stable",
+					Steps:         steps,
+				}}},
+				Status: RolloutStatus{CurrentPodHash: "b", StableRS: "a", CurrentStepIndex: intp(4)},
+			},
+			expectedService: "podinfo-stable",
+			expected: []TrafficSplitBackend{
+				{Service: "podinfo-stable", Weight: 0},
+				{Service: "podinfo-canary", Weight: 100},
+			},
+		},
+		{
+			rollout: Rollout{
+				Spec: RolloutSpec{Strategy: RolloutStrategy{Canary: &RolloutCanaryStrategy{
+					CanaryService: "podinfo-canary",
+					StableService: "podinfo-stable",
+					Steps:         steps,
+				}}},
+				Status: RolloutStatus{CurrentPodHash: "b", StableRS: "b", CurrentStepIndex: intp(4)},
+			},
+			expectedService: "podinfo-stable",
+			expected: []TrafficSplitBackend{
+				{Service: "podinfo-stable", Weight: 100},
+				{Service: "podinfo-canary", Weight: 0},
+			},
+		},
+	}
+
+	for i, tc := range testcases {
+		ts, err := tc.rollout.TrafficSplit()
+		if err != nil {
+			t.Fatalf("case %d: unexpected error: %v", i, err)
+		}
+		if ts.Spec.Service != tc.expectedService {
+			t.Errorf("case %d: unexpected service: expected %q, got %q", i, tc.expectedService, ts.Spec.Service)
+		}
+		if diff := cmp.Diff(tc.expected, ts.Spec.Backends); diff != "" {
+			t.Errorf("case %d: unexpected backends: %s", i, diff)
+		}
+	}
+}
+
+func TestRolloutReconcilerCanaryWeightAnnotation(t *testing.T) {
+	const rds = `resources:
+- name: local_route
+  virtual_hosts:
+  - name: podinfo
+    routes:
+    - route:
+        weighted_clusters:
+          clusters:
+          - name: podinfo-stable
+            weight: 100
+          - name: podinfo-canary
+            weight: 0
+`
+	configMaps := newMemClient()
+	putTemplate := func(annotations map[string]string) {
+		configMaps.put("default", "envoy-xds", ConfigMap{
+			ObjectMeta: ObjectMeta{Name: "envoy-xds", Namespace: "default", Annotations: annotations},
+			Data:       map[string]string{"rds.yaml": rds},
+		})
+	}
+
+	rollouts := newMemClient()
+	rollouts.put("default", "podinfo", Rollout{
+		ObjectMeta: ObjectMeta{Name: "podinfo", Namespace: "default"},
+		Spec: RolloutSpec{Strategy: RolloutStrategy{Canary: &RolloutCanaryStrategy{
+			CanaryService: "podinfo-canary",
+			StableService: "podinfo-stable",
+			TrafficRouting: &RolloutTrafficRouting{
+				SMI: &RolloutSMITrafficRouting{RootService: "podinfo"},
+			},
+		}}},
+		Status: RolloutStatus{Canary: RolloutCanaryStatus{Weights: &RolloutTrafficWeights{
+			Canary: RolloutWeightDestination{Weight: 10},
+			Stable: RolloutWeightDestination{Weight: 90},
+		}}},
+	})
+
+	r := &RolloutReconciler{
+		Rollouts:          rollouts,
+		ConfigMaps:        configMaps,
+		Namespace:         "default",
+		RolloutsToConfigs: map[string]string{"podinfo": "envoy-xds"},
+	}
+	cr := &RolloutConfigMapReconciler{Rollouts: r}
+
+	testcases := []struct {
+		annotations map[string]string
+		reconcile   func() error
+		expected    string
+	}{
+		{
+			// The weight of the rollout status is used without the annotation
+			reconcile: func() error { return r.Reconcile("podinfo") },
+			expected:  "weight: 90",
+		},
+		{
+			annotations: map[string]string{AnnotationCanaryWeightPrefix + "podinfo": "25"},
+			reconcile:   func() error { return cr.Reconcile("envoy-xds") },
+			expected:    "weight: 75",
+		},
+		{
+			annotations: map[string]string{AnnotationCanaryWeightPrefix + "podinfo": "100"},
+			reconcile:   func() error { return r.Reconcile("podinfo") },
+			expected:    "weight: 0",
+		},
+		{
+			// Invalid weights are skipped, leaving the generated configmap as is
+			annotations: map[string]string{AnnotationCanaryWeightPrefix + "podinfo": "150"},
+			reconcile:   func() error { return cr.Reconcile("envoy-xds") },
+			expected:    "weight: 0",
+		},
+	}
+
+	for i, tc := range testcases {
+		putTemplate(tc.annotations)
+		if err := tc.reconcile(); err != nil {
+			t.Fatalf("case %d: unexpected error: %v", i, err)
+		}
+
+		gen := ConfigMap{}
+		if err := configMaps.Get("default", "envoy-xds-gen", &gen); err != nil {
+			t.Fatalf("case %d: unexpected error: %v", i, err)
+		}
+		stable := strings.SplitN(strings.SplitN(gen.Data["rds.yaml"], "- name: podinfo-stable\n", 2)[1], "\n", 2)[0]
+		if strings.TrimSpace(stable) != tc.expected {
+			t.Errorf("case %d: unexpected weight of the stable cluster: %s", i, gen.Data["rds.yaml"])
+		}
+	}
+
+	if _, _, err := annotatedCanaryWeight(ConfigMap{ObjectMeta: ObjectMeta{Annotations: map[string]string{AnnotationCanaryWeightPrefix + "podinfo": "x"}}}, "podinfo"); err == nil {
+		t.Errorf("expected error for the weight that isn't a number")
+	}
+}
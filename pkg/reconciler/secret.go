@@ -0,0 +1,116 @@
+package reconciler
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/mumoshu/crossover/pkg/kubeclient"
+	"github.com/mumoshu/crossover/pkg/types"
+)
+
+const (
+	// SecretTypeTLS is the type of secrets that hold a TLS certificate and its key, like the ones cert-manager issues
+	SecretTypeTLS = "kubernetes.io/tls"
+
+	secretTypeURL = "type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.Secret"
+
+	tlsCertKey = "tls.crt"
+	tlsKeyKey  = "tls.key"
+	caCertKey  = "ca.crt"
+)
+
+// Secret is the subset of Kubernetes Secret that is needed to serve TLS certificates via SDS.
+// Values of Data are base64-decoded by encoding/json.
+type Secret struct {
+	ObjectMeta ObjectMeta        `json:"metadata"`
+	Type       string            `json:"type"`
+	Data       map[string][]byte `json:"data"`
+}
+
+// SecretReconciler writes `kubernetes.io/tls` secrets as SDS DiscoveryResponse files named `sds-<secret name>.yaml`,
+// so that Envoy reloads renewed certificates without restarting.
+type SecretReconciler struct {
+	Client    kubeclient.ReadOnlyClient
+	Namespace string
+	Output
+}
+
+func (s *SecretReconciler) Reconcile(name string) error {
+	log.Printf("Reconciling secret %s", name)
+	secret := Secret{}
+	if err := s.Client.Get(s.Namespace, name, &secret); err != nil {
+		if err == types.ErrNotExist {
+			log.Printf("Secret %s/%s not found. Skipping reconcilation. This will be retried soon", s.Namespace, name)
+			return nil
+		}
+		log.Printf("Unexpected error while getting Secret %s/%s: %v", s.Namespace, name, err)
+		return err
+	}
+
+	conf, err := sdsConfig(secret)
+	if err != nil {
+		log.Printf("Skipping secret %s/%s: %v", s.Namespace, name, err)
+		return nil
+	}
+
+	files := ConfigMap{
+		ObjectMeta: secret.ObjectMeta,
+		Data:       map[string]string{sdsFileName(name): conf},
+	}
+
+	if err := s.output(secretSource(s.Namespace, name), files, newSecretWriter); err != nil {
+		return fmt.Errorf("failed writing secret %s/%s: %v", s.Namespace, name, err)
+	}
+	return nil
+}
+
+func sdsFileName(secretName string) string {
+	return fmt.Sprintf("sds-%s.yaml", secretName)
+}
+
+// sdsConfig returns the SDS DiscoveryResponse for the TLS secret.
+// It contains the `tls_certificate` secret named after the Kubernetes secret, and the `validation_context` secret
+// named `<secret name>-ca` when the Kubernetes secret has `ca.crt`.
+func sdsConfig(secret Secret) (string, error) {
+	if secret.Type != SecretTypeTLS {
+		return "", fmt.Errorf("unsupported secret type %q: only %s is supported", secret.Type, SecretTypeTLS)
+	}
+
+	cert, key := secret.Data[tlsCertKey], secret.Data[tlsKeyKey]
+	if len(cert) == 0 || len(key) == 0 {
+		return "", fmt.Errorf("both %s and %s are required", tlsCertKey, tlsKeyKey)
+	}
+
+	resources := []interface{}{
+		map[string]interface{}{
+			"@type": secretTypeURL,
+			"name":  secret.ObjectMeta.Name,
+			"tls_certificate": map[string]interface{}{
+				"certificate_chain": map[string]interface{}{"inline_string": string(cert)},
+				"private_key":       map[string]interface{}{"inline_string": string(key)},
+			},
+		},
+	}
+
+	if ca := secret.Data[caCertKey]; len(ca) > 0 {
+		resources = append(resources, map[string]interface{}{
+			"@type": secretTypeURL,
+			"name":  secret.ObjectMeta.Name + "-ca",
+			"validation_context": map[string]interface{}{
+				"trusted_ca": map[string]interface{}{"inline_string": string(ca)},
+			},
+		})
+	}
+
+	versionInfo := secret.ObjectMeta.ResourceVersion
+	if versionInfo == "" {
+		versionInfo = "0"
+	}
+
+	return encodeYAML(discoveryResponse{VersionInfo: versionInfo, Resources: resources})
+}
+
+type discoveryResponse struct {
+	VersionInfo string        `yaml:"version_info"`
+	Resources   []interface{} `yaml:"resources"`
+}
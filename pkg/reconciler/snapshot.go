@@ -0,0 +1,57 @@
+package reconciler
+
+import (
+	"fmt"
+	"log"
+)
+
+// SnapshotStore receives the files crossover writes, so that they can be served to Envoy over the network as well
+type SnapshotStore interface {
+	// Update replaces the files previously given for the source, like a configmap.
+	// Non-empty serviceNode and serviceCluster restrict the files to Envoys with the node ID and the cluster.
+	Update(source, serviceNode, serviceCluster string, files map[string]string) error
+}
+
+// updateSnapshot gives the data of the configmap to the store, if any.
+// While the source is pinned to a snapshot in the output directory, the files of the snapshot are given instead.
+// A file the store fails to read is logged, so that writing files to the output directory is unaffected.
+func updateSnapshot(store SnapshotStore, dir, source string, cm ConfigMap) {
+	if store == nil {
+		return
+	}
+	data := cm.Data
+	if pinned, err := PinnedSnapshot(dir, source); err != nil {
+		log.Printf("Skipping snapshot update of %s: %v", source, err)
+		return
+	} else if pinned != "" {
+		_, files, err := SnapshotFiles(dir, pinned)
+		if err != nil {
+			log.Printf("Skipping snapshot update of %s: reading pinned snapshot: %v", source, err)
+			return
+		}
+		log.Printf("Serving pinned snapshot %s of %s", pinned, source)
+		data = map[string]string{}
+		for p, content := range files {
+			data[p] = string(content)
+		}
+	}
+	annotations := cm.ObjectMeta.Annotations
+	if err := store.Update(source, annotations[AnnotationServiceNode], annotations[AnnotationServiceCluster], data); err != nil {
+		log.Printf("Skipping snapshot update of %s: %v", source, err)
+	}
+}
+
+// Sources are keyed by kinds as well as namespaces and names, as e.g. a configmap and the endpoints of a service can
+// have the same name
+
+func configMapSource(namespace, name string) string {
+	return fmt.Sprintf("configmaps/%s/%s", namespace, name)
+}
+
+func secretSource(namespace, name string) string {
+	return fmt.Sprintf("secrets/%s/%s", namespace, name)
+}
+
+func endpointsSource(namespace, name string) string {
+	return fmt.Sprintf("endpoints/%s/%s", namespace, name)
+}
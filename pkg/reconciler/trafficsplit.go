@@ -18,7 +18,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
-	"strconv"
+	"sort"
+	"strings"
 
 	"github.com/mumoshu/crossover/pkg/kubeclient"
 	"github.com/mumoshu/crossover/pkg/types"
@@ -32,43 +33,67 @@ type TrafficSplitReconciler struct {
 	TsToConfigs   map[string]string
 }
 
+// Reconcile merges all the trafficsplits that target the same template configmap as the named trafficsplit at once,
+// so that they don't overwrite each other's weights in the generated configmap.
 func (r *TrafficSplitReconciler) Reconcile(name string) error {
-	ts := TrafficSplit{}
-	err := r.TrafficSplits.Get(r.Namespace, name, &ts)
-	if err != nil {
-		if err == types.ErrNotExist {
-			log.Printf("Trafficsplit %s/%s not found. Skipping reconcilation. This will be retried soon", r.Namespace, name)
-			return nil
+	tplCmName, ok := r.TsToConfigs[name]
+	if !ok {
+		panic(fmt.Sprintf("detected misconfiguration: no configmap name defined for trafficsplit named %q", name))
+	}
+
+	var tss []TrafficSplit
+	for _, n := range namesForConfig(r.TsToConfigs, tplCmName) {
+		ts := TrafficSplit{}
+		err := r.TrafficSplits.Get(r.Namespace, n, &ts)
+		if err != nil {
+			if err == types.ErrNotExist {
+				log.Printf("Trafficsplit %s/%s not found. Skipping reconcilation. This will be retried soon", r.Namespace, n)
+				continue
+			}
+			log.Printf("Unexpected error while getting Trafficsplit %s/%s: %v", r.Namespace, n, err)
+			return err
 		}
-		log.Printf("Unexpected error while getting Trafficsplit %s/%s: %v", r.Namespace, name, err)
-		return err
+
+		specYaml := bytes.Buffer{}
+		enc := yaml.NewEncoder(&specYaml)
+		enc.SetIndent(2)
+		if err := enc.Encode(ts.Spec); err != nil {
+			return err
+		}
+		log.Printf("Reconciling trafficsplit %s/%s:\n%s", r.Namespace, n, specYaml.String())
+
+		tss = append(tss, ts)
 	}
 
-	specYaml := bytes.Buffer{}
-	enc := yaml.NewEncoder(&specYaml)
-	enc.SetIndent(2)
-	if err := enc.Encode(ts.Spec); err != nil {
-		return err
+	if len(tss) == 0 {
+		return nil
 	}
-	log.Printf("Reconciling trafficsplit %s/%s:\n%s", r.Namespace, name, specYaml.String())
 
-	svc := ts.Spec.Service
+	// TODO specific this via command-line flag(1. same with the trafficsplit object 2. same with the controller 3. the one specified via annotation 4. the one specified via flag)
+	xdsNs := r.Namespace
+
+	return applyTrafficSplits(r.ConfigMaps, xdsNs, tplCmName, tss...)
+}
 
-	svcToTsBackend := map[string]TrafficSplitBackend{}
-	for _, b := range ts.Spec.Backends {
-		svcToTsBackend[b.Service] = b
+// namesForConfig returns the sorted names of the objects mapped to the template configmap
+func namesForConfig(objsToConfigs map[string]string, tplCmName string) []string {
+	var names []string
+	for n, cm := range objsToConfigs {
+		if cm == tplCmName {
+			names = append(names, n)
+		}
 	}
+	sort.Strings(names)
+	return names
+}
 
+// applyTrafficSplits merges the backend weights of the trafficsplits into the template configmap named tplCmName,
+// and creates or updates the generated configmap named `<tplCmName>-gen` with the result.
+func applyTrafficSplits(configMaps kubeclient.Client, xdsNs, tplCmName string, tss ...TrafficSplit) error {
 	tplCm := ConfigMap{}
-	tplCmName, ok := r.TsToConfigs[name]
-	if !ok {
-		panic(fmt.Sprintf("detected misconfiguration: no configmap name defined for trafficsplit named %q", name))
-	}
 	cmName := fmt.Sprintf("%s-gen", tplCmName)
-	// TODO specific this via command-line flag(1. same with the trafficsplit object 2. same with the controller 3. the one specified via annotation 4. the one specified via flag)
-	xdsNs := r.Namespace
 
-	err = r.ConfigMaps.Get(xdsNs, tplCmName, &tplCm)
+	err := configMaps.Get(xdsNs, tplCmName, &tplCm)
 	if err != nil {
 		if err == types.ErrNotExist {
 			log.Printf("Could not find template ConfigMap %q. Please create it: %v", tplCmName, err)
@@ -78,49 +103,23 @@ func (r *TrafficSplitReconciler) Reconcile(name string) error {
 		}
 	}
 
-	data := map[string]string{}
-DATA:
-	for file, conf := range tplCm.Data {
-		obj := map[string]interface{}{}
-
-		if err := yaml.Unmarshal([]byte(conf), &obj); err != nil {
-			return err
-		}
-
-		found := find(obj, []string{"resources", "*", "virtual_hosts", "name=" + svc, "routes", "*", "route", "weighted_clusters", "clusters"}, func(clusters interface{}) {
-			for name, backend := range svcToTsBackend {
-				find(clusters, []string{"name=" + name}, func(cluster interface{}) {
-					set(cluster, "weight", backend.Weight)
-				})
-			}
-		})
-		if !found {
-			continue DATA
+	for i := range tss {
+		if tss[i].ObjectMeta.Namespace == "" {
+			tss[i].ObjectMeta.Namespace = xdsNs
 		}
-
-		buf := bytes.Buffer{}
-		enc := yaml.NewEncoder(&buf)
-		enc.SetIndent(2)
-		err := enc.Encode(obj)
-		if err != nil {
-			log.Printf("Skipping SMI merge for %s/%s: %v", xdsNs, cmName, err)
-			return nil
-		}
-
-		data[file] = buf.String()
 	}
 
-	tplCm.Data = data
+	gen, err := GenerateConfigMap(tplCm, tss...)
+	if err != nil {
+		log.Printf("Skipping SMI merge for %s/%s: %v", xdsNs, cmName, err)
+		return nil
+	}
 
 	cm := ConfigMap{}
 
-	if err = r.ConfigMaps.Get(xdsNs, cmName, &cm); err != nil {
+	if err = configMaps.Get(xdsNs, cmName, &cm); err != nil {
 		if err == types.ErrNotExist {
-			cm := tplCm
-			delete(cm.ObjectMeta.Annotations, "kubectl.kubernetes.io/last-applied-configuration")
-			cm.ObjectMeta.Name = cmName
-			cm.ObjectMeta.ResourceVersion = ""
-			if err := r.ConfigMaps.Create(xdsNs, cm); err != nil {
+			if err := configMaps.Create(xdsNs, gen); err != nil {
 				return err
 			}
 			return nil
@@ -128,8 +127,53 @@ DATA:
 		return err
 	}
 
-	cm.Data = data
-	return r.ConfigMaps.Replace(xdsNs, cmName, &cm)
+	cm.Data = gen.Data
+	cm.BinaryData = gen.BinaryData
+	syncAnnotations(&cm, tplCm)
+	return configMaps.Replace(xdsNs, cmName, &cm)
+}
+
+// GenerateConfigMap returns the `<name>-gen` configmap made of the template configmap and the trafficsplits merged
+// into it, as it is created in the cluster
+func GenerateConfigMap(tplCm ConfigMap, tss ...TrafficSplit) (ConfigMap, error) {
+	data, err := mergeTrafficSplits(tplCm, tss...)
+	if err != nil {
+		return ConfigMap{}, err
+	}
+
+	gen := tplCm
+	gen.Data = data
+	gen.ObjectMeta.Name = fmt.Sprintf("%s-gen", tplCm.ObjectMeta.Name)
+	gen.ObjectMeta.ResourceVersion = ""
+	gen.ObjectMeta.Annotations = map[string]string{}
+	for k, v := range tplCm.ObjectMeta.Annotations {
+		if k != "kubectl.kubernetes.io/last-applied-configuration" {
+			gen.ObjectMeta.Annotations[k] = v
+		}
+	}
+	if len(gen.ObjectMeta.Annotations) == 0 {
+		gen.ObjectMeta.Annotations = nil
+	}
+
+	return gen, nil
+}
+
+// syncAnnotations copies crossover's annotations of the template configmap to the generated configmap,
+// so that options like file paths for the writer follow changes to the template
+func syncAnnotations(gen *ConfigMap, tpl ConfigMap) {
+	for k := range gen.ObjectMeta.Annotations {
+		if strings.HasPrefix(k, annotationPrefix) {
+			delete(gen.ObjectMeta.Annotations, k)
+		}
+	}
+	for k, v := range tpl.ObjectMeta.Annotations {
+		if strings.HasPrefix(k, annotationPrefix) {
+			if gen.ObjectMeta.Annotations == nil {
+				gen.ObjectMeta.Annotations = map[string]string{}
+			}
+			gen.ObjectMeta.Annotations[k] = v
+		}
+	}
 }
 
 type TrafficSplit struct {
@@ -172,7 +216,9 @@ func (e *TrafficSplitBackend) UnmarshalJSON(data []byte) (err error) {
 			return err
 		}
 		v1alpha2.Service = v1alpha1.Service
-		weight, err := strconv.Atoi(v1alpha1.Weight)
+		// v1alpha1 weights are Kubernetes quantities like `500m`.
+		// They are relative to each other, so it's safe to treat them as integers in milli-units.
+		weight, err := parseQuantityMilli(v1alpha1.Weight)
 		if err != nil {
 			return err
 		}
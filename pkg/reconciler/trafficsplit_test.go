@@ -0,0 +1,158 @@
+package reconciler
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+const multiServiceRDS = `resources:
+- name: local_route
+  virtual_hosts:
+  - name: podinfo
+    routes:
+    - route:
+        weighted_clusters:
+          clusters:
+          - name: podinfo-v1
+            weight: 100
+          - name: podinfo-v2
+            weight: 0
+  - name: frontend
+    routes:
+    - route:
+        weighted_clusters:
+          clusters:
+          - name: frontend-v1
+            weight: 100
+          - name: frontend-v2
+            weight: 0
+`
+
+func TestTrafficSplitReconcilerCombinesTrafficSplits(t *testing.T) {
+	configMaps := newMemClient()
+	configMaps.put("default", "envoy-xds", ConfigMap{
+		ObjectMeta: ObjectMeta{Name: "envoy-xds", Namespace: "default"},
+		Data:       map[string]string{"rds.yaml": multiServiceRDS},
+	})
+
+	trafficSplits := newMemClient()
+	trafficSplits.put("default", "podinfo", TrafficSplit{
+		ObjectMeta: ObjectMeta{Name: "podinfo", Namespace: "default"},
+		Spec: TrafficSplitSpec{Service: "podinfo", Backends: []TrafficSplitBackend{
+			{Service: "podinfo-v1", Weight: 30},
+			{Service: "podinfo-v2", Weight: 70},
+		}},
+	})
+	trafficSplits.put("default", "frontend", TrafficSplit{
+		ObjectMeta: ObjectMeta{Name: "frontend", Namespace: "default"},
+		Spec: TrafficSplitSpec{Service: "frontend", Backends: []TrafficSplitBackend{
+			{Service: "frontend-v1", Weight: 60},
+			{Service: "frontend-v2", Weight: 40},
+		}},
+	})
+
+	r := &TrafficSplitReconciler{
+		TrafficSplits: trafficSplits,
+		ConfigMaps:    configMaps,
+		Namespace:     "default",
+		TsToConfigs: map[string]string{
+			"podinfo":  "envoy-xds",
+			"frontend": "envoy-xds",
+			// not found trafficsplits are skipped
+			"missing": "envoy-xds",
+		},
+	}
+
+	expected := `resources:
+- name: local_route
+  virtual_hosts:
+  - name: podinfo
+    routes:
+    - route:
+        weighted_clusters:
+          clusters:
+          - name: podinfo-v1
+            weight: 30
+          - name: podinfo-v2
+            weight: 70
+  - name: frontend
+    routes:
+    - route:
+        weighted_clusters:
+          clusters:
+          - name: frontend-v1
+            weight: 60
+          - name: frontend-v2
+            weight: 40
+`
+
+	// Reconciling either trafficsplit results in the same generated configmap
+	for _, name := range []string{"podinfo", "frontend"} {
+		if err := r.Reconcile(name); err != nil {
+			t.Fatalf("%s: unexpected error: %v", name, err)
+		}
+
+		gen := ConfigMap{}
+		if err := configMaps.Get("default", "envoy-xds-gen", &gen); err != nil {
+			t.Fatalf("%s: unexpected error: %v", name, err)
+		}
+
+		if diff := cmp.Diff(expected, gen.Data["rds.yaml"]); diff != "" {
+			t.Errorf("%s: %s", name, diff)
+		}
+	}
+}
+
+func TestGenerateConfigMap(t *testing.T) {
+	tpl := ConfigMap{
+		ObjectMeta: ObjectMeta{
+			Name:            "envoy-xds",
+			Namespace:       "default",
+			ResourceVersion: "123",
+			Annotations: map[string]string{
+				"kubectl.kubernetes.io/last-applied-configuration": "{}",
+				AnnotationUnmatchedFiles:                           UnmatchedFilesCopy,
+			},
+		},
+		Data:       map[string]string{"rds.yaml": multiServiceRDS},
+		BinaryData: map[string][]byte{"ca.der": {0x30, 0x82}},
+	}
+
+	gen, err := GenerateConfigMap(tpl, TrafficSplit{
+		ObjectMeta: ObjectMeta{Name: "podinfo", Namespace: "default"},
+		Spec: TrafficSplitSpec{Service: "podinfo", Backends: []TrafficSplitBackend{
+			{Service: "podinfo-v1", Weight: 30},
+			{Service: "podinfo-v2", Weight: 70},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedMeta := ObjectMeta{
+		Name:        "envoy-xds-gen",
+		Namespace:   "default",
+		Annotations: map[string]string{AnnotationUnmatchedFiles: UnmatchedFilesCopy},
+	}
+	if d := cmp.Diff(expectedMeta, gen.ObjectMeta); d != "" {
+		t.Errorf("unexpected metadata: %s", d)
+	}
+	if d := cmp.Diff(tpl.BinaryData, gen.BinaryData); d != "" {
+		t.Errorf("unexpected binary data: %s", d)
+	}
+	if gen.Data["rds.yaml"] == multiServiceRDS {
+		t.Error("trafficsplit isn't merged")
+	}
+	// The template is left as is
+	if len(tpl.ObjectMeta.Annotations) != 2 || tpl.Data["rds.yaml"] != multiServiceRDS {
+		t.Errorf("unexpected change to the template: %+v", tpl)
+	}
+}
+
+func TestNamesForConfig(t *testing.T) {
+	actual := namesForConfig(map[string]string{"c": "x", "a": "x", "b": "y"}, "x")
+	if diff := cmp.Diff([]string{"a", "c"}, actual); diff != "" {
+		t.Errorf(diff)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/mumoshu/crossover/pkg/query"
 	"gopkg.in/yaml.v3"
 )
 
@@ -37,11 +38,11 @@ func TestUpdate(t *testing.T) {
 			},
 		},
 	}
-	found := find(m, []string{"resources", "*", "virtual_hosts", "*", "routes", "*", "route", "weighted_clusters", "clusters"}, func(m interface{}) {
-		find(m, []string{"name=foo"}, func(m interface{}) {
+	found := query.MustParse("resources/*/virtual_hosts/*/routes/*/route/weighted_clusters/clusters").Each(m, func(m interface{}) {
+		query.MustParse("name=foo").Each(m, func(m interface{}) {
 			set(m, "weight", 80)
 		})
-		find(m, []string{"name=bar"}, func(m interface{}) {
+		query.MustParse("name=bar").Each(m, func(m interface{}) {
 			set(m, "weight", 20)
 		})
 	})
@@ -57,15 +58,15 @@ func TestUpdate(t *testing.T) {
 	}
 	bs := buf.String()
 	expected := `resources:
-- virtual_hosts:
-  - routes:
-    - route:
-        weighted_clusters:
-          clusters:
-          - name: foo
-            weight: 80
-          - name: bar
-            weight: 20
+  - virtual_hosts:
+      - routes:
+          - route:
+              weighted_clusters:
+                clusters:
+                  - name: foo
+                    weight: 80
+                  - name: bar
+                    weight: 20
 `
 	diff := cmp.Diff(expected, bs)
 	if diff != "" {
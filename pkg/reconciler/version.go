@@ -0,0 +1,79 @@
+package reconciler
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+
+	"github.com/mumoshu/crossover/pkg/query"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// VersionInfoInject adds `version_info` to DiscoveryResponse files missing it
+	VersionInfoInject = "inject"
+	// VersionInfoOverride replaces `version_info` of every DiscoveryResponse file
+	VersionInfoOverride = "override"
+
+	versionInfoKey = "version_info"
+)
+
+// contentVersion returns the version_info of the file, made of the resourceVersion of the configmap and the hash of
+// the content, so that the same content of the same configmap revision always has the same version_info and
+// Envoy's `version_text` stat tells which revision Envoy runs
+func contentVersion(resourceVersion, content string) string {
+	if resourceVersion == "" {
+		resourceVersion = "0"
+	}
+	sum := sha256.Sum256([]byte(content))
+	return fmt.Sprintf("%s-%x", resourceVersion, sum[:4])
+}
+
+// stampVersions returns the configmap with `version_info` of its DiscoveryResponse files injected or overridden.
+// Other files, including ones that can't be parsed, are left as is.
+func stampVersions(cm ConfigMap, mode string) (ConfigMap, error) {
+	data := map[string]string{}
+	for key, conf := range cm.Data {
+		stamped, err := stampVersion(key, conf, contentVersion(cm.ObjectMeta.ResourceVersion, conf), mode == VersionInfoOverride)
+		if err != nil {
+			return cm, fmt.Errorf("%s: %v", key, err)
+		}
+		data[key] = stamped
+	}
+	cm.Data = data
+	return cm, nil
+}
+
+func stampVersion(key, conf, version string, override bool) (string, error) {
+	doc, err := decodeYAML(conf)
+	if err != nil || doc == nil {
+		return conf, nil
+	}
+	root := query.Resolve(doc)
+	if root.Kind != yaml.MappingNode || mappingIndex(root, "resources") < 0 {
+		return conf, nil
+	}
+
+	if idx := mappingIndex(root, versionInfoKey); idx >= 0 {
+		v := root.Content[idx+1]
+		if !override || (v.Kind == yaml.ScalarNode && v.Value == version) {
+			return conf, nil
+		}
+		root.Content[idx+1] = &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: version, Style: yaml.DoubleQuotedStyle}
+		return encodeConfig(key, conf, doc)
+	}
+
+	// Prepending the key to a block mapping keeps the rest of the file byte-for-byte
+	first := root.Content[0]
+	if detectFormat(key, conf) == formatYAML && root.Style&yaml.FlowStyle == 0 && first.Column == 1 {
+		lines := strings.SplitAfter(conf, "\n")
+		i := first.Line - 1
+		stamped := strings.Join(lines[:i], "") + fmt.Sprintf("%s: %q\n", versionInfoKey, version) + strings.Join(lines[i:], "")
+		return stamped, nil
+	}
+
+	k := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: versionInfoKey}
+	v := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: version, Style: yaml.DoubleQuotedStyle}
+	root.Content = append([]*yaml.Node{k, v}, root.Content...)
+	return encodeConfig(key, conf, doc)
+}
@@ -0,0 +1,108 @@
+package reconciler
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestStampVersions(t *testing.T) {
+	cds := `# clusters
+resources:
+- "@type": type.googleapis.com/envoy.api.v2.Cluster
+  name: podinfo  # primary
+`
+	rds := `version_info: "0"
+resources: []
+`
+	lds := `{
+  "version_info": "1",
+  "resources": []
+}
+`
+	eds := `{"resources": []}
+`
+	bootstrap := `admin:
+  access_log_path: /dev/null
+`
+
+	cm := ConfigMap{
+		ObjectMeta: ObjectMeta{Name: "envoy-xds", Namespace: "default", ResourceVersion: "123"},
+		Data: map[string]string{
+			"cds.yaml":   cds,
+			"rds.yaml":   rds,
+			"lds.json":   lds,
+			"eds.json":   eds,
+			"envoy.yaml": bootstrap,
+		},
+	}
+
+	testcases := []struct {
+		mode     string
+		expected map[string]string
+	}{
+		{
+			mode: VersionInfoInject,
+			expected: map[string]string{
+				"cds.yaml": `# clusters
+version_info: "` + contentVersion("123", cds) + `"
+resources:
+- "@type": type.googleapis.com/envoy.api.v2.Cluster
+  name: podinfo  # primary
+`,
+				"rds.yaml":   rds,
+				"lds.json":   lds,
+				"eds.json":   `{"version_info":"` + contentVersion("123", eds) + `","resources":[]}` + "\n",
+				"envoy.yaml": bootstrap,
+			},
+		},
+		{
+			mode: VersionInfoOverride,
+			expected: map[string]string{
+				"cds.yaml": `# clusters
+version_info: "` + contentVersion("123", cds) + `"
+resources:
+- "@type": type.googleapis.com/envoy.api.v2.Cluster
+  name: podinfo  # primary
+`,
+				"rds.yaml": `version_info: "` + contentVersion("123", rds) + `"
+resources: []
+`,
+				"lds.json": `{
+  "version_info": "` + contentVersion("123", lds) + `",
+  "resources": []
+}
+`,
+				"eds.json":   `{"version_info":"` + contentVersion("123", eds) + `","resources":[]}` + "\n",
+				"envoy.yaml": bootstrap,
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.mode, func(t *testing.T) {
+			actual, err := stampVersions(cm, tc.mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d := cmp.Diff(tc.expected, actual.Data); d != "" {
+				t.Errorf("unexpected data: %s", d)
+			}
+
+			// The same content of the same revision always gets the same version
+			again, err := stampVersions(actual, tc.mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.mode == VersionInfoInject {
+				if d := cmp.Diff(actual.Data, again.Data); d != "" {
+					t.Errorf("unexpected data stamped twice: %s", d)
+				}
+			}
+		})
+	}
+
+	if contentVersion("123", cds) == contentVersion("124", cds) || contentVersion("123", cds) == contentVersion("123", rds) {
+		t.Error("versions must differ by revisions and contents")
+	}
+}
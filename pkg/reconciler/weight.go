@@ -0,0 +1,323 @@
+package reconciler
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mumoshu/crossover/pkg/query"
+)
+
+// defaultTotalWeight is the value Envoy assumes when `total_weight` is omitted from `weighted_clusters`
+const defaultTotalWeight = 100
+
+// quantitySuffixes maps the suffixes of Kubernetes quantities to their multipliers.
+// See https://github.com/kubernetes/apimachinery/blob/master/pkg/api/resource/quantity.go
+var quantitySuffixes = map[string]*big.Rat{
+	"n":  big.NewRat(1, 1000000000),
+	"u":  big.NewRat(1, 1000000),
+	"m":  big.NewRat(1, 1000),
+	"":   big.NewRat(1, 1),
+	"k":  big.NewRat(1000, 1),
+	"M":  big.NewRat(1000000, 1),
+	"G":  big.NewRat(1000000000, 1),
+	"T":  new(big.Rat).SetInt64(1000000000000),
+	"P":  new(big.Rat).SetInt64(1000000000000000),
+	"E":  new(big.Rat).SetInt64(1000000000000000000),
+	"Ki": new(big.Rat).SetInt64(1 << 10),
+	"Mi": new(big.Rat).SetInt64(1 << 20),
+	"Gi": new(big.Rat).SetInt64(1 << 30),
+	"Ti": new(big.Rat).SetInt64(1 << 40),
+	"Pi": new(big.Rat).SetInt64(1 << 50),
+	"Ei": new(big.Rat).SetInt64(1 << 60),
+}
+
+// parseQuantityMilli parses a Kubernetes quantity string like `1`, `500m` or `1.5k` that is used as a weight in
+// SMI TrafficSplit v1alpha1, and returns its value in milli-units.
+// Fractional milli-units are rounded up, as Kubernetes does.
+func parseQuantityMilli(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, fmt.Errorf("empty quantity")
+	}
+
+	i := 0
+	if s[0] == '+' || s[0] == '-' {
+		i++
+	}
+	for i < len(s) && (s[i] == '.' || ('0' <= s[i] && s[i] <= '9')) {
+		i++
+	}
+	num, suffix := s[:i], s[i:]
+
+	multiplier, ok := quantitySuffixes[suffix]
+	if !ok {
+		// Decimal exponent like 1e3
+		if len(suffix) < 2 || (suffix[0] != 'e' && suffix[0] != 'E') {
+			return 0, fmt.Errorf("invalid quantity %q: unknown suffix %q", s, suffix)
+		}
+		exp, err := strconv.Atoi(suffix[1:])
+		if err != nil || exp < -18 || exp > 18 {
+			return 0, fmt.Errorf("invalid quantity %q: invalid exponent %q", s, suffix)
+		}
+		multiplier = ratPow(big.NewRat(10, 1), exp)
+	}
+
+	v, ok := new(big.Rat).SetString(num)
+	if !ok {
+		return 0, fmt.Errorf("invalid quantity %q", s)
+	}
+	if v.Sign() < 0 {
+		return 0, fmt.Errorf("invalid quantity %q: weights must not be negative", s)
+	}
+
+	v.Mul(v, multiplier)
+	v.Mul(v, big.NewRat(1000, 1))
+
+	q, r := new(big.Int).QuoRem(v.Num(), v.Denom(), new(big.Int))
+	if r.Sign() != 0 {
+		q.Add(q, big.NewInt(1))
+	}
+	if !q.IsInt64() || q.Int64() > int64(^uint32(0)) {
+		return 0, fmt.Errorf("invalid quantity %q: too large to be used as a weight", s)
+	}
+
+	return int(q.Int64()), nil
+}
+
+func ratPow(r *big.Rat, exp int) *big.Rat {
+	res := big.NewRat(1, 1)
+	base := r
+	if exp < 0 {
+		base = new(big.Rat).Inv(r)
+		exp = -exp
+	}
+	for i := 0; i < exp; i++ {
+		res.Mul(res, base)
+	}
+	return res
+}
+
+// normalizeWeights scales the relative weights so that they sum up to total exactly.
+// Rounding is done with the largest remainder method, where ties are broken by the order of weights.
+func normalizeWeights(weights []int, total int) ([]int, error) {
+	if total < 0 {
+		return nil, fmt.Errorf("unable to distribute negative total weight %d", total)
+	}
+
+	var sum int64
+	for _, w := range weights {
+		if w < 0 {
+			return nil, fmt.Errorf("weights must not be negative: %v", weights)
+		}
+		sum += int64(w)
+	}
+
+	res := make([]int, len(weights))
+
+	if sum == 0 {
+		if total == 0 {
+			return res, nil
+		}
+		return nil, fmt.Errorf("unable to distribute total weight %d over weights summing up to zero: %v", total, weights)
+	}
+
+	type remainder struct {
+		index int
+		value *big.Int
+	}
+
+	remainders := make([]remainder, len(weights))
+
+	var assigned int64
+	for i, w := range weights {
+		// Use big.Int as the product of uint32 weights and total_weight may overflow int64
+		p := new(big.Int).Mul(big.NewInt(int64(w)), big.NewInt(int64(total)))
+		q, r := p.QuoRem(p, big.NewInt(sum), new(big.Int))
+		res[i] = int(q.Int64())
+		remainders[i] = remainder{index: i, value: r}
+		assigned += int64(res[i])
+	}
+
+	sort.SliceStable(remainders, func(i, j int) bool {
+		return remainders[i].value.Cmp(remainders[j].value) > 0
+	})
+
+	for i := 0; assigned < int64(total); i++ {
+		res[remainders[i].index]++
+		assigned++
+	}
+
+	return res, nil
+}
+
+// clusterWeight is the desired relative weight of the Envoy cluster that corresponds to a trafficsplit backend
+type clusterWeight struct {
+	Name    string
+	Service string
+	Weight  int
+}
+
+var (
+	totalWeightQuery = query.MustParse("total_weight")
+	clustersQuery    = query.MustParse("clusters")
+	nameQuery        = query.MustParse("name")
+	weightQuery      = query.MustParse("weight")
+)
+
+// mergeWeightedClusters updates the weights of the clusters within the Envoy `weighted_clusters` object according
+// to the trafficsplit backends.
+// The object can be either a yaml.Node or a map decoded from YAML.
+//
+// Backend weights are relative, so they are scaled to the part of `total_weight` that is not occupied by the clusters
+// missing in the trafficsplit, so that the weights sum up to `total_weight` as Envoy requires.
+//
+// In the authoritative mode, clusters are added for backends missing in `weighted_clusters`, and clusters missing
+// in the trafficsplit are removed or zeroed.
+func mergeWeightedClusters(wc interface{}, backends []clusterWeight, opts *templateOptions) error {
+	total := defaultTotalWeight
+	if vs := totalWeightQuery.Find(wc); len(vs) > 0 {
+		v := query.Value(vs[0])
+		t, ok := toInt(v)
+		if !ok || t < 1 {
+			return fmt.Errorf("invalid total_weight: %v", v)
+		}
+		total = t
+	}
+
+	clusterLists := clustersQuery.Find(wc)
+	if len(clusterLists) == 0 {
+		return fmt.Errorf("weighted_clusters has no clusters")
+	}
+	clusters := query.MustParse("*").Find(clusterLists[0])
+
+	backendWeights := map[string]int{}
+	for _, b := range backends {
+		backendWeights[b.Name] = b.Weight
+	}
+
+	var (
+		targets []interface{}
+		weights []int
+		removed []int
+		fixed   int
+	)
+
+	existing := map[string]bool{}
+
+	for i, cluster := range clusters {
+		name := queryString(nameQuery, cluster)
+		existing[name] = true
+		if w, ok := backendWeights[name]; ok {
+			targets = append(targets, cluster)
+			weights = append(weights, w)
+			continue
+		}
+		if opts.authoritative {
+			if opts.removeMissing {
+				removed = append(removed, i)
+			} else {
+				set(cluster, "weight", 0)
+			}
+			continue
+		}
+		var w int
+		if vs := weightQuery.Find(cluster); len(vs) > 0 {
+			v := query.Value(vs[0])
+			var ok bool
+			if w, ok = toInt(v); !ok {
+				return fmt.Errorf("invalid weight of cluster %q: %v", name, v)
+			}
+		}
+		fixed += w
+	}
+
+	var added []clusterWeight
+	if opts.authoritative {
+		for _, b := range backends {
+			if existing[b.Name] {
+				continue
+			}
+			existing[b.Name] = true
+			added = append(added, b)
+			weights = append(weights, b.Weight)
+		}
+	}
+
+	// Clusters are removed even when no backend is found in them, so that removed backends never keep receiving traffic
+	for i := len(removed) - 1; i >= 0; i-- {
+		query.MustParse(fmt.Sprintf("clusters[%d]", removed[i])).Delete(wc)
+	}
+
+	if len(weights) == 0 {
+		// Envoy rejects weighted_clusters whose weights sum up to zero, like when every cluster is removed or zeroed
+		if fixed == 0 {
+			return fmt.Errorf("weights of weighted_clusters sum up to zero, as none of the backends %v is in it", backendNames(backends))
+		}
+		return nil
+	}
+
+	normalized, err := normalizeWeights(weights, total-fixed)
+	if err != nil {
+		return fmt.Errorf("unable to satisfy total_weight %d: %v", total, err)
+	}
+
+	for i, cluster := range targets {
+		set(cluster, "weight", normalized[i])
+	}
+
+	for i, b := range added {
+		clustersQuery.Append(wc, map[string]interface{}{
+			"name":   b.Name,
+			"weight": normalized[len(targets)+i],
+		})
+	}
+
+	return nil
+}
+
+// backendNames returns the names of the clusters of the backends
+func backendNames(backends []clusterWeight) []string {
+	var names []string
+	for _, b := range backends {
+		names = append(names, b.Name)
+	}
+	return names
+}
+
+// queryString returns the first value found by the query as a string, or an empty string when not found
+func queryString(q *query.Query, v interface{}) string {
+	vs := q.Find(v)
+	if len(vs) == 0 {
+		return ""
+	}
+	s, _ := query.Value(vs[0]).(string)
+	return s
+}
+
+func toInt(v interface{}) (int, bool) {
+	switch t := v.(type) {
+	case nil:
+		return 0, true
+	case int:
+		return t, true
+	case int64:
+		return int(t), true
+	case uint64:
+		return int(t), true
+	case float64:
+		if t != float64(int(t)) {
+			return 0, false
+		}
+		return int(t), true
+	case string:
+		i, err := strconv.Atoi(t)
+		if err != nil {
+			return 0, false
+		}
+		return i, true
+	}
+	return 0, false
+}
@@ -0,0 +1,212 @@
+package reconciler
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseQuantityMilli(t *testing.T) {
+	testcases := []struct {
+		in       string
+		expected int
+		err      bool
+	}{
+		{in: "1", expected: 1000},
+		{in: "500m", expected: 500},
+		{in: "0.5", expected: 500},
+		{in: "1.5k", expected: 1500000},
+		{in: "1Ki", expected: 1024000},
+		{in: "1e2", expected: 100000},
+		{in: "100u", expected: 1},
+		{in: "", err: true},
+		{in: "-1", err: true},
+		{in: "1x", err: true},
+		{in: "1E", err: true},
+	}
+
+	for _, tc := range testcases {
+		actual, err := parseQuantityMilli(tc.in)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%q: expected error, got %d", tc.in, actual)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tc.in, err)
+			continue
+		}
+		if actual != tc.expected {
+			t.Errorf("%q: expected %d, got %d", tc.in, tc.expected, actual)
+		}
+	}
+}
+
+func TestNormalizeWeights(t *testing.T) {
+	testcases := []struct {
+		weights  []int
+		total    int
+		expected []int
+		err      bool
+	}{
+		{weights: []int{1, 1}, total: 100, expected: []int{50, 50}},
+		{weights: []int{1, 1, 1}, total: 100, expected: []int{34, 33, 33}},
+		{weights: []int{1, 2}, total: 100, expected: []int{33, 67}},
+		{weights: []int{500, 1500}, total: 10000, expected: []int{2500, 7500}},
+		{weights: []int{0, 0}, total: 0, expected: []int{0, 0}},
+		{weights: []int{4294967295, 1}, total: 4294967295, expected: []int{4294967294, 1}},
+		{weights: []int{0, 0}, total: 100, err: true},
+		{weights: []int{1}, total: -1, err: true},
+	}
+
+	for i, tc := range testcases {
+		actual, err := normalizeWeights(tc.weights, tc.total)
+		if tc.err {
+			if err == nil {
+				t.Errorf("case %d: expected error, got %v", i, actual)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("case %d: unexpected error: %v", i, err)
+			continue
+		}
+		if diff := cmp.Diff(tc.expected, actual); diff != "" {
+			t.Errorf("case %d: %s", i, diff)
+		}
+	}
+}
+
+func TestMergeWeightedClusters(t *testing.T) {
+	wc := map[string]interface{}{
+		"total_weight": 10,
+		"clusters": []interface{}{
+			map[string]interface{}{"name": "foo", "weight": 2},
+			map[string]interface{}{"name": "bar", "weight": 4},
+			map[string]interface{}{"name": "baz", "weight": 4},
+		},
+	}
+
+	err := mergeWeightedClusters(wc, []clusterWeight{
+		{Name: "bar", Weight: 1},
+		{Name: "baz", Weight: 1},
+	}, &templateOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := map[string]interface{}{
+		"total_weight": 10,
+		"clusters": []interface{}{
+			map[string]interface{}{"name": "foo", "weight": 2},
+			map[string]interface{}{"name": "bar", "weight": 4},
+			map[string]interface{}{"name": "baz", "weight": 4},
+		},
+	}
+	if diff := cmp.Diff(expected, wc); diff != "" {
+		t.Errorf(diff)
+	}
+
+	err = mergeWeightedClusters(wc, []clusterWeight{
+		{Name: "bar", Weight: 0},
+		{Name: "baz", Weight: 0},
+	}, &templateOptions{})
+	if err == nil {
+		t.Errorf("expected error for weights that cannot sum up to total_weight")
+	}
+}
+
+func TestMergeWeightedClustersAuthoritative(t *testing.T) {
+	newWeightedClusters := func() map[string]interface{} {
+		return map[string]interface{}{
+			"clusters": []interface{}{
+				map[string]interface{}{"name": "v1", "weight": 50},
+				map[string]interface{}{"name": "v2", "weight": 50},
+			},
+		}
+	}
+
+	backends := []clusterWeight{
+		{Name: "v2", Weight: 1},
+		{Name: "v3", Weight: 3},
+	}
+
+	testcases := []struct {
+		opts     templateOptions
+		expected map[string]interface{}
+	}{
+		{
+			opts: templateOptions{authoritative: true, removeMissing: true},
+			expected: map[string]interface{}{
+				"clusters": []interface{}{
+					map[string]interface{}{"name": "v2", "weight": 25},
+					map[string]interface{}{"name": "v3", "weight": 75},
+				},
+			},
+		},
+		{
+			opts: templateOptions{authoritative: true},
+			expected: map[string]interface{}{
+				"clusters": []interface{}{
+					map[string]interface{}{"name": "v1", "weight": 0},
+					map[string]interface{}{"name": "v2", "weight": 25},
+					map[string]interface{}{"name": "v3", "weight": 75},
+				},
+			},
+		},
+		{
+			opts: templateOptions{},
+			expected: map[string]interface{}{
+				"clusters": []interface{}{
+					map[string]interface{}{"name": "v1", "weight": 50},
+					map[string]interface{}{"name": "v2", "weight": 50},
+				},
+			},
+		},
+	}
+
+	for i, tc := range testcases {
+		wc := newWeightedClusters()
+		if err := mergeWeightedClusters(wc, backends, &tc.opts); err != nil {
+			t.Fatalf("case %d: unexpected error: %v", i, err)
+		}
+		if diff := cmp.Diff(tc.expected, wc); diff != "" {
+			t.Errorf("case %d: %s", i, diff)
+		}
+	}
+}
+
+func TestMergeWeightedClustersWithoutWeights(t *testing.T) {
+	// A trafficsplit without backends would remove or zero every cluster, which Envoy rejects
+	for _, opts := range []templateOptions{{authoritative: true, removeMissing: true}, {authoritative: true}} {
+		wc := map[string]interface{}{
+			"clusters": []interface{}{
+				map[string]interface{}{"name": "v1", "weight": 100},
+			},
+		}
+		if err := mergeWeightedClusters(wc, nil, &opts); err == nil {
+			t.Errorf("%+v: expected error for weights summing up to zero, got %v", opts, wc)
+		}
+	}
+
+	wc := map[string]interface{}{
+		"clusters": []interface{}{
+			map[string]interface{}{"name": "v1", "weight": 0},
+		},
+	}
+	if err := mergeWeightedClusters(wc, []clusterWeight{{Name: "v2", Weight: 1}}, &templateOptions{}); err == nil {
+		t.Errorf("expected error for weights summing up to zero")
+	}
+}
+
+func TestTrafficSplitBackendV1Alpha1(t *testing.T) {
+	b := TrafficSplitBackend{}
+	if err := json.Unmarshal([]byte(`{"service":"foo","weight":"500m"}`), &b); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(TrafficSplitBackend{Service: "foo", Weight: 500}, b); diff != "" {
+		t.Errorf(diff)
+	}
+}
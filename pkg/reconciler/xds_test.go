@@ -0,0 +1,108 @@
+package reconciler
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	tls "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/mumoshu/crossover/pkg/xds"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// TestReconcilersOverADS sends the SDS and EDS resources the reconcilers generate through ADS, as Envoy would read them
+func TestReconcilersOverADS(t *testing.T) {
+	store := xds.NewServer()
+
+	secrets := newMemClient()
+	secrets.put("default", "podinfo-tls", Secret{
+		ObjectMeta: ObjectMeta{Name: "podinfo-tls", Namespace: "default", ResourceVersion: "1"},
+		Type:       SecretTypeTLS,
+		Data: map[string][]byte{
+			"tls.crt": []byte("cert"),
+			"tls.key": []byte("key"),
+		},
+	})
+	sr := &SecretReconciler{Client: secrets, Namespace: "default", Output: Output{Snapshots: store, SkipFiles: true}}
+	if err := sr.Reconcile("podinfo-tls"); err != nil {
+		t.Fatal(err)
+	}
+
+	port := int32(9898)
+	slices := newMemClient()
+	slices.put("default", "podinfo-abcde", EndpointSlice{
+		ObjectMeta:  ObjectMeta{Name: "podinfo-abcde", Namespace: "default", Labels: map[string]string{serviceNameLabel: "podinfo"}, ResourceVersion: "1"},
+		AddressType: "IPv4",
+		Ports:       []EndpointPort{{Name: "http", Port: &port}},
+		Endpoints:   []EndpointSliceEndpoint{{Addresses: []string{"10.0.0.1"}, Zone: "us-east-1a"}},
+	})
+	er := &EndpointsReconciler{EndpointSlices: slices, Namespace: "default", Output: Output{Snapshots: store, SkipFiles: true}}
+	if err := er.Reconcile("podinfo"); err != nil {
+		t.Fatal(err)
+	}
+
+	l := bufconn.Listen(1024 * 1024)
+	srv := grpc.NewServer()
+	discovery.RegisterAggregatedDiscoveryServiceServer(srv, store)
+	go srv.Serve(l)
+	defer srv.Stop()
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return l.Dial() }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	stream, err := discovery.NewAggregatedDiscoveryServiceClient(conn).StreamAggregatedResources(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recv := func(typeURL string) *discovery.DiscoveryResponse {
+		t.Helper()
+		if err := stream.Send(&discovery.DiscoveryRequest{TypeUrl: typeURL}); err != nil {
+			t.Fatal(err)
+		}
+		res, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.TypeUrl != typeURL || len(res.Resources) != 1 {
+			t.Fatalf("unexpected response: %v", res)
+		}
+		// ACK so that the next kind is sent
+		if err := stream.Send(&discovery.DiscoveryRequest{TypeUrl: typeURL, VersionInfo: res.VersionInfo, ResponseNonce: res.Nonce}); err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	secret := &tls.Secret{}
+	if err := recv(secretTypeURL).Resources[0].UnmarshalTo(secret); err != nil {
+		t.Fatal(err)
+	}
+	if secret.Name != "podinfo-tls" || secret.GetTlsCertificate().GetCertificateChain().GetInlineString() != "cert" {
+		t.Errorf("unexpected secret: %v", secret)
+	}
+
+	cla := &endpoint.ClusterLoadAssignment{}
+	if err := recv(clusterLoadAssignmentTypeURL).Resources[0].UnmarshalTo(cla); err != nil {
+		t.Fatal(err)
+	}
+	if cla.ClusterName != "podinfo" || len(cla.Endpoints) != 1 || len(cla.Endpoints[0].LbEndpoints) != 1 {
+		t.Fatalf("unexpected cluster load assignment: %v", cla)
+	}
+	if addr := cla.Endpoints[0].LbEndpoints[0].GetEndpoint().GetAddress().GetSocketAddress(); addr.GetAddress() != "10.0.0.1" || addr.GetPortValue() != 9898 {
+		t.Errorf("unexpected address: %v", addr)
+	}
+}
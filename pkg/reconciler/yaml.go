@@ -0,0 +1,141 @@
+package reconciler
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+)
+
+// decodeYAML parses the document into a yaml.Node tree, so that it can be updated without losing comments,
+// key order and scalar styles.
+// It returns nil when the document is empty.
+func decodeYAML(conf string) (*yaml.Node, error) {
+	doc := &yaml.Node{}
+	if err := yaml.Unmarshal([]byte(conf), doc); err != nil {
+		return nil, err
+	}
+	if doc.Kind == 0 || len(doc.Content) == 0 {
+		return nil, nil
+	}
+	return doc, nil
+}
+
+// encodeYAMLNode returns the text of the updated document parsed from src.
+//
+// When the update only changed values of plain scalars like weights, the new values are spliced into src so that
+// everything else round-trips byte-for-byte. Otherwise the whole document is re-encoded, which still preserves
+// comments and key order.
+func encodeYAMLNode(src string, doc *yaml.Node) (string, error) {
+	if patched, ok := patchScalars(src, doc); ok {
+		return patched, nil
+	}
+	return encodeYAML(doc)
+}
+
+type scalarEdit struct {
+	offset int
+	length int
+	text   string
+}
+
+// patchScalars splices the scalar values of the updated document into src.
+// It returns false when the document has changed in any other way than values of plain scalars.
+func patchScalars(src string, updated *yaml.Node) (string, bool) {
+	orig, err := decodeYAML(src)
+	if err != nil || orig == nil {
+		return "", false
+	}
+
+	lineOffsets := []int{0}
+	for i := 0; i < len(src); i++ {
+		if src[i] == '\n' {
+			lineOffsets = append(lineOffsets, i+1)
+		}
+	}
+
+	var edits []scalarEdit
+	if !diffScalars(src, lineOffsets, orig, updated, &edits) {
+		return "", false
+	}
+
+	sort.Slice(edits, func(i, j int) bool {
+		return edits[i].offset > edits[j].offset
+	})
+
+	res := src
+	for _, e := range edits {
+		res = res[:e.offset] + e.text + res[e.offset+e.length:]
+	}
+
+	return res, true
+}
+
+func diffScalars(src string, lineOffsets []int, a, b *yaml.Node, edits *[]scalarEdit) bool {
+	if a.Kind != b.Kind || len(a.Content) != len(b.Content) || a.Anchor != b.Anchor {
+		return false
+	}
+
+	switch a.Kind {
+	case yaml.AliasNode:
+		return a.Value == b.Value
+	case yaml.ScalarNode:
+		if a.Value == b.Value && a.ShortTag() == b.ShortTag() {
+			return true
+		}
+		if a.Style != 0 || b.Style&^yaml.TaggedStyle != 0 || strings.ContainsAny(b.Value, "\n#:") {
+			return false
+		}
+		// The new value must be read back as the same type without quotes
+		reparsed, err := decodeYAML(b.Value)
+		if err != nil || reparsed == nil || reparsed.Content[0].Kind != yaml.ScalarNode || reparsed.Content[0].ShortTag() != b.ShortTag() {
+			return false
+		}
+		offset, ok := nodeOffset(src, lineOffsets, a)
+		if !ok || !strings.HasPrefix(src[offset:], a.Value) {
+			return false
+		}
+		*edits = append(*edits, scalarEdit{offset: offset, length: len(a.Value), text: b.Value})
+		return true
+	}
+
+	for i := range a.Content {
+		if !diffScalars(src, lineOffsets, a.Content[i], b.Content[i], edits) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// nodeOffset returns the byte offset of the node within src, from its line and column counted in characters
+func nodeOffset(src string, lineOffsets []int, n *yaml.Node) (int, bool) {
+	if n.Line < 1 || n.Line > len(lineOffsets) || n.Column < 1 {
+		return 0, false
+	}
+	offset := lineOffsets[n.Line-1]
+	for col := 1; col < n.Column; col++ {
+		if offset >= len(src) || src[offset] == '\n' {
+			return 0, false
+		}
+		_, size := utf8.DecodeRuneInString(src[offset:])
+		offset += size
+	}
+	return offset, true
+}
+
+func encodeYAML(obj interface{}) (string, error) {
+	buf := bytes.Buffer{}
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(obj); err != nil {
+		return "", err
+	}
+	if err := enc.Close(); err != nil {
+		return "", fmt.Errorf("encoding yaml: %v", err)
+	}
+	return buf.String(), nil
+}
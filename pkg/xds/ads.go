@@ -0,0 +1,260 @@
+package xds
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// adsStream is the state of an ADS stream of an Envoy
+type adsStream struct {
+	node Node
+	// status is the ACKs and NACKs of the stream, apart from the ones of other replicas sharing the node
+	status *NodeStatus
+	// requests are the latest requests of each kind
+	requests map[string]DiscoveryRequest
+	// nonces are the nonces of the latest responses of each kind, to ignore requests for older responses
+	nonces map[string]string
+	// versions are the versions of the latest responses of each kind, not to send the same version twice
+	versions map[string]string
+	// names are the resource names requested for the latest responses of each kind, to respond to changes of them
+	names map[string]string
+	// errs are the latest errors of each kind, not to log the same error on every update
+	errs map[string]string
+}
+
+func newADSStream(status *NodeStatus) *adsStream {
+	return &adsStream{
+		status:   status,
+		requests: map[string]DiscoveryRequest{},
+		nonces:   map[string]string{},
+		versions: map[string]string{},
+		names:    map[string]string{},
+		errs:     map[string]string{},
+	}
+}
+
+// StreamAggregatedResources serves Envoy's Aggregated Discovery Service(ADS), which sends all the kinds of resources
+// over one gRPC stream. Like the REST-JSON API, updates are sent in the order of SDS, CDS, EDS, LDS and RDS, and an
+// update of a kind waits until Envoy has applied the current versions of the kinds before it.
+// ACKs and NACKs are recorded per stream, and reported along with the node statuses of the REST-JSON API.
+func (s *Server) StreamAggregatedResources(stream discovery.AggregatedDiscoveryService_StreamAggregatedResourcesServer) error {
+	ctx := stream.Context()
+
+	reqs := make(chan *discovery.DiscoveryRequest)
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				errs <- err
+				return
+			}
+			select {
+			case reqs <- req:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	st := newADSStream(s.openStream(peerAddress(ctx)))
+	defer s.closeStream(st.status)
+	for {
+		s.mu.RLock()
+		changed := s.changed
+		s.mu.RUnlock()
+
+		for _, res := range s.push(st) {
+			if err := stream.Send(res); err != nil {
+				return err
+			}
+		}
+
+		select {
+		case req := <-reqs:
+			s.receive(st, req)
+		case err := <-errs:
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		case <-changed:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// receive records the request in the stream and in the status of the node
+func (s *Server) receive(st *adsStream, req *discovery.DiscoveryRequest) {
+	kind, ok := kindOfTypeURL(req.TypeUrl)
+	if !ok {
+		log.Printf("Ignoring ADS request for unsupported type %q", req.TypeUrl)
+		return
+	}
+
+	// Envoy sends the node only in the first request of the stream by default
+	if req.Node != nil && st.node == (Node{}) {
+		st.node = Node{ID: req.Node.Id, Cluster: req.Node.Cluster}
+	}
+
+	// A request for an older response is superseded by the one Envoy sends for the latest response
+	if req.ResponseNonce != "" && req.ResponseNonce != st.nonces[kind] {
+		return
+	}
+
+	r := DiscoveryRequest{
+		VersionInfo:   req.VersionInfo,
+		Node:          st.node,
+		ResourceNames: req.ResourceNames,
+		TypeURL:       req.TypeUrl,
+		ResponseNonce: req.ResponseNonce,
+	}
+	if d := req.ErrorDetail; d != nil {
+		r.ErrorDetail = &ErrorDetail{Code: int(d.Code), Message: d.Message}
+	}
+
+	s.mu.Lock()
+	st.status.ID, st.status.Cluster = st.node.ID, st.node.Cluster
+	s.observe(st.status, kind, r)
+	s.mu.Unlock()
+
+	st.requests[kind] = r
+}
+
+// push returns the responses to send to the stream, in the order of kinds
+func (s *Server) push(st *adsStream) []*discovery.DiscoveryResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var res []*discovery.DiscoveryResponse
+	for _, kind := range order {
+		req, ok := st.requests[kind]
+		if !ok {
+			continue
+		}
+
+		// Envoy reports the version it had until it applies the response, so the version sent last is compared instead.
+		// Changing the names of resources Envoy subscribes to needs a new response even if the version is the same.
+		names := strings.Join(req.ResourceNames, ",")
+		if v, ok := st.versions[kind]; ok && st.names[kind] == names {
+			req.VersionInfo = v
+		}
+
+		r, ok, err := s.response(kind, req, st.status)
+		if err == nil && ok {
+			var pb *discovery.DiscoveryResponse
+			if pb, err = toProto(r); err == nil {
+				st.versions[kind], st.nonces[kind], st.names[kind] = r.VersionInfo, r.Nonce, names
+				res = append(res, pb)
+			}
+		}
+		if err != nil && err.Error() != st.errs[kind] {
+			log.Printf("Unable to send %s to Envoy %s/%s over ADS: %v", kind, st.node.Cluster, st.node.ID, err)
+		}
+		st.errs[kind] = ""
+		if err != nil {
+			st.errs[kind] = err.Error()
+		}
+	}
+	return res
+}
+
+// toProto converts the response to protobuf, by resolving the types of the resources from their `@type`s
+func toProto(r DiscoveryResponse) (*discovery.DiscoveryResponse, error) {
+	res := &discovery.DiscoveryResponse{
+		VersionInfo: r.VersionInfo,
+		TypeUrl:     r.TypeURL,
+		Nonce:       r.Nonce,
+	}
+	for _, resource := range r.Resources {
+		a, err := toAny(resource)
+		if err != nil {
+			return nil, err
+		}
+		res.Resources = append(res.Resources, a)
+	}
+	return res, nil
+}
+
+func toAny(r Resource) (*anypb.Any, error) {
+	bs, err := json.Marshal(r)
+	if err != nil {
+		return nil, fmt.Errorf("resource %q: %v", r.Name(), err)
+	}
+	a := &anypb.Any{}
+	if err := protojson.Unmarshal(bs, a); err != nil {
+		return nil, fmt.Errorf("resource %q: %v", r.Name(), err)
+	}
+	return a, nil
+}
+
+// peerAddress returns the address of the Envoy on the other end of the stream
+func peerAddress(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		return p.Addr.String()
+	}
+	return ""
+}
+
+func kindOfTypeURL(t string) (string, bool) {
+	kind, ok := kindsByTypeSuffix[t[strings.LastIndex(t, ".")+1:]]
+	return kind, ok
+}
+
+// ListenAndServeGRPC serves ADS on the address until the context is canceled.
+// The statuses of nodes are served at `/nodes` on the same address over HTTP/1.1, so that they can be read without
+// the REST-JSON API.
+func (s *Server) ListenAndServeGRPC(ctx context.Context, addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Serving ADS on %s", l.Addr())
+	return s.serveGRPC(ctx, l)
+}
+
+func (s *Server) serveGRPC(ctx context.Context, l net.Listener) error {
+	grpcServer := grpc.NewServer()
+	discovery.RegisterAggregatedDiscoveryServiceServer(grpcServer, s)
+
+	// Envoy connects over HTTP/2 without TLS, which is told apart from HTTP/1.1 requests for the statuses of nodes
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			grpcServer.ServeHTTP(w, r)
+			return
+		}
+		if r.URL.Path != "/nodes" {
+			http.NotFound(w, r)
+			return
+		}
+		s.serveNodes(w, r)
+	})
+	srv := &http.Server{Handler: h2c.NewHandler(handler, &http2.Server{})}
+
+	go func() {
+		<-ctx.Done()
+		// Shutdown would wait for streams, which last as long as Envoys are connected
+		srv.Close()
+	}()
+
+	if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,277 @@
+package xds
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	rpcstatus "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+const (
+	typeCluster = "type.googleapis.com/envoy.config.cluster.v3.Cluster"
+	typeRoute   = "type.googleapis.com/envoy.config.route.v3.RouteConfiguration"
+)
+
+const testCDSv3 = `resources:
+- "@type": type.googleapis.com/envoy.config.cluster.v3.Cluster
+  name: podinfo-primary
+  connect_timeout: 0.25s
+  type: STRICT_DNS
+`
+
+func dialADS(t *testing.T, s *Server) (discovery.AggregatedDiscoveryServiceClient, func()) {
+	t.Helper()
+
+	l := bufconn.Listen(1024 * 1024)
+	ctx, cancel := context.WithCancel(context.Background())
+	go s.serveGRPC(ctx, l)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return l.Dial() }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return discovery.NewAggregatedDiscoveryServiceClient(conn), func() {
+		conn.Close()
+		cancel()
+	}
+}
+
+func TestADS(t *testing.T) {
+	s := NewServer()
+	if err := s.Update("configmaps/envoy-xds", "", "", map[string]string{"cds.yaml": testCDSv3, "rds.json": testRDS}); err != nil {
+		t.Fatal(err)
+	}
+
+	client, stop := dialADS(t, s)
+	defer stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := client.StreamAggregatedResources(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	node := &core.Node{Id: "envoy-1", Cluster: "front"}
+	send := func(req *discovery.DiscoveryRequest) {
+		t.Helper()
+		if err := stream.Send(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recv := func() *discovery.DiscoveryResponse {
+		t.Helper()
+		res, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	// Routes wait until clusters are applied
+	send(&discovery.DiscoveryRequest{Node: node, TypeUrl: typeCluster})
+	send(&discovery.DiscoveryRequest{TypeUrl: typeRoute})
+
+	clusters := recv()
+	if clusters.TypeUrl != typeCluster || len(clusters.Resources) != 1 || clusters.VersionInfo == "" || clusters.Nonce == "" {
+		t.Fatalf("unexpected clusters: %v", clusters)
+	}
+	c := &cluster.Cluster{}
+	if err := clusters.Resources[0].UnmarshalTo(c); err != nil {
+		t.Fatal(err)
+	}
+	if c.Name != "podinfo-primary" || c.ConnectTimeout.AsDuration().Seconds() != 0.25 || c.GetType() != cluster.Cluster_STRICT_DNS {
+		t.Errorf("unexpected cluster: %v", c)
+	}
+
+	// ACK of the clusters lets the routes through
+	send(&discovery.DiscoveryRequest{TypeUrl: typeCluster, VersionInfo: clusters.VersionInfo, ResponseNonce: clusters.Nonce})
+	routes := recv()
+	if routes.TypeUrl != typeRoute || len(routes.Resources) != 1 {
+		t.Fatalf("unexpected routes: %v", routes)
+	}
+	send(&discovery.DiscoveryRequest{TypeUrl: typeRoute, VersionInfo: routes.VersionInfo, ResponseNonce: routes.Nonce})
+
+	// Updates are pushed
+	if err := s.Update("configmaps/envoy-xds", "", "", map[string]string{"cds.yaml": testCDSv3 + `- "@type": type.googleapis.com/envoy.config.cluster.v3.Cluster
+  name: podinfo-canary
+  connect_timeout: 0.25s
+`, "rds.json": testRDS}); err != nil {
+		t.Fatal(err)
+	}
+	updated := recv()
+	if updated.TypeUrl != typeCluster || len(updated.Resources) != 2 || updated.VersionInfo == clusters.VersionInfo {
+		t.Fatalf("unexpected updated clusters: %v", updated)
+	}
+
+	// NACKs are recorded per node
+	send(&discovery.DiscoveryRequest{TypeUrl: typeCluster, VersionInfo: clusters.VersionInfo, ResponseNonce: updated.Nonce, ErrorDetail: &rpcstatus.Status{Message: "invalid cluster"}})
+	for i := 0; len(s.Nodes()[0].Nacked) == 0; i++ {
+		if i == 100 {
+			t.Fatal("NACK isn't recorded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Reverting the clusters sends them again
+	if err := s.Update("configmaps/envoy-xds", "", "", map[string]string{"cds.yaml": testCDSv3, "rds.json": testRDS}); err != nil {
+		t.Fatal(err)
+	}
+	reverted := recv()
+	if reverted.VersionInfo != clusters.VersionInfo {
+		t.Fatalf("unexpected reverted clusters: %v", reverted)
+	}
+	nodes := s.Nodes()
+	if len(nodes) != 1 || nodes[0].ID != "envoy-1" || nodes[0].Cluster != "front" {
+		t.Fatalf("unexpected nodes: %+v", nodes)
+	}
+	if nack := nodes[0].Nacked[KindClusters]; nack.Version != updated.VersionInfo || nack.Message != "invalid cluster" {
+		t.Errorf("unexpected nack: %+v", nack)
+	}
+	if nodes[0].Acked[KindRoutes] != routes.VersionInfo {
+		t.Errorf("unexpected acked routes: %+v", nodes[0].Acked)
+	}
+}
+
+func TestADSUnservableResources(t *testing.T) {
+	s := NewServer()
+	// v2 resources can't be sent over gRPC, as their types aren't linked into crossover
+	if err := s.Update("configmaps/envoy-xds", "", "", map[string]string{"cds.yaml": testCDS}); err != nil {
+		t.Fatal(err)
+	}
+	st := newADSStream(s.openStream(""))
+	s.receive(st, &discovery.DiscoveryRequest{Node: &core.Node{Id: "envoy-1"}, TypeUrl: "type.googleapis.com/envoy.api.v2.Cluster"})
+	if res := s.push(st); len(res) != 0 {
+		t.Errorf("unexpected responses: %v", res)
+	}
+	if st.errs[KindClusters] == "" {
+		t.Errorf("missing error")
+	}
+
+	if err := s.Update("configmaps/envoy-xds", "", "", map[string]string{"cds.yaml": testCDSv3}); err != nil {
+		t.Fatal(err)
+	}
+	s.receive(st, &discovery.DiscoveryRequest{TypeUrl: typeCluster})
+	if res := s.push(st); len(res) != 1 || len(res[0].Resources) != 1 {
+		t.Errorf("unexpected responses: %v", res)
+	}
+}
+
+func TestADSReplicas(t *testing.T) {
+	s := NewServer()
+	if err := s.Update("configmaps/envoy-xds", "", "", map[string]string{"cds.yaml": testCDSv3, "rds.json": testRDS}); err != nil {
+		t.Fatal(err)
+	}
+
+	l := bufconn.Listen(1024 * 1024)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.serveGRPC(ctx, l)
+	dial := func(context.Context, string) (net.Conn, error) { return l.Dial() }
+
+	conn, err := grpc.Dial("bufnet", grpc.WithContextDialer(dial), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := discovery.NewAggregatedDiscoveryServiceClient(conn)
+
+	// Replicas of a deployment share the node ID and the cluster
+	node := &core.Node{Id: "envoy", Cluster: "front"}
+	open := func() discovery.AggregatedDiscoveryService_StreamAggregatedResourcesClient {
+		t.Helper()
+		stream, err := client.StreamAggregatedResources(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := stream.Send(&discovery.DiscoveryRequest{Node: node, TypeUrl: typeCluster}); err != nil {
+			t.Fatal(err)
+		}
+		if err := stream.Send(&discovery.DiscoveryRequest{TypeUrl: typeRoute}); err != nil {
+			t.Fatal(err)
+		}
+		return stream
+	}
+	recv := func(stream discovery.AggregatedDiscoveryService_StreamAggregatedResourcesClient) *discovery.DiscoveryResponse {
+		t.Helper()
+		res, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	a, b := open(), open()
+	clustersA, clustersB := recv(a), recv(b)
+	if clustersA.TypeUrl != typeCluster || clustersB.TypeUrl != typeCluster {
+		t.Fatalf("unexpected responses: %v, %v", clustersA, clustersB)
+	}
+
+	// The ACK of one replica doesn't let the routes through to the other one, which rejects the clusters
+	if err := a.Send(&discovery.DiscoveryRequest{TypeUrl: typeCluster, VersionInfo: clustersA.VersionInfo, ResponseNonce: clustersA.Nonce}); err != nil {
+		t.Fatal(err)
+	}
+	if routes := recv(a); routes.TypeUrl != typeRoute {
+		t.Fatalf("unexpected routes: %v", routes)
+	}
+	if err := b.Send(&discovery.DiscoveryRequest{TypeUrl: typeCluster, ResponseNonce: clustersB.Nonce, ErrorDetail: &rpcstatus.Status{Message: "invalid cluster"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The statuses of the replicas are reported apart, over the same port as ADS
+	httpClient := &http.Client{Transport: &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) { return l.Dial() }}}
+	var nodes []NodeStatus
+	var applied, rejected NodeStatus
+	for i := 0; len(rejected.Nacked) == 0; i++ {
+		if i == 100 {
+			t.Fatalf("unexpected nodes: %+v", nodes)
+		}
+		time.Sleep(10 * time.Millisecond)
+
+		res, err := httpClient.Get("http://bufnet/nodes")
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes = nil
+		err = json.NewDecoder(res.Body).Decode(&nodes)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, n := range nodes {
+			if n.Acked[KindClusters] != "" {
+				applied = n
+			} else {
+				rejected = n
+			}
+		}
+	}
+	if len(nodes) != 2 || applied.ID != "envoy" || applied.Stream == rejected.Stream || len(applied.Nacked) != 0 || applied.Acked[KindRoutes] != "" {
+		t.Errorf("unexpected status of the replica that applied the clusters: %+v", nodes)
+	}
+	if nack := rejected.Nacked[KindClusters]; nack.Version != clustersB.VersionInfo || rejected.ID != "envoy" {
+		t.Errorf("unexpected status of the replica that rejected the clusters: %+v", rejected)
+	}
+
+	// Closed streams are no longer reported
+	a.CloseSend()
+	b.CloseSend()
+	for i := 0; len(s.Nodes()) != 0; i++ {
+		if i == 100 {
+			t.Fatalf("unexpected nodes after closing streams: %+v", s.Nodes())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
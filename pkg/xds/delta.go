@@ -0,0 +1,336 @@
+package xds
+
+import (
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"sync/atomic"
+
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+)
+
+// wildcard is the resource name to subscribe to all the resources of a kind
+const wildcard = "*"
+
+// deltaStream is the state of an incremental ADS stream of an Envoy
+type deltaStream struct {
+	node Node
+	// status is the ACKs and NACKs of the stream, apart from the ones of other replicas sharing the node
+	status *NodeStatus
+	// typeURLs are the type URLs Envoy requested for each kind
+	typeURLs map[string]string
+	// wildcards are the kinds Envoy subscribes to all the resources of
+	wildcards map[string]bool
+	// names are the names of resources Envoy explicitly subscribes to, keyed by kind
+	names map[string]map[string]bool
+	// resources are the versions of the resources Envoy has applied, keyed by kind and then by name
+	resources map[string]map[string]string
+	// pending are the responses Envoy hasn't ACKed or NACKed yet, keyed by kind in the order they were sent
+	pending map[string][]deltaUpdate
+	// versions are the snapshot versions Envoy has been sent, not to compute the same differences twice.
+	// A kind is removed when Envoy changes its subscriptions.
+	versions map[string]string
+	// sent are the latest responses of each kind, to tell which version an ACK is for
+	sent map[string]sent
+	// acked are the snapshot versions Envoy has applied
+	acked map[string]string
+	// errs are the latest errors of each kind, not to log the same error on every update
+	errs map[string]string
+}
+
+func newDeltaStream(status *NodeStatus) *deltaStream {
+	return &deltaStream{
+		status:    status,
+		typeURLs:  map[string]string{},
+		wildcards: map[string]bool{},
+		names:     map[string]map[string]bool{},
+		resources: map[string]map[string]string{},
+		pending:   map[string][]deltaUpdate{},
+		versions:  map[string]string{},
+		sent:      map[string]sent{},
+		acked:     map[string]string{},
+		errs:      map[string]string{},
+	}
+}
+
+// deltaUpdate is the resources changed by a response
+type deltaUpdate struct {
+	nonce string
+	// resources are the versions of added or updated resources, and empty for removed ones, keyed by name
+	resources map[string]string
+}
+
+// has returns the versions of the resources Envoy has applied or is being sent, keyed by name
+func (st *deltaStream) has(kind string) map[string]string {
+	res := map[string]string{}
+	for name, v := range st.resources[kind] {
+		res[name] = v
+	}
+	for _, u := range st.pending[kind] {
+		for name, v := range u.resources {
+			if v == "" {
+				delete(res, name)
+			} else {
+				res[name] = v
+			}
+		}
+	}
+	return res
+}
+
+// settle moves the changes of the response with the nonce into the resources Envoy has when it applied them, and
+// drops them when Envoy rejected them, so that rejected resources are sent again with the next update.
+// Responses sent before it are dropped as well, as Envoy answers responses in order.
+func (st *deltaStream) settle(kind, nonce string, applied bool) {
+	for i, u := range st.pending[kind] {
+		if u.nonce != nonce {
+			continue
+		}
+		if applied {
+			for name, v := range u.resources {
+				if v == "" {
+					delete(st.resources[kind], name)
+				} else {
+					st.resources[kind][name] = v
+				}
+			}
+		}
+		st.pending[kind] = st.pending[kind][i+1:]
+		return
+	}
+}
+
+// DeltaAggregatedResources serves the incremental variant of ADS, which sends only the resources added or updated
+// since the ones Envoy has along with the names of removed ones, so that e.g. a canary weight change sends only the
+// changed route configuration. Updates are sent in the same order as StreamAggregatedResources.
+func (s *Server) DeltaAggregatedResources(stream discovery.AggregatedDiscoveryService_DeltaAggregatedResourcesServer) error {
+	ctx := stream.Context()
+
+	reqs := make(chan *discovery.DeltaDiscoveryRequest)
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				errs <- err
+				return
+			}
+			select {
+			case reqs <- req:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	st := newDeltaStream(s.openStream(peerAddress(ctx)))
+	defer s.closeStream(st.status)
+	for {
+		s.mu.RLock()
+		changed := s.changed
+		s.mu.RUnlock()
+
+		for _, res := range s.pushDelta(st) {
+			if err := stream.Send(res); err != nil {
+				return err
+			}
+		}
+
+		select {
+		case req := <-reqs:
+			s.receiveDelta(st, req)
+		case err := <-errs:
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		case <-changed:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// receiveDelta records the changes of subscriptions in the request, and the ACK or NACK in the status of the node
+func (s *Server) receiveDelta(st *deltaStream, req *discovery.DeltaDiscoveryRequest) {
+	kind, ok := kindOfTypeURL(req.TypeUrl)
+	if !ok {
+		log.Printf("Ignoring incremental ADS request for unsupported type %q", req.TypeUrl)
+		return
+	}
+
+	if req.Node != nil && st.node == (Node{}) {
+		st.node = Node{ID: req.Node.Id, Cluster: req.Node.Cluster}
+	}
+	st.typeURLs[kind] = req.TypeUrl
+
+	names, ok := st.names[kind]
+	if !ok {
+		// The first request of a kind without names subscribes to all the resources of it
+		names = map[string]bool{}
+		st.names[kind] = names
+		st.wildcards[kind] = len(req.ResourceNamesSubscribe) == 0
+		st.resources[kind] = map[string]string{}
+		for n, v := range req.InitialResourceVersions {
+			st.resources[kind][n] = v
+		}
+	}
+	for _, n := range req.ResourceNamesSubscribe {
+		if n == wildcard {
+			st.wildcards[kind] = true
+		} else {
+			names[n] = true
+		}
+		// Envoy needs newly subscribed resources even when the snapshot hasn't changed
+		delete(st.versions, kind)
+	}
+	for _, n := range req.ResourceNamesUnsubscribe {
+		if n == wildcard {
+			st.wildcards[kind] = false
+		} else {
+			delete(names, n)
+			delete(st.resources[kind], n)
+			for _, u := range st.pending[kind] {
+				delete(u.resources, n)
+			}
+		}
+		delete(st.versions, kind)
+	}
+
+	// A response is applied when Envoy sends its nonce without an error.
+	// Requests for older responses only change subscriptions, as Envoy sends another one for the latest response.
+	if req.ResponseNonce != "" {
+		st.settle(kind, req.ResponseNonce, req.ErrorDetail == nil)
+		if req.ResponseNonce != st.sent[kind].nonce {
+			return
+		}
+		if req.ErrorDetail == nil {
+			st.acked[kind] = st.sent[kind].version
+		}
+	}
+
+	r := DiscoveryRequest{
+		VersionInfo:   st.acked[kind],
+		Node:          st.node,
+		TypeURL:       req.TypeUrl,
+		ResponseNonce: req.ResponseNonce,
+	}
+	if d := req.ErrorDetail; d != nil {
+		r.ErrorDetail = &ErrorDetail{Code: int(d.Code), Message: d.Message}
+	}
+
+	s.mu.Lock()
+	st.status.ID, st.status.Cluster = st.node.ID, st.node.Cluster
+	s.observe(st.status, kind, r)
+	s.mu.Unlock()
+}
+
+// pushDelta returns the responses to send to the stream, in the order of kinds
+func (s *Server) pushDelta(st *deltaStream) []*discovery.DeltaDiscoveryResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var res []*discovery.DeltaDiscoveryResponse
+	for _, kind := range order {
+		if _, ok := st.names[kind]; !ok {
+			continue
+		}
+
+		r, ok, err := s.deltaResponse(kind, st)
+		if err == nil && ok {
+			res = append(res, r)
+		}
+		if err != nil && err.Error() != st.errs[kind] {
+			log.Printf("Unable to send %s to Envoy %s/%s over incremental ADS: %v", kind, st.node.Cluster, st.node.ID, err)
+		}
+		st.errs[kind] = ""
+		if err != nil {
+			st.errs[kind] = err.Error()
+		}
+	}
+	return res
+}
+
+// deltaResponse returns the resources added or updated since the ones Envoy has, and the names of removed ones.
+// It returns false when Envoy is up to date, or when the update needs to wait for updates of other kinds.
+// It must be called with the lock held.
+func (s *Server) deltaResponse(kind string, st *deltaStream) (*discovery.DeltaDiscoveryResponse, bool, error) {
+	status := st.status
+	snap := s.snapshot(st.node)
+	ver := snap.versions[kind]
+
+	typeURL, err := snap.typeURL(kind, st.typeURLs[kind])
+	if err != nil {
+		return nil, false, err
+	}
+
+	if v, ok := st.versions[kind]; ok && v == ver {
+		return nil, false, nil
+	}
+
+	// Resending the version Envoy has just rejected would only be rejected again
+	if nack, ok := status.Nacked[kind]; ok && nack.Version == ver {
+		return nil, false, nil
+	}
+
+	if !s.ready(kind, status, snap) {
+		return nil, false, nil
+	}
+
+	have := st.has(kind)
+	res := &discovery.DeltaDiscoveryResponse{
+		SystemVersionInfo: ver,
+		TypeUrl:           typeURL,
+	}
+
+	current := map[string]bool{}
+	for i, r := range snap.resources[kind] {
+		name := r.Name()
+		if !st.wildcards[kind] && !st.names[kind][name] {
+			continue
+		}
+		current[name] = true
+		v := snap.resourceVersions[kind][i]
+		if have[name] == v {
+			continue
+		}
+		a, err := toAny(r)
+		if err != nil {
+			return nil, false, err
+		}
+		res.Resources = append(res.Resources, &discovery.Resource{Name: name, Version: v, Resource: a})
+	}
+
+	for name := range have {
+		if !current[name] {
+			res.RemovedResources = append(res.RemovedResources, name)
+		}
+	}
+	sort.Strings(res.RemovedResources)
+
+	st.versions[kind] = ver
+
+	// Envoy already has all the resources, as on reconnecting with the resources of the current version
+	if len(res.Resources) == 0 && len(res.RemovedResources) == 0 {
+		st.acked[kind] = ver
+		status.Acked[kind] = ver
+		return nil, false, nil
+	}
+
+	res.Nonce = strconv.FormatUint(atomic.AddUint64(&s.nonce, 1), 10)
+
+	// The changes are applied to the resources Envoy has once Envoy ACKs them
+	u := deltaUpdate{nonce: res.Nonce, resources: map[string]string{}}
+	for _, r := range res.Resources {
+		u.resources[r.Name] = r.Version
+	}
+	for _, name := range res.RemovedResources {
+		u.resources[name] = ""
+	}
+	st.pending[kind] = append(st.pending[kind], u)
+	st.sent[kind] = sent{version: ver, nonce: res.Nonce}
+	status.sent[kind] = st.sent[kind]
+
+	return res, true, nil
+}
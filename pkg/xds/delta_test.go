@@ -0,0 +1,160 @@
+package xds
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/google/go-cmp/cmp"
+	rpcstatus "google.golang.org/genproto/googleapis/rpc/status"
+)
+
+const testCDSv3Canary = `- "@type": type.googleapis.com/envoy.config.cluster.v3.Cluster
+  name: podinfo-canary
+  connect_timeout: 0.25s
+`
+
+func TestDeltaADS(t *testing.T) {
+	s := NewServer()
+	if err := s.Update("configmaps/envoy-xds", "", "", map[string]string{"cds.yaml": testCDSv3 + testCDSv3Canary, "rds.json": testRDS}); err != nil {
+		t.Fatal(err)
+	}
+
+	client, stop := dialADS(t, s)
+	defer stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := client.DeltaAggregatedResources(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	send := func(req *discovery.DeltaDiscoveryRequest) {
+		t.Helper()
+		if err := stream.Send(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recv := func() *discovery.DeltaDiscoveryResponse {
+		t.Helper()
+		res, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	names := func(res *discovery.DeltaDiscoveryResponse) map[string]string {
+		m := map[string]string{}
+		for _, r := range res.Resources {
+			m[r.Name] = r.Version
+		}
+		return m
+	}
+
+	// Envoy reconnecting with the current version of podinfo-primary gets podinfo-canary only
+	primary := s.snapshot(Node{}).resourceVersions[KindClusters][0]
+	send(&discovery.DeltaDiscoveryRequest{
+		Node:                    &core.Node{Id: "envoy-1", Cluster: "front"},
+		TypeUrl:                 typeCluster,
+		InitialResourceVersions: map[string]string{"podinfo-primary": primary, "podinfo-old": "1"},
+	})
+	send(&discovery.DeltaDiscoveryRequest{TypeUrl: typeRoute})
+
+	clusters := recv()
+	if clusters.TypeUrl != typeCluster || clusters.SystemVersionInfo == "" || clusters.Nonce == "" {
+		t.Fatalf("unexpected clusters: %v", clusters)
+	}
+	if _, ok := names(clusters)["podinfo-canary"]; !ok || len(clusters.Resources) != 1 {
+		t.Errorf("unexpected clusters: %v", names(clusters))
+	}
+	if diff := cmp.Diff([]string{"podinfo-old"}, clusters.RemovedResources); diff != "" {
+		t.Errorf(diff)
+	}
+
+	// ACK of the clusters lets the routes through
+	send(&discovery.DeltaDiscoveryRequest{TypeUrl: typeCluster, ResponseNonce: clusters.Nonce})
+	routes := recv()
+	if routes.TypeUrl != typeRoute || len(routes.Resources) != 1 {
+		t.Fatalf("unexpected routes: %v", routes)
+	}
+	send(&discovery.DeltaDiscoveryRequest{TypeUrl: typeRoute, ResponseNonce: routes.Nonce})
+
+	// Subscribing to a resource again sends it even when the snapshot is unchanged
+	send(&discovery.DeltaDiscoveryRequest{TypeUrl: typeRoute, ResourceNamesUnsubscribe: []string{"*", "local_route"}})
+	send(&discovery.DeltaDiscoveryRequest{TypeUrl: typeRoute, ResourceNamesSubscribe: []string{"local_route"}})
+	resubscribed := recv()
+	if _, ok := names(resubscribed)["local_route"]; !ok || resubscribed.SystemVersionInfo != routes.SystemVersionInfo {
+		t.Errorf("unexpected routes: %v", resubscribed)
+	}
+
+	// Updating one cluster and removing the other sends only the differences
+	if err := s.Update("configmaps/envoy-xds", "", "", map[string]string{"cds.yaml": `resources:
+- "@type": type.googleapis.com/envoy.config.cluster.v3.Cluster
+  name: podinfo-primary
+  connect_timeout: 1s
+`, "rds.json": testRDS}); err != nil {
+		t.Fatal(err)
+	}
+	updated := recv()
+	if _, ok := names(updated)["podinfo-primary"]; !ok || len(updated.Resources) != 1 {
+		t.Errorf("unexpected updated clusters: %v", names(updated))
+	}
+	if diff := cmp.Diff([]string{"podinfo-canary"}, updated.RemovedResources); diff != "" {
+		t.Errorf(diff)
+	}
+
+	// NACKs are recorded per node
+	send(&discovery.DeltaDiscoveryRequest{TypeUrl: typeCluster, ResponseNonce: updated.Nonce, ErrorDetail: &rpcstatus.Status{Message: "invalid cluster"}})
+	for i := 0; len(s.Nodes()[0].Nacked) == 0; i++ {
+		if i == 100 {
+			t.Fatal("NACK isn't recorded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	nodes := s.Nodes()
+	if nack := nodes[0].Nacked[KindClusters]; nack.Version != updated.SystemVersionInfo || nack.Message != "invalid cluster" {
+		t.Errorf("unexpected nack: %+v", nack)
+	}
+	if nodes[0].Acked[KindClusters] != clusters.SystemVersionInfo || nodes[0].Acked[KindRoutes] != routes.SystemVersionInfo {
+		t.Errorf("unexpected acked: %+v", nodes[0].Acked)
+	}
+
+	// The next update resends the rejected changes along with the new ones, as Envoy still has the previous resources
+	if err := s.Update("configmaps/envoy-xds", "", "", map[string]string{"cds.yaml": `resources:
+- "@type": type.googleapis.com/envoy.config.cluster.v3.Cluster
+  name: podinfo-primary
+  connect_timeout: 1s
+- "@type": type.googleapis.com/envoy.config.cluster.v3.Cluster
+  name: podinfo-next
+  connect_timeout: 1s
+`, "rds.json": testRDS}); err != nil {
+		t.Fatal(err)
+	}
+	resent := recv()
+	if diff := cmp.Diff(map[string]string{"podinfo-primary": names(updated)["podinfo-primary"], "podinfo-next": names(resent)["podinfo-next"]}, names(resent)); diff != "" || names(resent)["podinfo-next"] == "" {
+		t.Errorf("unexpected resent clusters: %s", diff)
+	}
+	if diff := cmp.Diff([]string{"podinfo-canary"}, resent.RemovedResources); diff != "" {
+		t.Errorf(diff)
+	}
+	send(&discovery.DeltaDiscoveryRequest{TypeUrl: typeCluster, ResponseNonce: resent.Nonce})
+
+	// Applied changes aren't sent again
+	if err := s.Update("configmaps/envoy-xds", "", "", map[string]string{"cds.yaml": `resources:
+- "@type": type.googleapis.com/envoy.config.cluster.v3.Cluster
+  name: podinfo-primary
+  connect_timeout: 1s
+`, "rds.json": testRDS}); err != nil {
+		t.Fatal(err)
+	}
+	removed := recv()
+	if len(removed.Resources) != 0 {
+		t.Errorf("unexpected clusters: %v", names(removed))
+	}
+	if diff := cmp.Diff([]string{"podinfo-next"}, removed.RemovedResources); diff != "" {
+		t.Errorf(diff)
+	}
+}
@@ -0,0 +1,178 @@
+package xds
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// NodeStatus is what the server knows about an Envoy from its requests.
+// Envoys polling over REST-JSON are identified by their node IDs and clusters, while each gRPC stream has its own status,
+// as replicas of a deployment usually share the node ID and the cluster.
+type NodeStatus struct {
+	ID      string `json:"id"`
+	Cluster string `json:"cluster"`
+	// Stream is the ID of the gRPC stream of the Envoy, or 0 for Envoys polling over REST-JSON
+	Stream uint64 `json:"stream,omitempty"`
+	// Address is the address of the Envoy connected over gRPC
+	Address string `json:"address,omitempty"`
+	// Acked are the versions Envoy has applied, keyed by kind
+	Acked map[string]string `json:"acked"`
+	// Nacked are the latest versions Envoy has rejected, keyed by kind.
+	// A kind is removed once Envoy applies a version of it.
+	Nacked map[string]Nack `json:"nacked,omitempty"`
+	// LastSeen is the time of the latest request from Envoy
+	LastSeen time.Time `json:"last_seen"`
+
+	// subscribed are the kinds Envoy has requested
+	subscribed map[string]bool
+	// sent are the latest responses, to tell which version a NACK is for
+	sent map[string]sent
+}
+
+// Nack is a version rejected by Envoy
+type Nack struct {
+	Version string    `json:"version"`
+	Nonce   string    `json:"nonce"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+type sent struct {
+	version, nonce string
+}
+
+// observe records the request in the status, and returns the status.
+// It must be called with the lock held.
+func (s *Server) observe(status *NodeStatus, kind string, req DiscoveryRequest) *NodeStatus {
+	status.LastSeen = time.Now()
+	status.subscribed[kind] = true
+
+	// Envoy always sends the version it has applied, whether it accepted the previous response or not
+	prev := status.Acked[kind]
+	status.Acked[kind] = req.VersionInfo
+
+	if req.ErrorDetail != nil {
+		s.nack(status, kind, req.ResponseNonce, req.ErrorDetail.Message)
+	} else if req.VersionInfo != prev && req.VersionInfo != "" {
+		delete(status.Nacked, kind)
+	}
+
+	return status
+}
+
+func newNodeStatus(n Node) *NodeStatus {
+	return &NodeStatus{
+		ID:         n.ID,
+		Cluster:    n.Cluster,
+		Acked:      map[string]string{},
+		Nacked:     map[string]Nack{},
+		subscribed: map[string]bool{},
+		sent:       map[string]sent{},
+	}
+}
+
+// node returns the status of the node polling over REST-JSON, which is created on the first request of it.
+// It must be called with the lock held.
+func (s *Server) node(n Node) *NodeStatus {
+	key := Node{ID: n.ID, Cluster: n.Cluster}
+	status, ok := s.nodes[key]
+	if !ok {
+		status = newNodeStatus(key)
+		s.nodes[key] = status
+	}
+	return status
+}
+
+// openStream returns the status of a new gRPC stream from the address, which is reported until closeStream is called.
+// The node is set on the first request of the stream.
+func (s *Server) openStream(addr string) *NodeStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := newNodeStatus(Node{})
+	status.Stream = atomic.AddUint64(&s.streamID, 1)
+	status.Address = addr
+	s.streams[status.Stream] = status
+	return status
+}
+
+func (s *Server) closeStream(status *NodeStatus) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.streams, status.Stream)
+}
+
+// nack records the rejection of the response with the nonce, and logs it once per response.
+// It must be called with the lock held.
+func (s *Server) nack(status *NodeStatus, kind, nonce, message string) {
+	nack := Nack{Nonce: nonce, Message: message, Time: status.LastSeen}
+	if last, ok := status.sent[kind]; ok && last.nonce == nonce {
+		nack.Version = last.version
+	}
+	if existing, ok := status.Nacked[kind]; !ok || existing.Nonce != nack.Nonce {
+		log.Printf("Envoy %s/%s rejected %s version %q: %s", status.Cluster, status.ID, kind, nack.Version, nack.Message)
+	}
+	status.Nacked[kind] = nack
+}
+
+// Nodes returns the statuses of Envoys that have sent requests, ordered by node ID, cluster and stream
+func (s *Server) Nodes() []NodeStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	statuses := make([]*NodeStatus, 0, len(s.nodes)+len(s.streams))
+	for _, n := range s.nodes {
+		statuses = append(statuses, n)
+	}
+	for _, n := range s.streams {
+		// Streams are reported once Envoy sends a request over them
+		if !n.LastSeen.IsZero() {
+			statuses = append(statuses, n)
+		}
+	}
+
+	var res []NodeStatus
+	for _, n := range statuses {
+		c := *n
+		c.Acked = map[string]string{}
+		for k, v := range n.Acked {
+			c.Acked[k] = v
+		}
+		c.Nacked = map[string]Nack{}
+		for k, v := range n.Nacked {
+			c.Nacked[k] = v
+		}
+		res = append(res, c)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].ID != res[j].ID {
+			return res[i].ID < res[j].ID
+		}
+		if res[i].Cluster != res[j].Cluster {
+			return res[i].Cluster < res[j].Cluster
+		}
+		return res[i].Stream < res[j].Stream
+	})
+	return res
+}
+
+func (s *Server) serveNodes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	nodes := s.Nodes()
+	if nodes == nil {
+		nodes = []NodeStatus{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(nodes); err != nil {
+		log.Printf("Failed writing node statuses: %v", err)
+	}
+}
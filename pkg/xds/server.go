@@ -0,0 +1,489 @@
+// Package xds serves Envoy configs produced by crossover over the REST-JSON variant of Envoy's xDS API and over
+// gRPC ADS, so that Envoys can fetch configs from crossover instead of reading files from a volume shared with it.
+//
+// See https://www.envoyproxy.io/docs/envoy/latest/api-docs/xds_protocol
+package xds
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Kinds of resources, that are also the names of the REST-JSON endpoints like `/v3/discovery:clusters`
+const (
+	KindClusters  = "clusters"
+	KindListeners = "listeners"
+	KindRoutes    = "routes"
+	KindEndpoints = "endpoints"
+	KindSecrets   = "secrets"
+)
+
+// order is the order in which updates are sent, so that Envoy never sees a reference to a resource it doesn't have yet.
+// Secrets come first as clusters and listeners refer to them.
+var order = []string{KindSecrets, KindClusters, KindEndpoints, KindListeners, KindRoutes}
+
+// kindsByTypeSuffix maps the last segment of resource type URLs to kinds, so that both v2 and v3 resources are served
+var kindsByTypeSuffix = map[string]string{
+	"Cluster":               KindClusters,
+	"Listener":              KindListeners,
+	"RouteConfiguration":    KindRoutes,
+	"ClusterLoadAssignment": KindEndpoints,
+	"Secret":                KindSecrets,
+}
+
+// v3TypeURLs are the type URLs of responses when Envoy doesn't specify one in the request
+var v3TypeURLs = map[string]string{
+	KindClusters:  "type.googleapis.com/envoy.config.cluster.v3.Cluster",
+	KindListeners: "type.googleapis.com/envoy.config.listener.v3.Listener",
+	KindRoutes:    "type.googleapis.com/envoy.config.route.v3.RouteConfiguration",
+	KindEndpoints: "type.googleapis.com/envoy.config.endpoint.v3.ClusterLoadAssignment",
+	KindSecrets:   "type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.Secret",
+}
+
+// Resource is an Envoy resource decoded from a DiscoveryResponse file
+type Resource map[string]interface{}
+
+// Name returns the name of the resource. ClusterLoadAssignments are named by `cluster_name`.
+func (r Resource) Name() string {
+	if n, ok := r["name"].(string); ok {
+		return n
+	}
+	if n, ok := r["cluster_name"].(string); ok {
+		return n
+	}
+	return ""
+}
+
+// DiscoveryRequest is the subset of Envoy's DiscoveryRequest used by the REST-JSON API
+type DiscoveryRequest struct {
+	VersionInfo   string       `json:"version_info,omitempty"`
+	Node          Node         `json:"node,omitempty"`
+	ResourceNames []string     `json:"resource_names,omitempty"`
+	TypeURL       string       `json:"type_url,omitempty"`
+	ResponseNonce string       `json:"response_nonce,omitempty"`
+	ErrorDetail   *ErrorDetail `json:"error_detail,omitempty"`
+}
+
+// Node identifies the Envoy
+type Node struct {
+	ID      string `json:"id,omitempty"`
+	Cluster string `json:"cluster,omitempty"`
+}
+
+// ErrorDetail is set by Envoy when it rejected the previous response
+type ErrorDetail struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// DiscoveryResponse is Envoy's DiscoveryResponse
+type DiscoveryResponse struct {
+	VersionInfo string     `json:"version_info"`
+	Resources   []Resource `json:"resources"`
+	TypeURL     string     `json:"type_url"`
+	Nonce       string     `json:"nonce"`
+}
+
+// Server is the xDS server serving REST-JSON and ADS.
+// Snapshots are updated per source, like a configmap, and the resources of all the sources matching an Envoy are
+// served together, as if Envoy read all the files crossover writes to the output directory.
+type Server struct {
+	mu sync.RWMutex
+	// sources are the resources of each source
+	sources map[string]source
+	// snapshots are the resources served to each node, computed on demand from the sources
+	snapshots map[Node]*snapshot
+	// nodes are the statuses of Envoys polling over REST-JSON, keyed by node ID and cluster
+	nodes map[Node]*NodeStatus
+	// streams are the statuses of gRPC streams, keyed by stream IDs
+	streams map[uint64]*NodeStatus
+	// changed is closed and replaced on every update, to let gRPC streams push the update
+	changed chan struct{}
+
+	nonce    uint64
+	streamID uint64
+}
+
+// source is the resources read from a configmap or a secret
+type source struct {
+	// serviceNode and serviceCluster restrict the source to Envoys started with the `--service-node` and
+	// `--service-cluster` flags. Empty values match any Envoy.
+	serviceNode, serviceCluster string
+	// resources are keyed by kind
+	resources map[string][]Resource
+	// versions are the versions of each resource, in the same order as resources
+	versions map[string][]string
+}
+
+func (s source) matches(n Node) bool {
+	return (s.serviceNode == "" || s.serviceNode == n.ID) && (s.serviceCluster == "" || s.serviceCluster == n.Cluster)
+}
+
+// snapshot is the resources and their versions served to a node, keyed by kind
+type snapshot struct {
+	resources map[string][]Resource
+	versions  map[string]string
+	// resourceVersions are the versions of each resource, in the same order as resources, for incremental ADS
+	resourceVersions map[string][]string
+	// typeURLs are the `@type` shared by the resources of each kind. It is missing for kinds without resources.
+	typeURLs map[string]string
+	// errs are why the resources of each kind can't be served, like when resources of v2 and v3 are mixed
+	errs map[string]error
+}
+
+// NewServer returns a server with an empty snapshot
+func NewServer() *Server {
+	return &Server{
+		sources:   map[string]source{},
+		snapshots: map[Node]*snapshot{},
+		nodes:     map[Node]*NodeStatus{},
+		streams:   map[uint64]*NodeStatus{},
+		changed:   make(chan struct{}),
+	}
+}
+
+// Update replaces the resources of the source with the ones in the files, which are DiscoveryResponses in YAML or JSON.
+// The resources are served only to Envoys with the service node and cluster, when they are not empty.
+// Files that aren't DiscoveryResponses, like the bootstrap config, are ignored.
+// On error, the previous resources of the source are kept.
+func (s *Server) Update(name, serviceNode, serviceCluster string, files map[string]string) error {
+	src := source{serviceNode: serviceNode, serviceCluster: serviceCluster, resources: map[string][]Resource{}, versions: map[string][]string{}}
+
+	names := make([]string, 0, len(files))
+	for n := range files {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	for _, n := range names {
+		resources, err := parseResources(files[n])
+		if err != nil {
+			return fmt.Errorf("%s: %v", n, err)
+		}
+		for _, r := range resources {
+			kind, ok := kindOf(r)
+			if !ok {
+				continue
+			}
+			ver, err := version(r)
+			if err != nil {
+				return fmt.Errorf("%s: resource %q: %v", n, r.Name(), err)
+			}
+			src.resources[kind] = append(src.resources[kind], r)
+			src.versions[kind] = append(src.versions[kind], ver)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sources[name] = src
+	s.snapshots = map[Node]*snapshot{}
+	close(s.changed)
+	s.changed = make(chan struct{})
+
+	return nil
+}
+
+// snapshot returns the resources served to the node. It must be called with the lock held.
+func (s *Server) snapshot(n Node) *snapshot {
+	key := Node{ID: n.ID, Cluster: n.Cluster}
+	if snap, ok := s.snapshots[key]; ok {
+		return snap
+	}
+
+	names := make([]string, 0, len(s.sources))
+	for name := range s.sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	snap := &snapshot{
+		resources:        map[string][]Resource{},
+		versions:         map[string]string{},
+		resourceVersions: map[string][]string{},
+		typeURLs:         map[string]string{},
+		errs:             map[string]error{},
+	}
+	for _, kind := range order {
+		var (
+			resources []Resource
+			versions  []string
+		)
+		for _, name := range names {
+			if src := s.sources[name]; src.matches(n) {
+				resources = append(resources, src.resources[kind]...)
+				versions = append(versions, src.versions[kind]...)
+			}
+		}
+		snap.resources[kind] = resources
+		snap.resourceVersions[kind] = versions
+		snap.versions[kind] = hash(strings.Join(versions, ","))
+		for _, r := range resources {
+			t := typeOf(r)
+			if prev, ok := snap.typeURLs[kind]; ok && prev != t {
+				snap.errs[kind] = fmt.Errorf("%s %q is of type %s while others are of type %s", kind, r.Name(), t, prev)
+				break
+			}
+			snap.typeURLs[kind] = t
+		}
+	}
+	s.snapshots[key] = snap
+
+	return snap
+}
+
+// version returns the version derived from the content of the resource, so that the same resource
+// always has the same version across restarts and replicas of crossover
+func version(r Resource) (string, error) {
+	bs, err := json.Marshal(r)
+	if err != nil {
+		// e.g. `.inf` and `.nan` are valid in YAML but can't be represented in JSON
+		return "", err
+	}
+	return hash(string(bs)), nil
+}
+
+func hash(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:8])
+}
+
+func parseResources(conf string) ([]Resource, error) {
+	var doc struct {
+		Resources []Resource `yaml:"resources"`
+	}
+	if err := yaml.Unmarshal([]byte(conf), &doc); err != nil {
+		return nil, err
+	}
+	for _, r := range doc.Resources {
+		normalize(r)
+	}
+	return doc.Resources, nil
+}
+
+// normalize converts maps with non-string keys decoded from YAML, which can't be encoded in JSON, in place
+func normalize(v interface{}) {
+	switch t := v.(type) {
+	case Resource:
+		normalize(map[string]interface{}(t))
+	case map[string]interface{}:
+		for k, e := range t {
+			t[k] = stringKeys(e)
+			normalize(t[k])
+		}
+	case []interface{}:
+		for i, e := range t {
+			t[i] = stringKeys(e)
+			normalize(t[i])
+		}
+	}
+}
+
+func stringKeys(v interface{}) interface{} {
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return v
+	}
+	res := map[string]interface{}{}
+	for k, e := range m {
+		res[fmt.Sprint(k)] = e
+	}
+	return res
+}
+
+func kindOf(r Resource) (string, bool) {
+	return kindOfTypeURL(typeOf(r))
+}
+
+func typeOf(r Resource) string {
+	t, _ := r["@type"].(string)
+	return t
+}
+
+// ServeHTTP serves `/v3/discovery:<kind>` and `/v2/discovery:<kind>`, and the statuses of nodes at `/nodes`
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/nodes" {
+		s.serveNodes(w, r)
+		return
+	}
+
+	var kind string
+	for _, prefix := range []string{"/v3/discovery:", "/v2/discovery:"} {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			kind = strings.TrimPrefix(r.URL.Path, prefix)
+		}
+	}
+	if _, ok := v3TypeURLs[kind]; !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req := DiscoveryRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid discovery request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	res, ok, err := s.respond(kind, req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !ok {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Printf("Failed writing discovery response: %v", err)
+	}
+}
+
+// respond records the ACK or NACK in the request, and returns the response to it.
+// It returns false when Envoy is up to date, or when the update needs to wait for updates of other kinds.
+// It returns an error when the resources can't be served as the type Envoy requested.
+func (s *Server) respond(kind string, req DiscoveryRequest) (DiscoveryResponse, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.response(kind, req, s.observe(s.node(req.Node), kind, req))
+}
+
+// response returns the response to the request of the node with the status, without recording the request.
+// It must be called with the lock held.
+func (s *Server) response(kind string, req DiscoveryRequest, status *NodeStatus) (DiscoveryResponse, bool, error) {
+	snap := s.snapshot(req.Node)
+	ver := snap.versions[kind]
+
+	typeURL, err := snap.typeURL(kind, req.TypeURL)
+	if err != nil {
+		return DiscoveryResponse{}, false, err
+	}
+
+	// Envoy sends the version it has applied, so that nothing needs to be sent when nothing has changed
+	if req.VersionInfo == ver {
+		return DiscoveryResponse{}, false, nil
+	}
+
+	// Resending the version Envoy has just rejected would only be rejected again
+	if nack, ok := status.Nacked[kind]; ok && nack.Version == ver {
+		return DiscoveryResponse{}, false, nil
+	}
+
+	if !s.ready(kind, status, snap) {
+		return DiscoveryResponse{}, false, nil
+	}
+
+	res := DiscoveryResponse{
+		VersionInfo: ver,
+		Resources:   filterResources(snap.resources[kind], req.ResourceNames),
+		TypeURL:     typeURL,
+		Nonce:       strconv.FormatUint(atomic.AddUint64(&s.nonce, 1), 10),
+	}
+	if res.Resources == nil {
+		res.Resources = []Resource{}
+	}
+
+	status.sent[kind] = sent{version: ver, nonce: res.Nonce}
+
+	return res, true, nil
+}
+
+// typeURL returns the type URL of the response of the kind, which is the `@type` of the resources,
+// so that Envoy never receives resources of a type other than the one in the response.
+// It returns an error when Envoy requested another type, like v3 resources when the resources are of v2.
+func (snap *snapshot) typeURL(kind, requested string) (string, error) {
+	if err := snap.errs[kind]; err != nil {
+		return "", err
+	}
+	t, ok := snap.typeURLs[kind]
+	if !ok {
+		if requested != "" {
+			return requested, nil
+		}
+		return v3TypeURLs[kind], nil
+	}
+	if requested != "" && requested != t {
+		return "", fmt.Errorf("%s are of type %s while %s is requested", kind, t, requested)
+	}
+	return t, nil
+}
+
+// ready returns true if Envoy has applied the current versions of every kind it subscribes to that comes before the kind,
+// so that e.g. routes never refer to clusters Envoy doesn't know yet
+func (s *Server) ready(kind string, status *NodeStatus, snap *snapshot) bool {
+	for _, k := range order {
+		if k == kind {
+			return true
+		}
+		if !status.subscribed[k] {
+			continue
+		}
+		if status.Acked[k] != snap.versions[k] {
+			return false
+		}
+	}
+	return true
+}
+
+// filterResources returns the resources with the names, or all the resources when no name is given
+func filterResources(resources []Resource, names []string) []Resource {
+	if len(names) == 0 {
+		return resources
+	}
+	wanted := map[string]bool{}
+	for _, n := range names {
+		wanted[n] = true
+	}
+	var res []Resource
+	for _, r := range resources {
+		if wanted[r.Name()] {
+			res = append(res, r)
+		}
+	}
+	return res
+}
+
+// ListenAndServe serves xDS on the address until the context is canceled
+func (s *Server) ListenAndServe(ctx context.Context, addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	srv := &http.Server{Handler: s}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	log.Printf("Serving xDS on %s", l.Addr())
+	if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
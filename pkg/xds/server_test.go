@@ -0,0 +1,274 @@
+package xds
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+const testCDS = `version_info: "0"
+resources:
+- "@type": type.googleapis.com/envoy.api.v2.Cluster
+  name: podinfo-primary
+  connect_timeout: 0.25s
+- "@type": type.googleapis.com/envoy.api.v2.Cluster
+  name: podinfo-canary
+  connect_timeout: 0.25s
+`
+
+const testRDS = `{
+  "version_info": "0",
+  "resources": [
+    {"@type": "type.googleapis.com/envoy.config.route.v3.RouteConfiguration", "name": "local_route"}
+  ]
+}
+`
+
+func discover(t *testing.T, s *Server, path string, req DiscoveryRequest) (int, DiscoveryResponse) {
+	t.Helper()
+
+	bs, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, bytes.NewReader(bs)))
+
+	res := DiscoveryResponse{}
+	if rec.Code == http.StatusOK {
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+			t.Fatalf("%s: %v: %s", path, err, rec.Body.String())
+		}
+	}
+	return rec.Code, res
+}
+
+func TestServer(t *testing.T) {
+	s := NewServer()
+
+	if err := s.Update("configmaps/envoy-xds", "", "", map[string]string{
+		"cds.yaml":   testCDS,
+		"rds.json":   testRDS,
+		"envoy.yaml": "admin: {}\n",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	code, clusters := discover(t, s, "/v3/discovery:clusters", DiscoveryRequest{Node: Node{ID: "envoy-1"}})
+	if code != http.StatusOK {
+		t.Fatalf("unexpected status: %d", code)
+	}
+	var names []string
+	for _, r := range clusters.Resources {
+		names = append(names, r.Name())
+	}
+	if d := cmp.Diff([]string{"podinfo-primary", "podinfo-canary"}, names); d != "" {
+		t.Errorf("unexpected clusters: %s", d)
+	}
+	if clusters.TypeURL != "type.googleapis.com/envoy.api.v2.Cluster" {
+		t.Errorf("unexpected type_url: %s", clusters.TypeURL)
+	}
+	if clusters.VersionInfo == "" || clusters.Nonce == "" {
+		t.Errorf("missing version_info or nonce: %+v", clusters)
+	}
+
+	// ACK of the current version
+	code, _ = discover(t, s, "/v3/discovery:clusters", DiscoveryRequest{Node: Node{ID: "envoy-1"}, VersionInfo: clusters.VersionInfo, ResponseNonce: clusters.Nonce})
+	if code != http.StatusNotModified {
+		t.Errorf("unexpected status for the current version: %d", code)
+	}
+
+	// The version rejected by Envoy isn't sent again, and is reported per node
+	_, rejected := discover(t, s, "/v3/discovery:clusters", DiscoveryRequest{Node: Node{ID: "envoy-2", Cluster: "front"}})
+	code, _ = discover(t, s, "/v3/discovery:clusters", DiscoveryRequest{
+		Node:          Node{ID: "envoy-2", Cluster: "front"},
+		ResponseNonce: rejected.Nonce,
+		ErrorDetail:   &ErrorDetail{Message: "invalid cluster"},
+	})
+	if code != http.StatusNotModified {
+		t.Errorf("unexpected status for NACK: %d", code)
+	}
+	nodes := s.Nodes()
+	if len(nodes) != 2 || nodes[1].ID != "envoy-2" || nodes[1].Cluster != "front" {
+		t.Fatalf("unexpected nodes: %+v", nodes)
+	}
+	nack := nodes[1].Nacked[KindClusters]
+	if nack.Version != rejected.VersionInfo || nack.Nonce != rejected.Nonce || nack.Message != "invalid cluster" {
+		t.Errorf("unexpected nack: %+v", nack)
+	}
+	if len(nodes[0].Nacked) != 0 {
+		t.Errorf("unexpected nacks of envoy-1: %+v", nodes[0].Nacked)
+	}
+
+	code, filtered := discover(t, s, "/v3/discovery:clusters", DiscoveryRequest{Node: Node{ID: "envoy-3"}, ResourceNames: []string{"podinfo-canary"}})
+	if code != http.StatusOK || len(filtered.Resources) != 1 || filtered.Resources[0].Name() != "podinfo-canary" {
+		t.Errorf("unexpected filtered clusters: %d %+v", code, filtered)
+	}
+
+	// The type of the response is the one of the resources, and requests for another type are rejected
+	code, _ = discover(t, s, "/v2/discovery:routes", DiscoveryRequest{TypeURL: "type.googleapis.com/envoy.api.v2.RouteConfiguration"})
+	if code != http.StatusBadRequest {
+		t.Errorf("unexpected status for routes of another type: %d", code)
+	}
+	code, routes := discover(t, s, "/v3/discovery:routes", DiscoveryRequest{TypeURL: "type.googleapis.com/envoy.config.route.v3.RouteConfiguration"})
+	if code != http.StatusOK || len(routes.Resources) != 1 || routes.TypeURL != "type.googleapis.com/envoy.config.route.v3.RouteConfiguration" {
+		t.Errorf("unexpected routes: %d %+v", code, routes)
+	}
+
+	code, listeners := discover(t, s, "/v3/discovery:listeners", DiscoveryRequest{})
+	if code != http.StatusOK || len(listeners.Resources) != 0 {
+		t.Errorf("unexpected listeners: %d %+v", code, listeners)
+	}
+
+	// Only the version of the updated kind changes
+	if err := s.Update("configmaps/envoy-xds", "", "", map[string]string{"cds.yaml": testCDS}); err != nil {
+		t.Fatal(err)
+	}
+	code, _ = discover(t, s, "/v3/discovery:clusters", DiscoveryRequest{VersionInfo: clusters.VersionInfo})
+	if code != http.StatusNotModified {
+		t.Errorf("unexpected status for unchanged clusters: %d", code)
+	}
+	code, _ = discover(t, s, "/v3/discovery:listeners", DiscoveryRequest{VersionInfo: listeners.VersionInfo})
+	if code != http.StatusNotModified {
+		t.Errorf("unexpected status for unchanged listeners: %d", code)
+	}
+	code, routes = discover(t, s, "/v3/discovery:routes", DiscoveryRequest{VersionInfo: routes.VersionInfo})
+	if code != http.StatusOK || len(routes.Resources) != 0 {
+		t.Errorf("unexpected routes after removal: %d %+v", code, routes)
+	}
+
+	// Broken files keep the previous snapshot
+	if err := s.Update("configmaps/envoy-xds", "", "", map[string]string{"cds.yaml": "resources: ["}); err == nil {
+		t.Error("expected error for broken file")
+	}
+	// So do values that can't be served as JSON
+	if err := s.Update("configmaps/envoy-xds", "", "", map[string]string{"cds.yaml": `resources:
+- "@type": type.googleapis.com/envoy.api.v2.Cluster
+  name: podinfo
+  per_connection_buffer_limit_bytes: .inf
+`}); err == nil {
+		t.Error("expected error for .inf")
+	}
+	_, clusters2 := discover(t, s, "/v3/discovery:clusters", DiscoveryRequest{})
+	if clusters2.VersionInfo != clusters.VersionInfo {
+		t.Errorf("unexpected version after broken update: %s", clusters2.VersionInfo)
+	}
+
+	// Mixing v2 and v3 resources of a kind makes them unservable until fixed
+	if err := s.Update("configmaps/envoy-xds-v3", "", "", map[string]string{"cds.yaml": `resources:
+- "@type": type.googleapis.com/envoy.config.cluster.v3.Cluster
+  name: podinfo-v3
+`}); err != nil {
+		t.Fatal(err)
+	}
+	code, _ = discover(t, s, "/v3/discovery:clusters", DiscoveryRequest{})
+	if code != http.StatusBadRequest {
+		t.Errorf("unexpected status for mixed types: %d", code)
+	}
+}
+
+func TestServerPerNodeSnapshots(t *testing.T) {
+	s := NewServer()
+
+	if err := s.Update("configmaps/common", "", "", map[string]string{"cds.yaml": testCDS}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Update("configmaps/front", "", "front", map[string]string{"rds.json": testRDS}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, front := discover(t, s, "/v3/discovery:routes", DiscoveryRequest{Node: Node{ID: "envoy-1", Cluster: "front"}})
+	if len(front.Resources) != 1 {
+		t.Errorf("unexpected routes of the front cluster: %+v", front)
+	}
+	_, back := discover(t, s, "/v3/discovery:routes", DiscoveryRequest{Node: Node{ID: "envoy-2", Cluster: "back"}})
+	if len(back.Resources) != 0 {
+		t.Errorf("unexpected routes of the back cluster: %+v", back)
+	}
+	_, clusters := discover(t, s, "/v3/discovery:clusters", DiscoveryRequest{Node: Node{ID: "envoy-2", Cluster: "back"}})
+	if len(clusters.Resources) != 2 {
+		t.Errorf("unexpected clusters of the back cluster: %+v", clusters)
+	}
+}
+
+func TestServerOrdering(t *testing.T) {
+	s := NewServer()
+	node := Node{ID: "envoy-1"}
+
+	if err := s.Update("configmaps/envoy-xds", "", "", map[string]string{"cds.yaml": testCDS, "rds.json": testRDS}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, clusters := discover(t, s, "/v3/discovery:clusters", DiscoveryRequest{Node: node})
+	_, routes := discover(t, s, "/v3/discovery:routes", DiscoveryRequest{Node: node})
+	if len(routes.Resources) != 0 {
+		// Envoy has yet to report that it has applied the clusters
+		t.Fatalf("unexpected routes before clusters are applied: %+v", routes)
+	}
+
+	code, _ := discover(t, s, "/v3/discovery:routes", DiscoveryRequest{Node: node})
+	if code != http.StatusNotModified {
+		t.Errorf("unexpected status for routes before clusters are applied: %d", code)
+	}
+
+	code, _ = discover(t, s, "/v3/discovery:clusters", DiscoveryRequest{Node: node, VersionInfo: clusters.VersionInfo, ResponseNonce: clusters.Nonce})
+	if code != http.StatusNotModified {
+		t.Errorf("unexpected status for applied clusters: %d", code)
+	}
+
+	code, routes = discover(t, s, "/v3/discovery:routes", DiscoveryRequest{Node: node})
+	if code != http.StatusOK || len(routes.Resources) != 1 {
+		t.Errorf("unexpected routes after clusters are applied: %d %+v", code, routes)
+	}
+}
+
+func TestServerNodesSharingID(t *testing.T) {
+	s := NewServer()
+
+	if err := s.Update("configmaps/envoy-xds", "", "", map[string]string{"cds.yaml": testCDS}); err != nil {
+		t.Fatal(err)
+	}
+
+	front, back := Node{ID: "envoy", Cluster: "front"}, Node{ID: "envoy", Cluster: "back"}
+	_, clusters := discover(t, s, "/v3/discovery:clusters", DiscoveryRequest{Node: front})
+	discover(t, s, "/v3/discovery:clusters", DiscoveryRequest{Node: front, VersionInfo: clusters.VersionInfo, ResponseNonce: clusters.Nonce})
+	_, rejected := discover(t, s, "/v3/discovery:clusters", DiscoveryRequest{Node: back})
+	discover(t, s, "/v3/discovery:clusters", DiscoveryRequest{Node: back, ResponseNonce: rejected.Nonce, ErrorDetail: &ErrorDetail{Message: "invalid cluster"}})
+
+	nodes := s.Nodes()
+	if len(nodes) != 2 {
+		t.Fatalf("unexpected nodes: %+v", nodes)
+	}
+	if nodes[0].Cluster != "back" || nodes[0].Nacked[KindClusters].Message != "invalid cluster" || nodes[0].Acked[KindClusters] != "" {
+		t.Errorf("unexpected status of the back node: %+v", nodes[0])
+	}
+	if nodes[1].Cluster != "front" || len(nodes[1].Nacked) != 0 || nodes[1].Acked[KindClusters] != clusters.VersionInfo {
+		t.Errorf("unexpected status of the front node: %+v", nodes[1])
+	}
+}
+
+func TestServerInvalidRequests(t *testing.T) {
+	s := NewServer()
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v3/discovery:unknown", bytes.NewReader([]byte("{}"))))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("unexpected status for unknown kind: %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v3/discovery:clusters", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("unexpected status for GET: %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v3/discovery:clusters", bytes.NewReader([]byte("{"))))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("unexpected status for broken request: %d", rec.Code)
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/mumoshu/crossover/pkg/controller"
+	"github.com/mumoshu/crossover/pkg/reconciler"
+	"gopkg.in/yaml.v3"
+)
+
+const renderUsage = `Usage: crossover render --configmap FILE [--trafficsplit FILE]... [--output-dir DIR]
+
+Merges the trafficsplits into the configmap read from local manifests like crossover does in the cluster,
+and prints the generated <configmap>-gen configmap, or writes the Envoy files to the output dir.
+Files are rendered as templates before they are written, when the configmap opts in to the templating.
+`
+
+// runRender runs the `render` subcommand, and returns the exit code
+func runRender(args []string) int {
+	fs := flag.NewFlagSet("render", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, renderUsage)
+		fs.PrintDefaults()
+	}
+	var (
+		configMap     string
+		trafficSplits controller.StringSlice
+		outputDir     string
+		namespace     string
+		templateCMs   controller.StringSlice
+		templateEnv   controller.StringSlice
+	)
+	fs.StringVar(&configMap, "configmap", "", "the file of the configmap manifest")
+	fs.Var(&trafficSplits, "trafficsplit", "the file of trafficsplit manifests. Can be specified multiple times")
+	fs.StringVar(&outputDir, "output-dir", "", "Directory to write Envoy files to instead of printing the configmap")
+	fs.StringVar(&namespace, "namespace", "default", "the namespace of manifests without one")
+	fs.Var(&templateCMs, "template-configmap", "the file of configmap manifests that templates can read via configMapValue. Can be specified multiple times")
+	fs.Var(&templateEnv, "template-env", "the environment variable that templates can read via env, besides POD_NAME and POD_NAMESPACE. Can be specified multiple times")
+	fs.Parse(args)
+
+	if configMap == "" || fs.NArg() > 0 {
+		fs.Usage()
+		return 1
+	}
+
+	opts := renderOptions{
+		namespace:          namespace,
+		outputDir:          outputDir,
+		templateConfigMaps: templateCMs,
+		templateEnv:        templateEnv,
+	}
+	if err := render(os.Stdout, configMap, trafficSplits, opts); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+type renderOptions struct {
+	// namespace is the namespace of manifests without one
+	namespace string
+	// outputDir is where Envoy files are written. The configmap is printed when empty
+	outputDir string
+	// templateConfigMaps are the files of configmaps that templates read via `configMapValue`
+	templateConfigMaps []string
+	// templateEnv are the environment variables that templates read via `env`, besides POD_NAME and POD_NAMESPACE
+	templateEnv []string
+}
+
+func render(out io.Writer, configMapFile string, trafficSplitFiles []string, opts renderOptions) error {
+	cms, err := readManifests(configMapFile, "ConfigMap")
+	if err != nil {
+		return err
+	}
+	if len(cms) != 1 {
+		return fmt.Errorf("%s: expected exactly one ConfigMap, found %d", configMapFile, len(cms))
+	}
+	cm := reconciler.ConfigMap{}
+	if err := json.Unmarshal(cms[0], &cm); err != nil {
+		return fmt.Errorf("%s: %v", configMapFile, err)
+	}
+	if cm.ObjectMeta.Namespace == "" {
+		cm.ObjectMeta.Namespace = opts.namespace
+	}
+
+	var tss []reconciler.TrafficSplit
+	for _, f := range trafficSplitFiles {
+		items, err := readManifests(f, "TrafficSplit")
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			ts := reconciler.TrafficSplit{}
+			if err := json.Unmarshal(item, &ts); err != nil {
+				return fmt.Errorf("%s: %v", f, err)
+			}
+			tss = append(tss, ts)
+		}
+	}
+	for i := range tss {
+		if tss[i].ObjectMeta.Namespace == "" {
+			tss[i].ObjectMeta.Namespace = cm.ObjectMeta.Namespace
+		}
+	}
+
+	gen, err := reconciler.GenerateConfigMap(cm, tss...)
+	if err != nil {
+		return err
+	}
+
+	if opts.outputDir != "" {
+		configMaps := manifestClient{}
+		for _, f := range opts.templateConfigMaps {
+			if err := configMaps.add(f, opts.namespace); err != nil {
+				return err
+			}
+		}
+		files, err := reconciler.RenderConfigMap(gen, configMaps, gen.ObjectMeta.Namespace, opts.templateEnv)
+		if err != nil {
+			return fmt.Errorf("configmap %s/%s: %v", gen.ObjectMeta.Namespace, gen.ObjectMeta.Name, err)
+		}
+		return reconciler.WriteFiles(opts.outputDir, files, reconciler.DefaultFileOptions())
+	}
+
+	return printConfigMap(out, gen)
+}
+
+// readManifests returns the objects of the kind in the YAML or JSON file, which may contain multiple documents and
+// `List`s, in JSON, as the types are defined for the JSON of the API server
+func readManifests(file, kind string) ([]json.RawMessage, error) {
+	bs, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var docs []interface{}
+	dec := yaml.NewDecoder(bytes.NewReader(bs))
+	for {
+		var doc interface{}
+		if err := dec.Decode(&doc); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		docs = append(docs, doc)
+	}
+
+	var res []json.RawMessage
+	for len(docs) > 0 {
+		doc, ok := docs[0].(map[string]interface{})
+		docs = docs[1:]
+		if !ok {
+			continue
+		}
+		switch doc["kind"] {
+		case kind:
+			js, err := json.Marshal(doc)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", file, err)
+			}
+			res = append(res, js)
+		case "List":
+			if items, ok := doc["items"].([]interface{}); ok {
+				docs = append(docs, items...)
+			}
+		}
+	}
+	return res, nil
+}
+
+// manifestClient serves configmaps read from local manifests to templates, in place of the API server
+type manifestClient map[string]json.RawMessage
+
+// add reads the configmaps in the file. Ones without a namespace are in the namespace
+func (c manifestClient) add(file, namespace string) error {
+	items, err := readManifests(file, "ConfigMap")
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		cm := reconciler.ConfigMap{}
+		if err := json.Unmarshal(item, &cm); err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+		if cm.ObjectMeta.Namespace == "" {
+			cm.ObjectMeta.Namespace = namespace
+		}
+		c[cm.ObjectMeta.Namespace+"/"+cm.ObjectMeta.Name] = item
+	}
+	return nil
+}
+
+func (c manifestClient) Get(namespace, name string, obj interface{}) error {
+	item, ok := c[namespace+"/"+name]
+	if !ok {
+		return fmt.Errorf("no manifest of configmap %s/%s: add it with --template-configmap", namespace, name)
+	}
+	return json.Unmarshal(item, obj)
+}
+
+func (c manifestClient) RetryWatch(ctx context.Context, namespace, name string, updated chan string) error {
+	return errors.New("watching local manifests is not supported")
+}
+
+// configMapManifest is the ConfigMap in the order of fields kubectl prints
+type configMapManifest struct {
+	APIVersion string            `yaml:"apiVersion"`
+	Kind       string            `yaml:"kind"`
+	Metadata   metadataManifest  `yaml:"metadata"`
+	Data       map[string]string `yaml:"data,omitempty"`
+	// BinaryData is base64-encoded like the API server does
+	BinaryData map[string]string `yaml:"binaryData,omitempty"`
+}
+
+type metadataManifest struct {
+	Name        string            `yaml:"name"`
+	Namespace   string            `yaml:"namespace,omitempty"`
+	Labels      map[string]string `yaml:"labels,omitempty"`
+	Annotations map[string]string `yaml:"annotations,omitempty"`
+}
+
+func printConfigMap(out io.Writer, cm reconciler.ConfigMap) error {
+	m := configMapManifest{
+		APIVersion: cm.ApiVersion,
+		Kind:       cm.Kind,
+		Metadata: metadataManifest{
+			Name:        cm.ObjectMeta.Name,
+			Namespace:   cm.ObjectMeta.Namespace,
+			Labels:      cm.ObjectMeta.Labels,
+			Annotations: cm.ObjectMeta.Annotations,
+		},
+		Data: cm.Data,
+	}
+	for k, v := range cm.BinaryData {
+		if m.BinaryData == nil {
+			m.BinaryData = map[string]string{}
+		}
+		m.BinaryData[k] = base64.StdEncoding.EncodeToString(v)
+	}
+	if m.APIVersion == "" {
+		m.APIVersion = "v1"
+	}
+	if m.Kind == "" {
+		m.Kind = "ConfigMap"
+	}
+	enc := yaml.NewEncoder(out)
+	enc.SetIndent(2)
+	if err := enc.Encode(m); err != nil {
+		return err
+	}
+	return enc.Close()
+}
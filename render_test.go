@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func writeManifest(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	file := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestReadManifests(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crossover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := writeManifest(t, dir, "manifests.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: first
+---
+apiVersion: split.smi-spec.io/v1alpha1
+kind: TrafficSplit
+metadata:
+  name: podinfo
+---
+apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: ConfigMap
+  metadata:
+    name: second
+- apiVersion: v1
+  kind: List
+  items:
+  - apiVersion: v1
+    kind: ConfigMap
+    metadata:
+      name: third
+---
+{"apiVersion": "v1", "kind": "ConfigMap", "metadata": {"name": "fourth"}}
+`)
+
+	items, err := readManifests(file, "ConfigMap")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, item := range items {
+		var obj struct {
+			Metadata struct {
+				Name string `json:"name"`
+			} `json:"metadata"`
+		}
+		if err := json.Unmarshal(item, &obj); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, obj.Metadata.Name)
+	}
+
+	expected := []string{"first", "fourth", "second", "third"}
+	if diff := cmp.Diff(expected, names); diff != "" {
+		t.Errorf("unexpected configmaps (-expected +actual):\n%s", diff)
+	}
+}
+
+const renderRDS = `resources:
+- name: local_route
+  virtual_hosts:
+  - name: podinfo
+    routes:
+    - route:
+        weighted_clusters:
+          clusters:
+          - name: podinfo-v1
+            weight: 100
+          - name: podinfo-v2
+            weight: 0
+`
+
+const renderTrafficSplits = `apiVersion: v1
+kind: List
+items:
+- apiVersion: split.smi-spec.io/v1alpha1
+  kind: TrafficSplit
+  metadata:
+    name: podinfo
+  spec:
+    service: podinfo
+    backends:
+    - service: podinfo-v1
+      weight: 30
+    - service: podinfo-v2
+      weight: 70
+`
+
+func TestRender(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crossover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configMap := writeManifest(t, dir, "envoy-xds.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: envoy-xds
+data:
+  rds.yaml: |
+`+indentManifest(renderRDS))
+	trafficSplits := writeManifest(t, dir, "trafficsplits.yaml", renderTrafficSplits)
+
+	var out bytes.Buffer
+	if err := render(&out, configMap, []string{trafficSplits}, renderOptions{namespace: "test"}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: envoy-xds-gen
+  namespace: test
+data:
+  rds.yaml: |
+` + indentManifest(strings.Replace(strings.Replace(renderRDS, "weight: 100", "weight: 30", 1), "weight: 0", "weight: 70", 1))
+	if diff := cmp.Diff(expected, out.String()); diff != "" {
+		t.Errorf("unexpected configmap (-expected +actual):\n%s", diff)
+	}
+}
+
+func TestRenderOutputDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crossover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	t.Setenv("CONNECT_TIMEOUT", "0.25s")
+
+	configMap := writeManifest(t, dir, "envoy-xds.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: envoy-xds
+  annotations:
+    crossover.mumoshu.github.io/render-templates: "true"
+data:
+  cds.yaml: |
+    resources:
+    - name: "{{ configMapValue "envoy-values" "cluster" }}"
+      connect_timeout: "{{ env "CONNECT_TIMEOUT" }}"
+  rds.yaml: |
+`+indentManifest(renderRDS))
+	values := writeManifest(t, dir, "envoy-values.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: envoy-values
+data:
+  cluster: podinfo-v1
+`)
+	trafficSplits := writeManifest(t, dir, "trafficsplits.yaml", renderTrafficSplits)
+	outputDir := filepath.Join(dir, "out")
+
+	opts := renderOptions{
+		namespace:          "test",
+		outputDir:          outputDir,
+		templateConfigMaps: []string{values},
+		templateEnv:        []string{"CONNECT_TIMEOUT"},
+	}
+	var out bytes.Buffer
+	if err := render(&out, configMap, []string{trafficSplits}, opts); err != nil {
+		t.Fatal(err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("unexpected output: %s", out.String())
+	}
+
+	expected := map[string]string{
+		"cds.yaml": `resources:
+- name: "podinfo-v1"
+  connect_timeout: "0.25s"
+`,
+		"rds.yaml": strings.Replace(strings.Replace(renderRDS, "weight: 100", "weight: 30", 1), "weight: 0", "weight: 70", 1),
+	}
+	for file, content := range expected {
+		actual, err := ioutil.ReadFile(filepath.Join(outputDir, "current", file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(content, string(actual)); diff != "" {
+			t.Errorf("unexpected %s (-expected +actual):\n%s", file, diff)
+		}
+	}
+
+	// Configmaps that templates read must be given as manifests, as there's no API server to get them from
+	opts.templateConfigMaps = nil
+	if err := render(&out, configMap, []string{trafficSplits}, opts); err == nil || !strings.Contains(err.Error(), "--template-configmap") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// indentManifest indents the file to embed it as a block scalar of configmap data
+func indentManifest(s string) string {
+	return "    " + strings.Replace(strings.TrimSuffix(s, "\n"), "\n", "\n    ", -1) + "\n"
+}
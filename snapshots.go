@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mumoshu/crossover/pkg/reconciler"
+)
+
+const snapshotsUsage = `Usage: crossover snapshots [--output-dir DIR] COMMAND
+
+Commands:
+  list                    list snapshots kept with --history, from the oldest to the newest
+  pin ID                  write the snapshot to the output dir, and stop crossover from writing the source of the
+                          snapshot until unpinned
+  unpin KIND/NS/NAME      let crossover write the source like configmaps/default/envoy-xds again
+`
+
+// runSnapshots runs the `snapshots` subcommand, and returns the exit code
+func runSnapshots(args []string) int {
+	fs := flag.NewFlagSet("snapshots", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, snapshotsUsage)
+		fs.PrintDefaults()
+	}
+	outputDir := fs.String("output-dir", "", "Directory crossover writes xDS configs to")
+	fs.Parse(args)
+
+	if err := snapshots(*outputDir, fs.Args()); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		if err == errSnapshotsUsage {
+			fs.Usage()
+		}
+		return 1
+	}
+	return 0
+}
+
+var errSnapshotsUsage = errors.New("invalid arguments")
+
+func snapshots(dir string, args []string) error {
+	if len(args) == 0 {
+		return errSnapshotsUsage
+	}
+
+	switch args[0] {
+	case "list":
+		if len(args) != 1 {
+			return errSnapshotsUsage
+		}
+		snapshots, err := reconciler.ListSnapshots(dir)
+		if err != nil {
+			return err
+		}
+		pinned, err := reconciler.PinnedSnapshots(dir)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tSOURCE\tRESOURCE VERSION\tTIME\tHASH\tFILES\tPINNED")
+		for _, s := range snapshots {
+			var p string
+			if s.ID == pinned[s.Source] {
+				p = "*"
+			}
+			// The metadata may have been edited by hand
+			hash := s.Hash
+			if len(hash) > 12 {
+				hash = hash[:12]
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", s.ID, s.Source, s.ResourceVersion, s.Time.Format(time.RFC3339), hash, strings.Join(s.Files, ","), p)
+		}
+		return w.Flush()
+	case "pin":
+		if len(args) != 2 {
+			return errSnapshotsUsage
+		}
+		if err := reconciler.PinSnapshot(dir, args[1], reconciler.DefaultFileOptions()); err != nil {
+			return err
+		}
+		fmt.Printf("Pinned to snapshot %s\n", args[1])
+		return nil
+	case "unpin":
+		if len(args) != 2 {
+			return errSnapshotsUsage
+		}
+		if err := reconciler.UnpinSnapshot(dir, args[1]); err != nil {
+			return err
+		}
+		fmt.Printf("Unpinned %s. The output dir is updated on the next sync\n", args[1])
+		return nil
+	}
+
+	return errSnapshotsUsage
+}
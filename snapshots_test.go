@@ -0,0 +1,30 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshotsListShortHash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crossover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Metadata edited by hand can have hashes shorter than the ones listed
+	snapshot := filepath.Join(dir, "history", "20201019T090455.123456789Z-abc")
+	if err := os.MkdirAll(snapshot, 0755); err != nil {
+		t.Fatal(err)
+	}
+	meta := `{"id": "20201019T090455.123456789Z-abc", "source": "configmaps/default/envoy-xds", "hash": "abc", "files": ["cds.yaml"]}`
+	if err := ioutil.WriteFile(filepath.Join(snapshot, "metadata.json"), []byte(meta), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := snapshots(dir, []string{"list"}); err != nil {
+		t.Fatal(err)
+	}
+}